@@ -16,5 +16,6 @@ require (
 	github.com/valyala/fasttemplate v1.0.1
 	golang.org/x/crypto v0.0.0-20181203042331-505ab145d0a9
 	golang.org/x/sys v0.0.0-20181205085412-a5c9d58dba9a
+	gopkg.in/yaml.v2 v2.2.2
 	mellium.im/sasl v0.2.1 // indirect
 )
@@ -0,0 +1,103 @@
+package psql
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/dosco/super-graph/qcode"
+)
+
+// aggColName is the name given to the result of an aggregate function
+// in the base select.
+func aggColName(col *qcode.Column) string {
+	if col.Name == "*" {
+		return col.Agg
+	}
+	return col.Agg + "_" + col.Name
+}
+
+// renderAggColumns renders the columns of an aggregate field, the
+// results of each function are put together in an object like
+// '"sum": { "price": 10 }'.
+func (v *selectBlock) renderAggColumns(w io.Writer) {
+	done := make(map[string]struct{})
+	n := 0
+
+	for _, col := range v.sel.Cols {
+		if _, ok := done[col.Agg]; ok && len(col.Agg) != 0 {
+			continue
+		}
+
+		if n != 0 {
+			io.WriteString(w, ", ")
+		}
+		n++
+
+		switch {
+		case len(col.Agg) == 0:
+			fmt.Fprintf(w, `"%s_%d"."%s" AS "%s"`,
+				v.sel.Table, v.sel.ID, col.Name, col.FieldName)
+
+		case col.Name == "*":
+			fmt.Fprintf(w, `"%s_%d"."%s" AS "%s"`,
+				v.sel.Table, v.sel.ID, aggColName(col), col.FieldName)
+
+		default:
+			done[col.Agg] = struct{}{}
+			io.WriteString(w, `json_build_object(`)
+
+			i := 0
+			for _, c := range v.sel.Cols {
+				if c.Agg != col.Agg || c.Name == "*" {
+					continue
+				}
+				if i != 0 {
+					io.WriteString(w, ", ")
+				}
+				fmt.Fprintf(w, `'%s', "%s_%d"."%s"`,
+					c.FieldName, v.sel.Table, v.sel.ID, aggColName(c))
+				i++
+			}
+
+			fmt.Fprintf(w, `) AS "%s"`, col.Agg)
+		}
+	}
+}
+
+func (v *selectBlock) renderAggFunc(w io.Writer, col *qcode.Column) error {
+	if col.Name == "*" {
+		fmt.Fprintf(w, `%s(*) AS "%s"`, col.Agg, aggColName(col))
+		return nil
+	}
+
+	if _, ok := v.ti.Columns[col.Name]; !ok {
+		return fmt.Errorf("unknown column '%s.%s'", v.ti.Name, col.Name)
+	}
+
+	fmt.Fprintf(w, `%s("%s"."%s") AS "%s"`,
+		col.Agg, v.sel.Table, col.Name, aggColName(col))
+
+	return nil
+}
+
+func (v *selectBlock) renderGroupBy(w io.Writer) error {
+	if len(v.sel.GroupBy) == 0 {
+		return nil
+	}
+
+	io.WriteString(w, ` GROUP BY `)
+
+	for i, cn := range v.sel.GroupBy {
+		if _, ok := v.ti.Columns[cn]; !ok {
+			return fmt.Errorf("unknown column '%s.%s' in group_by", v.ti.Name, cn)
+		}
+
+		fmt.Fprintf(w, `"%s"."%s"`, v.sel.Table, cn)
+
+		if i < len(v.sel.GroupBy)-1 {
+			io.WriteString(w, ", ")
+		}
+	}
+
+	return nil
+}
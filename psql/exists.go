@@ -0,0 +1,125 @@
+package psql
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/dosco/super-graph/qcode"
+	"github.com/gobuffalo/flect"
+)
+
+// whereRel returns the relationship when an expression is on a related
+// table like '{ purchases: { quantity: { gt: 1 } } }' rather than on a
+// column of this table.
+func (v *selectBlock) whereRel(ex *qcode.Exp) (*DBRel, bool) {
+	if len(ex.Col) == 0 {
+		return nil, false
+	}
+
+	if _, ok := v.ti.Columns[ex.Col]; ok {
+		return nil, false
+	}
+
+	rel, err := v.getRelByName(flect.Pluralize(ex.Col), v.ti)
+	if err != nil {
+		return nil, false
+	}
+
+	return rel, true
+}
+
+// renderExists renders an expression on a related table as a correlated
+// EXISTS, everything nested under the same related field has to match the
+// same row. A 'not' around it matches rows that have no such related row.
+func (v *selectBlock) renderExists(w io.Writer, ex *qcode.Exp, rel *DBRel) error {
+	if len(ex.Path) == 0 && ex.Op != qcode.OpAnd && ex.Op != qcode.OpOr &&
+		ex.Op != qcode.OpNot {
+		return fmt.Errorf("[Where] '%s' is a related table, expecting one of its columns", ex.Col)
+	}
+
+	if rel.Type == RelPolymorphic {
+		return fmt.Errorf("[Where] filtering on the polymorphic field '%s' is not supported", ex.Col)
+	}
+
+	ti, err := v.schema.GetTable(rel.Table)
+	if err != nil {
+		return err
+	}
+
+	t := fmt.Sprintf("%s.%s", v.sel.Table, ex.Col)
+
+	io.WriteString(w, `EXISTS (SELECT 1`)
+	renderRelFrom(w, rel, ti, t, v.sel.Table)
+	io.WriteString(w, ` AND (`)
+
+	sub := &selectBlock{
+		sel:      &qcode.Select{Table: t, Where: trimWherePath(ex)},
+		ti:       ti,
+		rel:      rel,
+		Compiler: v.Compiler,
+	}
+
+	if err := sub.renderWhere(w); err != nil {
+		return err
+	}
+
+	io.WriteString(w, `))`)
+
+	return nil
+}
+
+// trimWherePath returns a copy of the expression with the related field
+// removed from the front of its path and the paths of its children.
+func trimWherePath(ex *qcode.Exp) *qcode.Exp {
+	e := *ex
+
+	if len(e.Path) != 0 {
+		e.Col, e.Path = e.Path[0], e.Path[1:]
+	} else {
+		e.Col = ""
+	}
+
+	if len(e.Path) == 0 {
+		e.Path = nil
+	}
+
+	if len(ex.Children) != 0 {
+		e.Children = make([]*qcode.Exp, len(ex.Children))
+
+		for i := range ex.Children {
+			e.Children[i] = trimWherePath(ex.Children[i])
+		}
+	}
+
+	return &e
+}
+
+// renderRelFrom renders the FROM and the join condition of a subquery on
+// the related table ti named t, pt is the name of the parent table.
+func renderRelFrom(w io.Writer, rel *DBRel, ti *DBTableInfo, t, pt string) {
+	fmt.Fprintf(w, ` FROM "%s" AS "%s"`, ti.Name, t)
+
+	if rel.Type != RelOneToManyThrough {
+		io.WriteString(w, ` WHERE (`)
+		renderRelColumns(w, rel, t, pt)
+		io.WriteString(w, `)`)
+		return
+	}
+
+	fmt.Fprintf(w, `, "%s" WHERE (`, rel.Through)
+
+	for i := range rel.Col1 {
+		fmt.Fprintf(w, `(("%s"."%s") = ("%s"."%s")) AND `,
+			t, rel.Col1[i], rel.Through, rel.ColT1[i])
+	}
+
+	for i := range rel.ColT2 {
+		fmt.Fprintf(w, `(("%s"."%s") = ("%s"."%s"))`,
+			rel.Through, rel.ColT2[i], pt, rel.Col2[i])
+
+		if i < len(rel.ColT2)-1 {
+			io.WriteString(w, " AND ")
+		}
+	}
+	io.WriteString(w, `)`)
+}
@@ -0,0 +1,241 @@
+package psql
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/dosco/super-graph/qcode"
+)
+
+// FuncConfig adds a computed field Name to Table whose value is the
+// result of calling Function with the row of the table. Args are the
+// names of the variables passed after the row, either session variables
+// like 'user_id' or ones defined in the config. Function defaults to Name
+// and can include the schema like 'public.full_name'. Type is the GraphQL
+// type of the value shown in introspection, String by default.
+type FuncConfig struct {
+	Name     string
+	Table    string
+	Function string
+	Args     []string
+	Type     string
+}
+
+// DBFunction is a function used as a computed field of a table.
+type DBFunction struct {
+	Name string
+	Args []string
+	Type string
+}
+
+// ComputedField is a computed field of a table and its GraphQL type.
+type ComputedField struct {
+	Table string
+	Name  string
+	Type  string
+}
+
+var funcNameRe = regexp.MustCompile(`^[a-z_][a-z0-9_]*(\.[a-z_][a-z0-9_]*)?$`)
+
+// AddFunctions validates the computed fields and adds them to the tables
+// in the schema.
+func (s *DBSchema) AddFunctions(funcs []FuncConfig) error {
+	for i := range funcs {
+		if err := s.addFuncConfig(&funcs[i]); err != nil {
+			return fmt.Errorf("function '%s.%s': %s",
+				funcs[i].Table, funcs[i].Name, err)
+		}
+	}
+	return nil
+}
+
+func (s *DBSchema) addFuncConfig(fc *FuncConfig) error {
+	ti, err := s.GetTable(strings.ToLower(fc.Table))
+	if err != nil {
+		return err
+	}
+
+	name := strings.ToLower(fc.Name)
+	if !funcNameRe.MatchString(name) || strings.Contains(name, ".") {
+		return fmt.Errorf("invalid field name")
+	}
+
+	if _, ok := ti.Columns[name]; ok {
+		return fmt.Errorf("a column with the same name exists")
+	}
+
+	fn := strings.ToLower(fc.Function)
+	if len(fn) == 0 {
+		fn = name
+	}
+
+	if !funcNameRe.MatchString(fn) {
+		return fmt.Errorf("invalid function name '%s'", fc.Function)
+	}
+
+	for _, a := range fc.Args {
+		if !funcNameRe.MatchString(a) || strings.Contains(a, ".") {
+			return fmt.Errorf("invalid variable name '%s'", a)
+		}
+	}
+
+	if ti.Funcs == nil {
+		ti.Funcs = make(map[string]*DBFunction)
+	}
+	typ := fc.Type
+	if len(typ) == 0 {
+		typ = "String"
+	}
+
+	ti.Funcs[name] = &DBFunction{Name: fn, Args: fc.Args, Type: typ}
+
+	return nil
+}
+
+// ComputedFields returns the computed fields of all the tables sorted by
+// table and name.
+func (c *Compiler) ComputedFields() []ComputedField {
+	var cf []ComputedField
+
+	for _, ti := range c.schema.Tables {
+		for name, fn := range ti.Funcs {
+			cf = append(cf, ComputedField{ti.Name, name, fn.Type})
+		}
+	}
+
+	sort.Slice(cf, func(i, j int) bool {
+		if cf[i].Table != cf[j].Table {
+			return cf[i].Table < cf[j].Table
+		}
+		return cf[i].Name < cf[j].Name
+	})
+
+	return cf
+}
+
+// renderFuncCall calls the function of a computed field with the row of
+// the table named t followed by the values of its variables.
+func (c *Compiler) renderFuncCall(w io.Writer, fn *DBFunction, t string) {
+	fmt.Fprintf(w, `"%s"("%s"`, strings.Replace(fn.Name, ".", `"."`, 1), t)
+
+	for _, a := range fn.Args {
+		if val, ok := c.vars[a]; ok {
+			fmt.Fprintf(w, `, (%s)`, val)
+		} else {
+			fmt.Fprintf(w, `, '{{%s}}'`, a)
+		}
+	}
+
+	io.WriteString(w, `)`)
+}
+
+// tableFunc returns the function returning rows of a table that a field
+// like 'search_products' calls, tables and fields mapped to a table take
+// precedence over functions with the same name.
+func (c *Compiler) tableFunc(sel *qcode.Select) (*DBTableFunc, bool) {
+	if _, ok := c.schema.Tables[sel.Table]; ok {
+		return nil, false
+	}
+
+	if _, ok := c.tmap[sel.Table]; ok {
+		return nil, false
+	}
+
+	fn, ok := c.schema.TableFuncs[fieldName(sel)]
+	return fn, ok
+}
+
+// checkRootFunc makes sure functions that can change data are only called
+// from a mutation and that a mutation not inserting rows calls one of the
+// functions allowed in the config.
+func (c *Compiler) checkRootFunc(qc *qcode.QCode) error {
+	sel := qc.Query.Select
+	fn, ok := c.tableFunc(sel)
+
+	if qc.Type != qcode.QTMutation {
+		if ok && fn.Volatile {
+			return fmt.Errorf("'%s' can change data and can only be used in a mutation", sel.FieldName)
+		}
+		return nil
+	}
+
+	if sel.Action != qcode.ActionNone {
+		if ok {
+			return fmt.Errorf("cannot insert into the function '%s'", sel.FieldName)
+		}
+		return nil
+	}
+
+	if !ok || !fn.Volatile {
+		return fmt.Errorf("'%s' is not a volatile function, mutations need one or an insert argument", sel.FieldName)
+	}
+
+	if _, ok := c.muts[fn.Name]; !ok {
+		return fmt.Errorf("'%s' is not one of the mutations allowed in the config", sel.FieldName)
+	}
+
+	return nil
+}
+
+// renderTableFunc selects from the rows returned by the function, the
+// arguments of the field are passed by name and cast to the type of the
+// function argument.
+func (v *selectBlock) renderTableFunc(w io.Writer, fn *DBTableFunc) error {
+	params := make(map[string]*qcode.Param, len(v.sel.Params))
+
+	for _, p := range v.sel.Params {
+		params[p.Name] = p
+	}
+
+	fmt.Fprintf(w, ` FROM "%s"(`, fn.Name)
+
+	var n int
+
+	for i, a := range fn.ArgNames {
+		p, ok := params[strings.ToLower(a)]
+		if !ok {
+			if i < len(fn.ArgNames)-fn.Defaults {
+				return fmt.Errorf("argument '%s' of '%s' is missing", a, v.sel.FieldName)
+			}
+			continue
+		}
+		delete(params, p.Name)
+
+		if n != 0 {
+			io.WriteString(w, ", ")
+		}
+		n++
+
+		fmt.Fprintf(w, `"%s" => `, a)
+
+		switch p.Type {
+		case qcode.ValInt, qcode.ValFloat, qcode.ValBool:
+			io.WriteString(w, p.Val)
+		case qcode.ValVar:
+			if val, ok := v.vars[p.Val]; ok {
+				fmt.Fprintf(w, `(%s)`, val)
+			} else {
+				fmt.Fprintf(w, `'{{%s}}'`, p.Val)
+			}
+		default:
+			io.WriteString(w, sqlString(p.Val))
+		}
+
+		if i < len(fn.ArgTypes) {
+			fmt.Fprintf(w, ` :: %s`, fn.ArgTypes[i])
+		}
+	}
+
+	for _, p := range v.sel.Params {
+		if _, ok := params[p.Name]; ok {
+			return fmt.Errorf("'%s' has no argument '%s'", v.sel.FieldName, p.Name)
+		}
+	}
+
+	fmt.Fprintf(w, `) AS "%s"`, v.sel.Table)
+
+	return nil
+}
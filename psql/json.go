@@ -0,0 +1,124 @@
+package psql
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/dosco/super-graph/qcode"
+)
+
+// jsonColumn returns the json or jsonb column a child selection like
+// 'metadata { color }' picks keys from. Relationships take precedence
+// over columns with the same name.
+func (c *Compiler) jsonColumn(sel *qcode.Select, ti *DBTableInfo) (*DBColumn, bool) {
+	if sel.Aggregate || sel.Union {
+		return nil, false
+	}
+
+	col, ok := ti.Columns[fieldName(sel)]
+	if !ok || !isJSONType(col.Type) {
+		return nil, false
+	}
+
+	if _, err := c.getRel(sel, ti); err == nil {
+		return nil, false
+	}
+
+	return col, true
+}
+
+func isJSONType(t string) bool {
+	return t == "json" || t == "jsonb"
+}
+
+// renderJSONField builds an object with just the selected keys of a json
+// column, nested selections pick keys from the objects under them.
+func (v *selectBlock) renderJSONField(w io.Writer, sel *qcode.Select, col *DBColumn) {
+	fn := "jsonb_build_object"
+	if col.Type == "json" {
+		fn = "json_build_object"
+	}
+
+	ref := fmt.Sprintf(`"%s_%d"."%s"`, v.sel.Table, v.sel.ID, col.Name)
+	renderJSONObject(w, fn, ref, sel)
+
+	fmt.Fprintf(w, ` AS "%s"`, sel.FieldName)
+}
+
+func renderJSONObject(w io.Writer, fn, ref string, sel *qcode.Select) {
+	fmt.Fprintf(w, `%s(`, fn)
+
+	for i, col := range sel.Cols {
+		if i != 0 {
+			io.WriteString(w, ", ")
+		}
+		fmt.Fprintf(w, `'%s', %s->'%s'`, col.FieldName, ref, col.Name)
+	}
+
+	for i, s := range sel.Joins {
+		if i != 0 || len(sel.Cols) != 0 {
+			io.WriteString(w, ", ")
+		}
+		fmt.Fprintf(w, `'%s', `, s.FieldName)
+		renderJSONObject(w, fn, fmt.Sprintf(`%s->'%s'`, ref, fieldName(s)), s)
+	}
+
+	io.WriteString(w, `)`)
+}
+
+// renderJSONPath renders the left side of a where on a key of a json
+// column. The value at the key is compared as text cast to the type of
+// the value given, the containment and key operators compare it as json.
+func (v *selectBlock) renderJSONPath(w io.Writer, ex *qcode.Exp) error {
+	col, ok := v.ti.Columns[ex.Col]
+	if !ok || !isJSONType(col.Type) {
+		return fmt.Errorf("[Where] '%s' is not a json column of %s", ex.Col, v.sel.Table)
+	}
+
+	var asJSON bool
+
+	switch ex.Op {
+	case qcode.OpContains, qcode.OpContainedIn,
+		qcode.OpHasKey, qcode.OpHasKeyAny, qcode.OpHasKeyAll:
+		asJSON = true
+	}
+
+	op, pathOp := "->>", "#>>"
+	if asJSON {
+		op, pathOp = "->", "#>"
+	}
+
+	var path string
+
+	if len(ex.Path) == 1 {
+		path = fmt.Sprintf(`"%s"."%s"%s'%s'`, v.sel.Table, col.Name, op, ex.Path[0])
+	} else {
+		path = fmt.Sprintf(`"%s"."%s"%s'{%s}'`,
+			v.sel.Table, col.Name, pathOp, strings.Join(ex.Path, ","))
+	}
+
+	t := ex.Type
+	if t == qcode.ValList {
+		t = ex.ListType
+	}
+
+	cast := ""
+
+	if !asJSON && ex.Op != qcode.OpIsNull {
+		switch t {
+		case qcode.ValInt, qcode.ValFloat:
+			cast = "numeric"
+		case qcode.ValBool:
+			cast = "boolean"
+		}
+	}
+
+	if len(cast) != 0 {
+		fmt.Fprintf(w, `(((%s) :: %s) `, path, cast)
+	} else {
+		fmt.Fprintf(w, `((%s) `, path)
+	}
+
+	return nil
+}
@@ -0,0 +1,114 @@
+package psql
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/dosco/super-graph/qcode"
+)
+
+// renderMutation renders the insert as a CTE named after the table so
+// the select that follows returns the inserted rows.
+func (c *Compiler) renderMutation(w io.Writer, sel *qcode.Select, ti *DBTableInfo, vars map[string]json.RawMessage) error {
+	if sel.Action != qcode.ActionInsert {
+		return fmt.Errorf("unknown mutation action %d", sel.Action)
+	}
+
+	data, ok := vars[sel.ActionVar]
+	if !ok {
+		return fmt.Errorf("variable '%s' not defined", sel.ActionVar)
+	}
+
+	data = bytes.TrimSpace(data)
+	isList := len(data) != 0 && data[0] == '['
+
+	cols, err := insertColumns(ti, data, isList)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, `WITH "%s" AS (INSERT INTO "%s" (`, ti.Name, ti.Name)
+
+	for i, cn := range cols {
+		fmt.Fprintf(w, `"%s"`, cn)
+
+		if i < len(cols)-1 {
+			io.WriteString(w, ", ")
+		}
+	}
+
+	io.WriteString(w, `) SELECT `)
+
+	for i, cn := range cols {
+		fmt.Fprintf(w, `"t"."%s"`, cn)
+
+		if i < len(cols)-1 {
+			io.WriteString(w, ", ")
+		}
+	}
+
+	if isList {
+		io.WriteString(w, ` FROM json_populate_recordset`)
+	} else {
+		io.WriteString(w, ` FROM json_populate_record`)
+	}
+
+	fmt.Fprintf(w, `(NULL::"%s", '%s' :: json) AS "t" RETURNING *) `,
+		ti.Name, quoteJSON(data))
+
+	return nil
+}
+
+// insertColumns returns the columns set by the rows being inserted,
+// every key has to be a column of the table.
+func insertColumns(ti *DBTableInfo, data json.RawMessage, isList bool) ([]string, error) {
+	var rows []map[string]json.RawMessage
+
+	if isList {
+		if err := json.Unmarshal(data, &rows); err != nil {
+			return nil, fmt.Errorf("expecting a list of objects to insert: %s", err)
+		}
+	} else {
+		var row map[string]json.RawMessage
+
+		if err := json.Unmarshal(data, &row); err != nil {
+			return nil, fmt.Errorf("expecting an object to insert: %s", err)
+		}
+		rows = append(rows, row)
+	}
+
+	colmap := make(map[string]struct{})
+
+	for _, row := range rows {
+		for k := range row {
+			if _, ok := ti.Columns[k]; !ok {
+				return nil, fmt.Errorf("unknown column '%s.%s'", ti.Name, k)
+			}
+			colmap[k] = struct{}{}
+		}
+	}
+
+	if len(colmap) == 0 {
+		return nil, fmt.Errorf("no columns to insert into '%s'", ti.Name)
+	}
+
+	cols := make([]string, 0, len(colmap))
+	for k := range colmap {
+		cols = append(cols, k)
+	}
+	sort.Strings(cols)
+
+	return cols, nil
+}
+
+// quoteJSON makes the json safe to use in a string literal, '{{' can
+// only be inside a json string so it is escaped to keep it from being
+// read as a template tag.
+func quoteJSON(data json.RawMessage) string {
+	s := strings.Replace(string(data), `'`, `''`, -1)
+	return strings.Replace(s, `{{`, `{\u007b`, -1)
+}
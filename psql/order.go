@@ -0,0 +1,184 @@
+package psql
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/dosco/super-graph/qcode"
+	"github.com/gobuffalo/flect"
+)
+
+const aggSuffix = "_aggregate"
+
+func renderOrderBy(w io.Writer, sel *qcode.Select) error {
+	io.WriteString(w, ` ORDER BY `)
+
+	for i, ob := range sel.OrderBy {
+		if i != 0 {
+			io.WriteString(w, ", ")
+		}
+		fmt.Fprintf(w, `"%s_%d.ob.%s"`, sel.Table, sel.ID, ob.Col)
+
+		if err := renderOrder(w, ob.Order); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renderBaseOrderBy orders the rows of the base select so the limit
+// applies to them in order. Values that are not columns like computed
+// fields or ones from related tables are ordered by the name they are
+// selected as.
+func (v *selectBlock) renderBaseOrderBy(w io.Writer) error {
+	io.WriteString(w, ` ORDER BY `)
+
+	for i, ob := range v.sel.OrderBy {
+		if i != 0 {
+			io.WriteString(w, ", ")
+		}
+
+		if _, ok := v.ti.Columns[ob.Col]; ok {
+			fmt.Fprintf(w, `"%s"."%s"`, v.sel.Table, ob.Col)
+		} else {
+			fmt.Fprintf(w, `"%s"`, ob.Col)
+		}
+
+		if err := renderOrder(w, ob.Order); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func renderOrder(w io.Writer, o qcode.Order) error {
+	switch o {
+	case qcode.OrderAsc:
+		io.WriteString(w, ` ASC`)
+	case qcode.OrderDesc:
+		io.WriteString(w, ` DESC`)
+	case qcode.OrderAscNullsFirst:
+		io.WriteString(w, ` ASC NULLS FIRST`)
+	case qcode.OrderDescNullsFirst:
+		io.WriteString(w, ` DESC NULLS FIRST`)
+	case qcode.OrderAscNullsLast:
+		io.WriteString(w, ` ASC NULLS LAST`)
+	case qcode.OrderDescNullsLast:
+		io.WriteString(w, ` DESC NULLS LAST`)
+	default:
+		return fmt.Errorf("[qcode.Order By] unexpected value encountered %v", o)
+	}
+	return nil
+}
+
+// renderOrderByExps adds the values ordered by that are not already
+// selected to the base select. Columns of related tables like
+// 'user.name' and aggregates like 'purchases_aggregate.count' are
+// fetched using a subquery and named after their path.
+func (v *selectBlock) renderOrderByExps(w io.Writer, cols map[string]struct{}) error {
+	for _, ob := range v.sel.OrderBy {
+		if _, ok := cols[ob.Col]; ok {
+			continue
+		}
+		cols[ob.Col] = struct{}{}
+
+		io.WriteString(w, ", ")
+		p := strings.Split(ob.Col, ".")
+
+		if len(p) == 1 {
+			if fn, ok := v.ti.Funcs[ob.Col]; ok {
+				v.renderFuncCall(w, fn, v.sel.Table)
+				fmt.Fprintf(w, ` AS %s`, ob.Col)
+				continue
+			}
+			if _, ok := v.ti.Columns[ob.Col]; !ok {
+				return fmt.Errorf("[Order By] unknown column '%s' of %s", ob.Col, v.sel.Table)
+			}
+			fmt.Fprintf(w, `"%s"."%s"`, v.sel.Table, ob.Col)
+			continue
+		}
+
+		if err := v.renderOrderByExp(w, v.ti, v.sel.Table, p); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, ` AS "%s"`, ob.Col)
+	}
+
+	return nil
+}
+
+// renderOrderByExp renders the value at path p starting from the table
+// ti named t. Each related table on the way has to be a single row,
+// related tables with many rows can only be ordered by an aggregate.
+func (c *Compiler) renderOrderByExp(w io.Writer, ti *DBTableInfo, t string, p []string) error {
+	if len(p) == 1 {
+		if fn, ok := ti.Funcs[p[0]]; ok {
+			c.renderFuncCall(w, fn, t)
+			return nil
+		}
+		if _, ok := ti.Columns[p[0]]; !ok {
+			return fmt.Errorf("[Order By] unknown column '%s' of %s", p[0], ti.Name)
+		}
+		fmt.Fprintf(w, `"%s"."%s"`, t, p[0])
+		return nil
+	}
+
+	fn := p[0]
+	isAgg := strings.HasSuffix(fn, aggSuffix)
+
+	if isAgg {
+		fn = strings.TrimSuffix(fn, aggSuffix)
+	}
+
+	rel, err := c.getRelByName(flect.Pluralize(fn), ti)
+	if err != nil {
+		return fmt.Errorf("[Order By] '%s' is not a column or related table of %s", fn, ti.Name)
+	}
+
+	if rel.Type == RelPolymorphic {
+		return fmt.Errorf("[Order By] ordering by the polymorphic field '%s' is not supported", fn)
+	}
+
+	// The related row is unique when the foreign key is on this table
+	single := rel.Type == RelOneToMany && rel.Array2 == RelArrayNone
+
+	if !isAgg && !single {
+		return fmt.Errorf("[Order By] '%s' has many rows, order by an aggregate of '%s%s' instead",
+			fn, fn, aggSuffix)
+	}
+
+	rti, err := c.schema.GetTable(rel.Table)
+	if err != nil {
+		return err
+	}
+
+	rt := fmt.Sprintf("%s.%s", t, p[0])
+
+	io.WriteString(w, `(SELECT `)
+
+	switch {
+	case isAgg && len(p) == 2:
+		fmt.Fprintf(w, `%s(*)`, p[1])
+
+	case isAgg:
+		if _, ok := rti.Columns[p[2]]; !ok {
+			return fmt.Errorf("[Order By] unknown column '%s' of %s", p[2], rti.Name)
+		}
+		fmt.Fprintf(w, `%s("%s"."%s")`, p[1], rt, p[2])
+
+	default:
+		if err := c.renderOrderByExp(w, rti, rt, p[1:]); err != nil {
+			return err
+		}
+	}
+
+	renderRelFrom(w, rel, rti, rt, t)
+
+	if !isAgg {
+		io.WriteString(w, ` LIMIT 1`)
+	}
+	io.WriteString(w, `)`)
+
+	return nil
+}
@@ -1,40 +1,70 @@
 package psql
 
 import (
-	"errors"
+	"encoding/json"
 	"fmt"
 	"io"
 	"strings"
 
 	"github.com/dosco/super-graph/qcode"
 	"github.com/dosco/super-graph/util"
+	"github.com/gobuffalo/flect"
 )
 
 type Config struct {
 	Schema   *DBSchema
 	Vars     map[string]string
 	TableMap map[string]string
+
+	// Mutations are the volatile functions that can be called from a
+	// mutation, the others cannot be called at all.
+	Mutations []string
 }
 
+const defaultRecursiveDepth = "10"
+
 type Compiler struct {
 	schema *DBSchema
 	vars   map[string]string
 	tmap   map[string]string
+	muts   map[string]struct{}
 }
 
 func NewCompiler(conf Config) *Compiler {
-	return &Compiler{conf.Schema, conf.Vars, conf.TableMap}
+	muts := make(map[string]struct{}, len(conf.Mutations))
+
+	for _, m := range conf.Mutations {
+		muts[strings.ToLower(m)] = struct{}{}
+	}
+
+	return &Compiler{conf.Schema, conf.Vars, conf.TableMap, muts}
 }
 
 func (c *Compiler) Compile(w io.Writer, qc *qcode.QCode) error {
+	return c.CompileVars(w, qc, nil)
+}
+
+// CompileVars compiles the query like Compile, mutations take the rows
+// they change from the variables.
+func (c *Compiler) CompileVars(w io.Writer, qc *qcode.QCode, vars map[string]json.RawMessage) error {
 	st := util.NewStack()
 	ti, err := c.getTable(qc.Query.Select)
 	if err != nil {
 		return err
 	}
 
+	if err := c.checkRootFunc(qc); err != nil {
+		return err
+	}
+
+	if qc.Type == qcode.QTMutation && qc.Query.Select.Action != qcode.ActionNone {
+		if err := c.renderMutation(w, qc.Query.Select, ti, vars); err != nil {
+			return err
+		}
+	}
+
 	st.Push(&selectBlockClose{nil, qc.Query.Select})
-	st.Push(&selectBlock{nil, qc.Query.Select, ti, c})
+	st.Push(&selectBlock{nil, qc.Query.Select, ti, nil, c})
 
 	fmt.Fprintf(w, `SELECT json_object_agg('%s', %s) FROM (`,
 		qc.Query.Select.FieldName, qc.Query.Select.Table)
@@ -48,20 +78,44 @@ func (c *Compiler) Compile(w io.Writer, qc *qcode.QCode) error {
 
 		switch v := intf.(type) {
 		case *selectBlock:
-			childCols, childIDs := c.relationshipColumns(v.sel)
-			v.render(w, c.schema, childCols, childIDs)
+			childCols, childIDs := c.relationshipColumns(v.sel, v.ti)
+			if err := v.render(w, c.schema, childCols, childIDs); err != nil {
+				return err
+			}
 
 			for i := range childIDs {
 				sub := v.sel.Joins[childIDs[i]]
 
-				ti, err := c.getTable(sub)
+				// Keys of json columns are picked in the parent select
+				if _, ok := c.jsonColumn(sub, v.ti); ok {
+					continue
+				}
+
+				rel, err := c.getRel(sub, v.ti)
 				if err != nil {
 					return err
 				}
 
+				if rel.Type == RelPolymorphic {
+					if err := c.pushUnion(st, v, sub, rel); err != nil {
+						return err
+					}
+					continue
+				}
+
+				ti, err := c.schema.GetTable(rel.Table)
+				if err != nil {
+					return err
+				}
+
+				if sub.Recursive &&
+					(rel.Type == RelOneToManyThrough || rel.Table != v.ti.Name) {
+					return fmt.Errorf("recursive queries need a self-referencing relationship, '%s' is not one", sub.FieldName)
+				}
+
 				st.Push(&joinClose{sub})
 				st.Push(&selectBlockClose{v.sel, sub})
-				st.Push(&selectBlock{v.sel, sub, ti, c})
+				st.Push(&selectBlock{v.sel, sub, ti, rel, c})
 				st.Push(&joinOpen{sub})
 			}
 		case *selectBlockClose:
@@ -81,14 +135,261 @@ func (c *Compiler) Compile(w io.Writer, qc *qcode.QCode) error {
 	return nil
 }
 
+// pushUnion adds a join for every inline fragment of a polymorphic
+// field, each one fetches the row from the table of the fragment type
+// when the type column of the parent matches.
+func (c *Compiler) pushUnion(st *util.Stack, v *selectBlock, sub *qcode.Select, rel *DBRel) error {
+	if !sub.Union {
+		return fmt.Errorf("polymorphic field '%s' needs inline fragments like '... on User'", sub.FieldName)
+	}
+
+	for _, frag := range sub.Joins {
+		ti, err := c.getTable(frag)
+		if err != nil {
+			return err
+		}
+
+		// The id column of the relationship is matched with the
+		// primary key of each type
+		if len(ti.PrimaryCol) == 0 {
+			return fmt.Errorf("polymorphic field '%s': no primary key column defined for %s",
+				sub.FieldName, ti.Name)
+		}
+
+		frel := &DBRel{
+			Type:    RelOneToMany,
+			Table:   ti.Name,
+			Col1:    []string{ti.PrimaryCol},
+			Col2:    rel.Col2,
+			TypeCol: rel.TypeCol,
+			TypeVal: frag.Type,
+		}
+
+		st.Push(&joinClose{frag})
+		st.Push(&selectBlockClose{v.sel, frag})
+		st.Push(&selectBlock{v.sel, frag, ti, frel, c})
+		st.Push(&joinOpen{frag})
+	}
+
+	return nil
+}
+
 func (c *Compiler) getTable(sel *qcode.Select) (*DBTableInfo, error) {
 	if tn, ok := c.tmap[sel.Table]; ok {
 		return c.schema.GetTable(tn)
 	}
+	if fn, ok := c.tableFunc(sel); ok {
+		return c.schema.GetTable(strings.ToLower(fn.Table))
+	}
 	return c.schema.GetTable(sel.Table)
 }
 
-func (c *Compiler) relationshipColumns(parent *qcode.Select) (
+// Tables returns the names of the tables a query reads from starting with
+// the one of the root field, this includes the related tables used in a
+// where or an order by. Known is false when the query calls a function,
+// a table function at the root or a computed field, as the tables those
+// read from are not known.
+func (c *Compiler) Tables(qc *qcode.QCode) (tables []string, known bool, err error) {
+	sel := qc.Query.Select
+
+	ti, err := c.getTable(sel)
+	if err != nil {
+		return nil, false, err
+	}
+
+	_, isFunc := c.tableFunc(sel)
+
+	tu := &tablesUsed{Compiler: c, known: !isFunc, seen: make(map[string]struct{})}
+	tu.add(ti.Name)
+
+	if err := tu.addSelect(sel, ti); err != nil {
+		return nil, false, err
+	}
+
+	return tu.tables, tu.known, nil
+}
+
+type tablesUsed struct {
+	*Compiler
+	tables []string
+	known  bool
+	seen   map[string]struct{}
+}
+
+func (tu *tablesUsed) add(t string) {
+	if _, ok := tu.seen[t]; !ok {
+		tu.seen[t] = struct{}{}
+		tu.tables = append(tu.tables, t)
+	}
+}
+
+// addRel adds the tables of the relationship and returns the related one.
+func (tu *tablesUsed) addRel(rel *DBRel) (*DBTableInfo, error) {
+	if len(rel.Through) != 0 {
+		tu.add(rel.Through)
+	}
+
+	ti, err := tu.schema.GetTable(rel.Table)
+	if err != nil {
+		return nil, err
+	}
+	tu.add(ti.Name)
+
+	return ti, nil
+}
+
+func (tu *tablesUsed) addSelect(sel *qcode.Select, ti *DBTableInfo) error {
+	for _, col := range sel.Cols {
+		if _, ok := ti.Funcs[col.Name]; ok {
+			tu.known = false
+		}
+	}
+
+	if err := tu.addWhere(sel.Where, ti); err != nil {
+		return err
+	}
+
+	for _, ob := range sel.OrderBy {
+		if err := tu.addOrderBy(strings.Split(ob.Col, "."), ti); err != nil {
+			return err
+		}
+	}
+
+	for _, sub := range sel.Joins {
+		if _, ok := tu.jsonColumn(sub, ti); ok {
+			continue
+		}
+
+		rel, err := tu.getRel(sub, ti)
+		if err != nil {
+			return err
+		}
+
+		if rel.Type == RelPolymorphic {
+			for _, frag := range sub.Joins {
+				fti, err := tu.getTable(frag)
+				if err != nil {
+					return err
+				}
+				tu.add(fti.Name)
+
+				if err := tu.addSelect(frag, fti); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		sti, err := tu.addRel(rel)
+		if err != nil {
+			return err
+		}
+
+		if err := tu.addSelect(sub, sti); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addWhere adds the related tables an expression filters on, these are
+// rendered as an EXISTS on the related table.
+func (tu *tablesUsed) addWhere(ex *qcode.Exp, ti *DBTableInfo) error {
+	if ex == nil {
+		return nil
+	}
+
+	if len(ex.Col) != 0 {
+		if _, ok := ti.Funcs[ex.Col]; ok {
+			tu.known = false
+			return nil
+		}
+
+		if _, ok := ti.Columns[ex.Col]; !ok {
+			rel, err := tu.getRelByName(flect.Pluralize(ex.Col), ti)
+			if err == nil && rel.Type != RelPolymorphic {
+				rti, err := tu.addRel(rel)
+				if err != nil {
+					return err
+				}
+				return tu.addWhere(trimWherePath(ex), rti)
+			}
+		}
+	}
+
+	for _, c := range ex.Children {
+		if err := tu.addWhere(c, ti); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addOrderBy adds the related tables on the path of an order by like
+// 'user.email' or 'purchases_agg.count'.
+func (tu *tablesUsed) addOrderBy(p []string, ti *DBTableInfo) error {
+	if len(p) == 1 {
+		if _, ok := ti.Funcs[p[0]]; ok {
+			tu.known = false
+		}
+		return nil
+	}
+
+	fn := p[0]
+	isAgg := strings.HasSuffix(fn, aggSuffix)
+
+	if isAgg {
+		fn = strings.TrimSuffix(fn, aggSuffix)
+	}
+
+	rel, err := tu.getRelByName(flect.Pluralize(fn), ti)
+	if err != nil || rel.Type == RelPolymorphic {
+		return nil
+	}
+
+	rti, err := tu.addRel(rel)
+	if err != nil {
+		return err
+	}
+
+	if isAgg {
+		return nil
+	}
+
+	return tu.addOrderBy(p[1:], rti)
+}
+
+// fieldName returns the name of the field a selection was compiled from.
+func fieldName(sel *qcode.Select) string {
+	if sel.AsList {
+		return sel.Table
+	}
+	return sel.Singular
+}
+
+// getRel returns the relationship between a child selection and it's
+// parent table. Fields mapped to a table in the table map like 'replies'
+// to 'comments' use the relationship of the table they are mapped to.
+func (c *Compiler) getRel(sel *qcode.Select, parent *DBTableInfo) (*DBRel, error) {
+	return c.getRelByName(sel.Table, parent)
+}
+
+func (c *Compiler) getRelByName(table string, parent *DBTableInfo) (*DBRel, error) {
+	rel, err := c.schema.GetRel(table, parent.Name)
+	if err == nil {
+		return rel, nil
+	}
+
+	if tn, ok := c.tmap[table]; ok {
+		return c.schema.GetRel(tn, parent.Name)
+	}
+
+	return nil, err
+}
+
+func (c *Compiler) relationshipColumns(parent *qcode.Select, ti *DBTableInfo) (
 	cols []*qcode.Column, childIDs []int) {
 
 	colmap := make(map[string]struct{}, len(parent.Cols))
@@ -97,26 +398,35 @@ func (c *Compiler) relationshipColumns(parent *qcode.Select) (
 	}
 
 	for i, sub := range parent.Joins {
-		k := TTKey{sub.Table, parent.Table}
+		// The json column is needed to pick the keys from
+		if col, ok := c.jsonColumn(sub, ti); ok {
+			if _, ok := colmap[col.Name]; !ok {
+				cols = append(cols, &qcode.Column{Table: parent.Table, Name: col.Name, FieldName: col.Name})
+				colmap[col.Name] = struct{}{}
+			}
+			childIDs = append(childIDs, i)
+			continue
+		}
 
-		rel, ok := c.schema.RelMap[k]
-		if !ok {
+		rel, err := c.getRel(sub, ti)
+		if err != nil {
 			continue
 		}
 
-		if rel.Type == RelBelongTo || rel.Type == RelOneToMany {
-			if _, ok := colmap[rel.Col2]; !ok {
-				cols = append(cols, &qcode.Column{parent.Table, rel.Col2, rel.Col2})
-			}
-			childIDs = append(childIDs, i)
+		// The parent side columns of the relationship are
+		// needed to join to the child
+		pcols := rel.Col2
+		if len(rel.TypeCol) != 0 && rel.Type != RelBelongTo {
+			pcols = append(pcols[:len(pcols):len(pcols)], rel.TypeCol)
 		}
 
-		if rel.Type == RelOneToManyThrough {
-			if _, ok := colmap[rel.Col1]; !ok {
-				cols = append(cols, &qcode.Column{parent.Table, rel.Col1, rel.Col1})
+		for _, cn := range pcols {
+			if _, ok := colmap[cn]; !ok {
+				cols = append(cols, &qcode.Column{Table: parent.Table, Name: cn, FieldName: cn})
+				colmap[cn] = struct{}{}
 			}
-			childIDs = append(childIDs, i)
 		}
+		childIDs = append(childIDs, i)
 	}
 
 	return cols, childIDs
@@ -126,6 +436,7 @@ type selectBlock struct {
 	parent *qcode.Select
 	sel    *qcode.Select
 	ti     *DBTableInfo
+	rel    *DBRel
 	*Compiler
 }
 
@@ -204,7 +515,7 @@ func (v *selectBlockClose) render(w io.Writer) error {
 
 	if len(v.sel.Paging.Limit) != 0 {
 		fmt.Fprintf(w, ` LIMIT ('%s') :: integer`, v.sel.Paging.Limit)
-	} else {
+	} else if v.sel.Action == qcode.ActionNone {
 		io.WriteString(w, ` LIMIT ('20') :: integer`)
 	}
 
@@ -237,23 +548,32 @@ func (v *joinClose) render(w io.Writer) error {
 	return nil
 }
 
-func (v *selectBlock) renderJoinTable(w io.Writer, schema *DBSchema, childIDs []int) {
-	k := TTKey{v.sel.Table, v.parent.Table}
-	rel, ok := schema.RelMap[k]
-	if !ok {
-		panic(errors.New("no relationship found"))
-	}
+func (v *selectBlock) renderJoinTable(w io.Writer) {
+	rel := v.rel
 
 	if rel.Type != RelOneToManyThrough {
 		return
 	}
 
-	fmt.Fprintf(w, ` LEFT OUTER JOIN "%s" ON (("%s"."%s") = ("%s_%d"."%s"))`,
-		rel.Through, rel.Through, rel.ColT, v.parent.Table, v.parent.ID, rel.Col1)
+	fmt.Fprintf(w, ` LEFT OUTER JOIN "%s" ON (`, rel.Through)
+
+	for i := range rel.ColT2 {
+		fmt.Fprintf(w, `("%s"."%s") = ("%s_%d"."%s")`,
+			rel.Through, rel.ColT2[i], v.parent.Table, v.parent.ID, rel.Col2[i])
 
+		if i < len(rel.ColT2)-1 {
+			io.WriteString(w, " AND ")
+		}
+	}
+	io.WriteString(w, `)`)
 }
 
 func (v *selectBlock) renderColumns(w io.Writer) {
+	if v.sel.Aggregate {
+		v.renderAggColumns(w)
+		return
+	}
+
 	for i, col := range v.sel.Cols {
 		fmt.Fprintf(w, `"%s_%d"."%s" AS "%s"`,
 			v.sel.Table, v.sel.ID, col.Name, col.FieldName)
@@ -272,8 +592,14 @@ func (v *selectBlock) renderJoinedColumns(w io.Writer, childIDs []int) error {
 	for i := range childIDs {
 		s := v.sel.Joins[childIDs[i]]
 
-		fmt.Fprintf(w, `"%s_%d.join"."%s" AS "%s"`,
-			s.Table, s.ID, s.Table, s.FieldName)
+		if s.Union {
+			renderUnionColumn(w, s)
+		} else if col, ok := v.jsonColumn(s, v.ti); ok {
+			v.renderJSONField(w, s, col)
+		} else {
+			fmt.Fprintf(w, `"%s_%d.join"."%s" AS "%s"`,
+				s.Table, s.ID, s.Table, s.FieldName)
+		}
 
 		if i < len(childIDs)-1 {
 			io.WriteString(w, ", ")
@@ -283,12 +609,28 @@ func (v *selectBlock) renderJoinedColumns(w io.Writer, childIDs []int) error {
 	return nil
 }
 
+// renderUnionColumn picks the one fragment of a polymorphic field that
+// matched a row.
+func renderUnionColumn(w io.Writer, sel *qcode.Select) {
+	io.WriteString(w, `coalesce(`)
+
+	for i, s := range sel.Joins {
+		fmt.Fprintf(w, `"%s_%d.join"."%s"`, s.Table, s.ID, s.Table)
+
+		if i < len(sel.Joins)-1 {
+			io.WriteString(w, ", ")
+		}
+	}
+
+	fmt.Fprintf(w, `) AS "%s"`, sel.FieldName)
+}
+
 func (v *selectBlock) renderBaseSelect(w io.Writer, schema *DBSchema, childCols []*qcode.Column, childIDs []int) error {
 	var groupBy []int
 
 	isRoot := v.parent == nil
 	isFil := v.sel.Where != nil
-	isSearch := v.sel.Args["search"] != nil
+	isSearch := v.sel.Search != nil
 	isAgg := false
 
 	io.WriteString(w, " FROM (SELECT ")
@@ -298,22 +640,37 @@ func (v *selectBlock) renderBaseSelect(w io.Writer, schema *DBSchema, childCols
 
 		_, isRealCol := v.ti.Columns[cn]
 
-		if !isRealCol {
+		if len(col.Agg) != 0 {
+			if err := v.renderAggFunc(w, col); err != nil {
+				return err
+			}
+
+		} else if !isRealCol && cn == "__typename" {
+			tn := v.sel.Type
+			if len(tn) == 0 {
+				tn = flect.Pascalize(v.sel.Singular)
+			}
+			fmt.Fprintf(w, `'%s' AS %s`, tn, col.Name)
+
+		} else if fn, ok := v.ti.Funcs[cn]; ok && !isRealCol {
+			v.renderFuncCall(w, fn, v.sel.Table)
+			fmt.Fprintf(w, ` AS %s`, col.Name)
+
+		} else if !isRealCol {
 			if isSearch {
 				switch {
 				case cn == "search_rank":
-					cn = v.ti.TSVCol
-					arg := v.sel.Args["search"]
-
-					fmt.Fprintf(w, `ts_rank("%s"."%s", to_tsquery('%s')) AS %s`,
-						v.sel.Table, cn, arg.Val, col.Name)
+					if err := v.renderSearchRank(w, col); err != nil {
+						return err
+					}
 
 				case strings.HasPrefix(cn, "search_headline_"):
-					cn = cn[16:]
-					arg := v.sel.Args["search"]
+					if err := v.renderSearchHeadline(w, col); err != nil {
+						return err
+					}
 
-					fmt.Fprintf(w, `ts_headline("%s"."%s", to_tsquery('%s')) AS %s`,
-						v.sel.Table, cn, arg.Val, col.Name)
+				default:
+					fmt.Fprintf(w, `'%s not defined' AS %s`, cn, col.Name)
 				}
 			} else {
 				pl := funcPrefixLen(cn)
@@ -344,8 +701,33 @@ func (v *selectBlock) renderBaseSelect(w io.Writer, schema *DBSchema, childCols
 		}
 	}
 
-	if tn, ok := v.tmap[v.sel.Table]; ok {
-		fmt.Fprintf(w, ` FROM "%s" AS "%s"`, tn, v.sel.Table)
+	if len(v.sel.OrderBy) != 0 {
+		cols := make(map[string]struct{}, len(v.sel.Cols)+len(childCols))
+
+		for _, col := range v.sel.Cols {
+			if len(col.Agg) == 0 {
+				cols[col.Name] = struct{}{}
+			}
+		}
+		for _, col := range childCols {
+			cols[col.Name] = struct{}{}
+		}
+
+		if err := v.renderOrderByExps(w, cols); err != nil {
+			return err
+		}
+	}
+
+	fn, isFunc := v.tableFunc(v.sel)
+
+	if v.sel.Recursive {
+		v.renderRecursiveTable(w)
+	} else if isRoot && isFunc {
+		if err := v.renderTableFunc(w, fn); err != nil {
+			return err
+		}
+	} else if v.ti.Name != v.sel.Table {
+		fmt.Fprintf(w, ` FROM "%s" AS "%s"`, v.ti.Name, v.sel.Table)
 	} else {
 		fmt.Fprintf(w, ` FROM "%s"`, v.sel.Table)
 	}
@@ -358,11 +740,20 @@ func (v *selectBlock) renderBaseSelect(w io.Writer, schema *DBSchema, childCols
 		io.WriteString(w, `)`)
 	}
 
-	if !isRoot {
-		v.renderJoinTable(w, schema, childIDs)
+	if !isRoot && v.sel.Recursive {
+		if isFil {
+			io.WriteString(w, ` WHERE (`)
+			if err := v.renderWhere(w); err != nil {
+				return err
+			}
+			io.WriteString(w, `)`)
+		}
+
+	} else if !isRoot {
+		v.renderJoinTable(w)
 
 		io.WriteString(w, ` WHERE (`)
-		v.renderRelationship(w, schema)
+		v.renderRelationship(w)
 
 		if isFil {
 			io.WriteString(w, ` AND `)
@@ -373,7 +764,12 @@ func (v *selectBlock) renderBaseSelect(w io.Writer, schema *DBSchema, childCols
 		io.WriteString(w, `)`)
 	}
 
-	if isAgg {
+	if v.sel.Aggregate {
+		if err := v.renderGroupBy(w); err != nil {
+			return err
+		}
+
+	} else if isAgg {
 		if len(groupBy) != 0 {
 			fmt.Fprintf(w, ` GROUP BY `)
 
@@ -387,9 +783,15 @@ func (v *selectBlock) renderBaseSelect(w io.Writer, schema *DBSchema, childCols
 		}
 	}
 
+	if len(v.sel.OrderBy) != 0 {
+		if err := v.renderBaseOrderBy(w); err != nil {
+			return err
+		}
+	}
+
 	if len(v.sel.Paging.Limit) != 0 {
 		fmt.Fprintf(w, ` LIMIT ('%s') :: integer`, v.sel.Paging.Limit)
-	} else {
+	} else if v.sel.Action == qcode.ActionNone {
 		io.WriteString(w, ` LIMIT ('20') :: integer`)
 	}
 
@@ -418,28 +820,101 @@ func (v *selectBlock) renderOrderByColumns(w io.Writer) {
 	}
 }
 
-func (v *selectBlock) renderRelationship(w io.Writer, schema *DBSchema) {
-	k := TTKey{v.sel.Table, v.parent.Table}
-	rel, ok := schema.RelMap[k]
-	if !ok {
-		panic(errors.New("no relationship found"))
-	}
+func (v *selectBlock) renderRelationship(w io.Writer) {
+	rel := v.rel
+	pt := fmt.Sprintf("%s_%d", v.parent.Table, v.parent.ID)
 
 	switch rel.Type {
-	case RelBelongTo:
-		fmt.Fprintf(w, `(("%s"."%s") = ("%s_%d"."%s"))`,
-			v.sel.Table, rel.Col1, v.parent.Table, v.parent.ID, rel.Col2)
-
-	case RelOneToMany:
-		fmt.Fprintf(w, `(("%s"."%s") = ("%s_%d"."%s"))`,
-			v.sel.Table, rel.Col1, v.parent.Table, v.parent.ID, rel.Col2)
+	case RelBelongTo, RelOneToMany:
+		renderRelColumns(w, rel, v.sel.Table, pt)
 
 	case RelOneToManyThrough:
-		fmt.Fprintf(w, `(("%s"."%s") = ("%s"."%s"))`,
-			v.sel.Table, rel.Col1, rel.Through, rel.Col2)
+		for i := range rel.Col1 {
+			fmt.Fprintf(w, `(("%s"."%s") = ("%s"."%s"))`,
+				v.sel.Table, rel.Col1[i], rel.Through, rel.ColT1[i])
+
+			if i < len(rel.Col1)-1 {
+				io.WriteString(w, " AND ")
+			}
+		}
 	}
 }
 
+// renderRelColumns renders the join condition between the columns of
+// a relationship, t1 and t2 are the names used for Table1 and Table2.
+func renderRelColumns(w io.Writer, rel *DBRel, t1, t2 string) {
+	for i := range rel.Col1 {
+		switch {
+		case rel.Array1 == RelArrayJSON:
+			fmt.Fprintf(w, `(("%s"."%s")::jsonb @> to_jsonb("%s"."%s"))`,
+				t1, rel.Col1[i], t2, rel.Col2[i])
+
+		case rel.Array2 == RelArrayJSON:
+			fmt.Fprintf(w, `(("%s"."%s")::jsonb @> to_jsonb("%s"."%s"))`,
+				t2, rel.Col2[i], t1, rel.Col1[i])
+
+		case rel.Array1 == RelArrayNative:
+			fmt.Fprintf(w, `(("%s"."%s") = ANY ("%s"."%s"))`,
+				t2, rel.Col2[i], t1, rel.Col1[i])
+
+		case rel.Array2 == RelArrayNative:
+			fmt.Fprintf(w, `(("%s"."%s") = ANY ("%s"."%s"))`,
+				t1, rel.Col1[i], t2, rel.Col2[i])
+
+		default:
+			fmt.Fprintf(w, `(("%s"."%s") = ("%s"."%s"))`,
+				t1, rel.Col1[i], t2, rel.Col2[i])
+		}
+
+		if i < len(rel.Col1)-1 {
+			io.WriteString(w, " AND ")
+		}
+	}
+
+	if len(rel.TypeCol) == 0 {
+		return
+	}
+
+	tt := t1
+	if rel.Type == RelOneToMany {
+		tt = t2
+	}
+
+	fmt.Fprintf(w, ` AND (("%s"."%s") = ('%s'))`, tt, rel.TypeCol, rel.TypeVal)
+}
+
+// renderRecursiveTable walks a self-referencing relationship using a
+// recursive CTE, the rows at every level up to the depth limit are
+// returned as one table.
+func (v *selectBlock) renderRecursiveTable(w io.Writer) {
+	rel := v.rel
+
+	depth := v.sel.Depth
+	if len(depth) == 0 {
+		depth = defaultRecursiveDepth
+	}
+
+	fmt.Fprintf(w, ` FROM (WITH RECURSIVE "%s_%d.rec" AS (`, v.sel.Table, v.sel.ID)
+
+	fmt.Fprintf(w, `SELECT "%s".*, 1 AS "%s_%d.depth" FROM "%s" WHERE (`,
+		v.ti.Name, v.sel.Table, v.sel.ID, v.ti.Name)
+
+	renderRelColumns(w, rel, v.ti.Name, fmt.Sprintf("%s_%d", v.parent.Table, v.parent.ID))
+	io.WriteString(w, `) UNION ALL `)
+
+	fmt.Fprintf(w, `SELECT "%s".*, "%s_%d.rec"."%s_%d.depth" + 1 FROM "%s", "%s_%d.rec" WHERE (`,
+		v.ti.Name, v.sel.Table, v.sel.ID, v.sel.Table, v.sel.ID,
+		v.ti.Name, v.sel.Table, v.sel.ID)
+
+	renderRelColumns(w, rel, v.ti.Name, fmt.Sprintf("%s_%d.rec", v.sel.Table, v.sel.ID))
+
+	fmt.Fprintf(w, ` AND (("%s_%d.rec"."%s_%d.depth") < ('%s') :: integer)))`,
+		v.sel.Table, v.sel.ID, v.sel.Table, v.sel.ID, depth)
+
+	fmt.Fprintf(w, ` SELECT * FROM "%s_%d.rec") AS "%s"`,
+		v.sel.Table, v.sel.ID, v.sel.Table)
+}
+
 func (v *selectBlock) renderWhere(w io.Writer) error {
 	st := util.NewStack()
 
@@ -466,7 +941,16 @@ func (v *selectBlock) renderWhere(w io.Writer) error {
 			default:
 				return fmt.Errorf("[Where] unexpected value encountered %v", intf)
 			}
+		case string:
+			io.WriteString(w, val)
 		case *qcode.Exp:
+			if rel, ok := v.whereRel(val); ok {
+				if err := v.renderExists(w, val, rel); err != nil {
+					return err
+				}
+				continue
+			}
+
 			switch val.Op {
 			case qcode.OpAnd, qcode.OpOr:
 				for i := len(val.Children) - 1; i >= 0; i-- {
@@ -477,13 +961,27 @@ func (v *selectBlock) renderWhere(w io.Writer) error {
 				}
 				continue
 			case qcode.OpNot:
-				st.Push(val.Children[0])
+				// An 'and' or 'or' in a 'not' like the fields of its
+				// object is negated as a whole
+				if c := val.Children[0]; c.Op == qcode.OpAnd || c.Op == qcode.OpOr {
+					st.Push(`)`)
+					st.Push(c)
+					st.Push(`(`)
+				} else {
+					st.Push(c)
+				}
 				st.Push(qcode.OpNot)
 				continue
 			}
 
-			if val.NestedCol {
-				fmt.Fprintf(w, `(("%s") `, val.Col)
+			if len(val.Path) != 0 {
+				if err := v.renderJSONPath(w, val); err != nil {
+					return err
+				}
+			} else if fn, ok := v.ti.Funcs[val.Col]; ok {
+				io.WriteString(w, `((`)
+				v.renderFuncCall(w, fn, v.sel.Table)
+				io.WriteString(w, `) `)
 			} else if len(val.Col) != 0 {
 				fmt.Fprintf(w, `(("%s"."%s") `, v.sel.Table, val.Col)
 			}
@@ -539,14 +1037,12 @@ func (v *selectBlock) renderWhere(w io.Writer) error {
 				if len(v.ti.PrimaryCol) == 0 {
 					return fmt.Errorf("no primary key column defined for %s", v.sel.Table)
 				}
-				fmt.Fprintf(w, `(("%s") = ('%s'))`, v.ti.PrimaryCol, val.Val)
+				fmt.Fprintf(w, `(("%s") = (%s))`, v.ti.PrimaryCol, sqlString(val.Val))
 				valExists = false
 			case qcode.OpTsQuery:
-				if len(v.ti.TSVCol) == 0 {
-					return fmt.Errorf("no tsv column defined for %s", v.sel.Table)
+				if err := v.renderSearch(w); err != nil {
+					return err
 				}
-
-				fmt.Fprintf(w, `(("%s") @@ to_tsquery('%s'))`, v.ti.TSVCol, val.Val)
 				valExists = false
 
 			default:
@@ -570,34 +1066,6 @@ func (v *selectBlock) renderWhere(w io.Writer) error {
 	return nil
 }
 
-func renderOrderBy(w io.Writer, sel *qcode.Select) error {
-	io.WriteString(w, ` ORDER BY `)
-	for i := range sel.OrderBy {
-		ob := sel.OrderBy[i]
-
-		switch ob.Order {
-		case qcode.OrderAsc:
-			fmt.Fprintf(w, `"%s_%d.ob.%s" ASC`, sel.Table, sel.ID, ob.Col)
-		case qcode.OrderDesc:
-			fmt.Fprintf(w, `"%s_%d.ob.%s" DESC`, sel.Table, sel.ID, ob.Col)
-		case qcode.OrderAscNullsFirst:
-			fmt.Fprintf(w, `"%s_%d.ob.%s" ASC NULLS FIRST`, sel.Table, sel.ID, ob.Col)
-		case qcode.OrderDescNullsFirst:
-			fmt.Fprintf(w, `%s_%d.ob.%s DESC NULLS FIRST`, sel.Table, sel.ID, ob.Col)
-		case qcode.OrderAscNullsLast:
-			fmt.Fprintf(w, `"%s_%d.ob.%s ASC NULLS LAST`, sel.Table, sel.ID, ob.Col)
-		case qcode.OrderDescNullsLast:
-			fmt.Fprintf(w, `%s_%d.ob.%s DESC NULLS LAST`, sel.Table, sel.ID, ob.Col)
-		default:
-			return fmt.Errorf("[qcode.Order By] unexpected value encountered %v", ob.Order)
-		}
-		if i < len(sel.OrderBy)-1 {
-			io.WriteString(w, ", ")
-		}
-	}
-	return nil
-}
-
 func (v selectBlock) renderDistinctOn(w io.Writer) {
 	io.WriteString(w, ` DISTINCT ON (`)
 	for i := range v.sel.DistinctOn {
@@ -618,7 +1086,7 @@ func renderList(w io.Writer, ex *qcode.Exp) {
 		case qcode.ValBool, qcode.ValInt, qcode.ValFloat:
 			io.WriteString(w, ex.ListVal[i])
 		case qcode.ValStr:
-			fmt.Fprintf(w, `'%s'`, ex.ListVal[i])
+			io.WriteString(w, sqlString(ex.ListVal[i]))
 		}
 
 		if i < len(ex.ListVal)-1 {
@@ -634,7 +1102,7 @@ func renderVal(w io.Writer, ex *qcode.Exp, vars map[string]string) {
 	case qcode.ValBool, qcode.ValInt, qcode.ValFloat:
 		io.WriteString(w, ex.Val)
 	case qcode.ValStr:
-		fmt.Fprintf(w, `'%s'`, ex.Val)
+		io.WriteString(w, sqlString(ex.Val))
 	case qcode.ValVar:
 		if val, ok := vars[ex.Val]; ok {
 			io.WriteString(w, val)
@@ -1,8 +1,10 @@
 package psql
 
 import (
+	"encoding/json"
 	"log"
 	"os"
+	"reflect"
 	"strings"
 	"testing"
 
@@ -14,8 +16,9 @@ const (
 )
 
 var (
-	qcompile *qcode.Compiler
-	pcompile *Compiler
+	qcompile     *qcode.Compiler
+	pcompile     *Compiler
+	testSnapshot *Snapshot
 )
 
 func TestMain(m *testing.M) {
@@ -34,6 +37,7 @@ func TestMain(m *testing.M) {
 				"{ price: { lt: 8 } }",
 			},
 			"customers": []string{},
+			"comments":  []string{},
 			"mes": []string{
 				"{ id: { eq: $user_id } }",
 			},
@@ -43,6 +47,10 @@ func TestMain(m *testing.M) {
 			"password",
 			"token",
 		},
+		FuncMap: map[string]string{
+			"search_products": "products",
+			"checkout":        "purchases",
+		},
 	})
 
 	if err != nil {
@@ -54,6 +62,13 @@ func TestMain(m *testing.M) {
 		&DBTable{Name: "users", Type: "table"},
 		&DBTable{Name: "products", Type: "table"},
 		&DBTable{Name: "purchases", Type: "table"},
+		&DBTable{Name: "addresses", Type: "table"},
+		&DBTable{Name: "orders", Type: "table"},
+		&DBTable{Name: "stocks", Type: "table"},
+		&DBTable{Name: "reservations", Type: "table"},
+		&DBTable{Name: "comments", Type: "table"},
+		&DBTable{Name: "tags", Type: "table"},
+		&DBTable{Name: "events", Type: "table"},
 	}
 
 	columns := [][]*DBColumn{
@@ -88,7 +103,10 @@ func TestMain(m *testing.M) {
 			&DBColumn{ID: 5, Name: "user_id", Type: "bigint", NotNull: false, PrimaryKey: false, Uniquekey: false, FKeyTable: "users", FKeyColID: []int{1}},
 			&DBColumn{ID: 6, Name: "created_at", Type: "timestamp without time zone", NotNull: true, PrimaryKey: false, Uniquekey: false, FKeyTable: "", FKeyColID: []int(nil)},
 			&DBColumn{ID: 7, Name: "updated_at", Type: "timestamp without time zone", NotNull: true, PrimaryKey: false, Uniquekey: false, FKeyTable: "", FKeyColID: []int(nil)},
-			&DBColumn{ID: 8, Name: "tsv", Type: "tsvector", NotNull: false, PrimaryKey: false, Uniquekey: false, FKeyTable: "", FKeyColID: []int(nil)}},
+			&DBColumn{ID: 8, Name: "tsv", Type: "tsvector", NotNull: false, PrimaryKey: false, Uniquekey: false, FKeyTable: "", FKeyColID: []int(nil)},
+			&DBColumn{ID: 9, Name: "tag_ids", Type: "jsonb", NotNull: false, PrimaryKey: false, Uniquekey: false, FKeyTable: "", FKeyColID: []int(nil)},
+			&DBColumn{ID: 10, Name: "description_tsv", Type: "tsvector", NotNull: false, PrimaryKey: false, Uniquekey: false, FKeyTable: "", FKeyColID: []int(nil)},
+			&DBColumn{ID: 11, Name: "metadata", Type: "jsonb", NotNull: false, PrimaryKey: false, Uniquekey: false, FKeyTable: "", FKeyColID: []int(nil)}},
 		[]*DBColumn{
 			&DBColumn{ID: 1, Name: "id", Type: "bigint", NotNull: true, PrimaryKey: true, Uniquekey: false, FKeyTable: "", FKeyColID: []int(nil)},
 			&DBColumn{ID: 2, Name: "customer_id", Type: "bigint", NotNull: false, PrimaryKey: false, Uniquekey: false, FKeyTable: "customers", FKeyColID: []int{1}},
@@ -97,15 +115,112 @@ func TestMain(m *testing.M) {
 			&DBColumn{ID: 5, Name: "quantity", Type: "integer", NotNull: false, PrimaryKey: false, Uniquekey: false, FKeyTable: "", FKeyColID: []int(nil)},
 			&DBColumn{ID: 6, Name: "due_date", Type: "timestamp without time zone", NotNull: false, PrimaryKey: false, Uniquekey: false, FKeyTable: "", FKeyColID: []int(nil)},
 			&DBColumn{ID: 7, Name: "returned", Type: "timestamp without time zone", NotNull: false, PrimaryKey: false, Uniquekey: false, FKeyTable: "", FKeyColID: []int(nil)}},
+		[]*DBColumn{
+			&DBColumn{ID: 1, Name: "id", Type: "bigint", NotNull: true, PrimaryKey: true, Uniquekey: false, FKeyTable: "", FKeyColID: []int(nil)},
+			&DBColumn{ID: 2, Name: "street", Type: "character varying", NotNull: false, PrimaryKey: false, Uniquekey: false, FKeyTable: "", FKeyColID: []int(nil)},
+			&DBColumn{ID: 3, Name: "city", Type: "character varying", NotNull: false, PrimaryKey: false, Uniquekey: false, FKeyTable: "", FKeyColID: []int(nil)}},
+		[]*DBColumn{
+			&DBColumn{ID: 1, Name: "id", Type: "bigint", NotNull: true, PrimaryKey: true, Uniquekey: false, FKeyTable: "", FKeyColID: []int(nil)},
+			&DBColumn{ID: 2, Name: "billing_address_id", Type: "bigint", NotNull: false, PrimaryKey: false, Uniquekey: false, FKeyTable: "addresses", FKeyColID: []int{1}, FKeyName: "orders_billing_address_id_fkey", FKeySrcColID: []int{2}},
+			&DBColumn{ID: 3, Name: "shipping_address_id", Type: "bigint", NotNull: false, PrimaryKey: false, Uniquekey: false, FKeyTable: "addresses", FKeyColID: []int{1}, FKeyName: "orders_shipping_address_id_fkey", FKeySrcColID: []int{3}},
+			&DBColumn{ID: 4, Name: "total", Type: "numeric(7,2)", NotNull: false, PrimaryKey: false, Uniquekey: false, FKeyTable: "", FKeyColID: []int(nil)}},
+		[]*DBColumn{
+			&DBColumn{ID: 1, Name: "product_code", Type: "character varying", NotNull: true, PrimaryKey: true, Uniquekey: false, FKeyTable: "", FKeyColID: []int(nil)},
+			&DBColumn{ID: 2, Name: "warehouse_code", Type: "character varying", NotNull: true, PrimaryKey: true, Uniquekey: false, FKeyTable: "", FKeyColID: []int(nil)},
+			&DBColumn{ID: 3, Name: "quantity", Type: "integer", NotNull: false, PrimaryKey: false, Uniquekey: false, FKeyTable: "", FKeyColID: []int(nil)}},
+		[]*DBColumn{
+			&DBColumn{ID: 1, Name: "id", Type: "bigint", NotNull: true, PrimaryKey: true, Uniquekey: false, FKeyTable: "", FKeyColID: []int(nil)},
+			&DBColumn{ID: 2, Name: "warehouse", Type: "character varying", NotNull: false, PrimaryKey: false, Uniquekey: false, FKeyTable: "stocks", FKeyColID: []int{2, 1}, FKeyName: "reservations_stock_fkey", FKeySrcColID: []int{2, 3}},
+			&DBColumn{ID: 3, Name: "product", Type: "character varying", NotNull: false, PrimaryKey: false, Uniquekey: false, FKeyTable: "stocks", FKeyColID: []int{2, 1}, FKeyName: "reservations_stock_fkey", FKeySrcColID: []int{2, 3}},
+			&DBColumn{ID: 4, Name: "quantity", Type: "integer", NotNull: false, PrimaryKey: false, Uniquekey: false, FKeyTable: "", FKeyColID: []int(nil)}},
+		[]*DBColumn{
+			&DBColumn{ID: 1, Name: "id", Type: "bigint", NotNull: true, PrimaryKey: true, Uniquekey: false, FKeyTable: "", FKeyColID: []int(nil)},
+			&DBColumn{ID: 2, Name: "body", Type: "text", NotNull: false, PrimaryKey: false, Uniquekey: false, FKeyTable: "", FKeyColID: []int(nil)},
+			&DBColumn{ID: 3, Name: "parent_id", Type: "bigint", NotNull: false, PrimaryKey: false, Uniquekey: false, FKeyTable: "comments", FKeyColID: []int{1}, FKeyName: "comments_parent_id_fkey", FKeySrcColID: []int{3}},
+			&DBColumn{ID: 4, Name: "commentable_type", Type: "character varying", NotNull: false, PrimaryKey: false, Uniquekey: false, FKeyTable: "", FKeyColID: []int(nil)},
+			&DBColumn{ID: 5, Name: "commentable_id", Type: "bigint", NotNull: false, PrimaryKey: false, Uniquekey: false, FKeyTable: "", FKeyColID: []int(nil)}},
+		[]*DBColumn{
+			&DBColumn{ID: 1, Name: "id", Type: "bigint", NotNull: true, PrimaryKey: true, Uniquekey: false, FKeyTable: "", FKeyColID: []int(nil)},
+			&DBColumn{ID: 2, Name: "name", Type: "character varying", NotNull: false, PrimaryKey: false, Uniquekey: false, FKeyTable: "", FKeyColID: []int(nil)}},
+		[]*DBColumn{
+			&DBColumn{ID: 1, Name: "id", Type: "bigint", NotNull: false, PrimaryKey: false, Uniquekey: false, FKeyTable: "", FKeyColID: []int(nil)},
+			&DBColumn{ID: 2, Name: "name", Type: "character varying", NotNull: false, PrimaryKey: false, Uniquekey: false, FKeyTable: "", FKeyColID: []int(nil)}},
 	}
 
-	schema := &DBSchema{
-		Tables: make(map[string]*DBTableInfo),
-		RelMap: make(map[TTKey]*DBRel),
-	}
+	testSnapshot = &Snapshot{}
 
 	for i, t := range tables {
-		schema.updateSchema(t, columns[i])
+		testSnapshot.Tables = append(testSnapshot.Tables,
+			&SnapshotTable{t.Name, t.Type, columns[i]})
+	}
+
+	testSnapshot.Functions = []*DBTableFunc{
+		&DBTableFunc{
+			Name:     "search_products",
+			Table:    "products",
+			ArgNames: []string{"q", "max_price"},
+			ArgTypes: []string{"text", "numeric"},
+			Defaults: 1,
+		},
+		&DBTableFunc{
+			Name:     "checkout",
+			Table:    "purchases",
+			ArgNames: []string{"cart_id"},
+			ArgTypes: []string{"bigint"},
+			Volatile: true,
+		},
+	}
+
+	schema := testSnapshot.Schema()
+
+	err = schema.AddRelationships([]RelConfig{
+		RelConfig{
+			Name:         "tags",
+			Type:         "belongs_to",
+			Table:        "products",
+			Columns:      []string{"tag_ids"},
+			ForeignTable: "tags",
+		},
+		RelConfig{
+			Name:         "product",
+			Type:         "belongs_to",
+			Table:        "comments",
+			Columns:      []string{"commentable_id"},
+			ForeignTable: "products",
+			TypeColumn:   "commentable_type",
+			TypeValue:    "Product",
+		},
+		RelConfig{
+			Name:                  "buyers",
+			Type:                  "many_to_many",
+			Table:                 "products",
+			Through:               "purchases",
+			ThroughColumns:        []string{"product_id"},
+			ThroughForeignColumns: []string{"customer_id"},
+			ForeignTable:          "customers",
+		},
+	})
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = schema.AddFunctions([]FuncConfig{
+		FuncConfig{
+			Name:     "display_name",
+			Table:    "users",
+			Function: "full_name",
+		},
+		FuncConfig{
+			Name:     "discount",
+			Table:    "products",
+			Function: "product_discount",
+			Args:     []string{"user_id"},
+		},
+	})
+
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	vars := NewVariables(map[string]string{
@@ -116,8 +231,10 @@ func TestMain(m *testing.M) {
 		Schema: schema,
 		Vars:   vars,
 		TableMap: map[string]string{
-			"mes": "users",
+			"mes":     "users",
+			"replies": "comments",
 		},
+		Mutations: []string{"checkout"},
 	})
 
 	os.Exit(m.Run())
@@ -161,7 +278,7 @@ func withComplexArgs(t *testing.T) {
 		}
 	}`
 
-	sql := `SELECT json_object_agg('products', products) FROM (SELECT coalesce(json_agg("products" ORDER BY "products_0.ob.price" DESC), '[]') AS "products" FROM (SELECT  DISTINCT ON ("products_0.ob.price") row_to_json((SELECT "sel_0" FROM (SELECT "products_0"."id" AS "id", "products_0"."name" AS "name", "products_0"."price" AS "price") AS "sel_0")) AS "products", "products_0"."price" AS "products_0.ob.price" FROM (SELECT "products"."id", "products"."name", "products"."price" FROM "products" WHERE ((("products"."price") > (0)) AND (("products"."price") < (8)) AND (("products"."id") < (28)) AND (("products"."id") >= (20))) LIMIT ('30') :: integer) AS "products_0" ORDER BY "products_0.ob.price" DESC LIMIT ('30') :: integer) AS "products_0") AS "done_1337";`
+	sql := `SELECT json_object_agg('products', products) FROM (SELECT coalesce(json_agg("products" ORDER BY "products_0.ob.price" DESC), '[]') AS "products" FROM (SELECT  DISTINCT ON ("products_0.ob.price") row_to_json((SELECT "sel_0" FROM (SELECT "products_0"."id" AS "id", "products_0"."name" AS "name", "products_0"."price" AS "price") AS "sel_0")) AS "products", "products_0"."price" AS "products_0.ob.price" FROM (SELECT "products"."id", "products"."name", "products"."price" FROM "products" WHERE ((("products"."price") > (0)) AND (("products"."price") < (8)) AND (("products"."id") < (28)) AND (("products"."id") >= (20))) ORDER BY "products"."price" DESC LIMIT ('30') :: integer) AS "products_0" ORDER BY "products_0.ob.price" DESC LIMIT ('30') :: integer) AS "products_0") AS "done_1337";`
 
 	resSQL, err := compileGQLToPSQL(gql)
 	if err != nil {
@@ -201,6 +318,27 @@ func withWhereMultiOr(t *testing.T) {
 	}
 }
 
+// Every field listed in a where object has to match, before only the first
+// one was used and 'id' and 'name' below were dropped without an error.
+func whereMultipleKeys(t *testing.T) {
+	gql := `query {
+		products(where: { price: { gt: 2 }, id: { lt: 5 }, not: { name: { eq: "a" }, description: { is_null: true } } }) {
+			id
+		}
+	}`
+
+	sql := `SELECT json_object_agg('products', products) FROM (SELECT coalesce(json_agg("products"), '[]') AS "products" FROM (SELECT row_to_json((SELECT "sel_0" FROM (SELECT "products_0"."id" AS "id") AS "sel_0")) AS "products" FROM (SELECT "products"."id" FROM "products" WHERE ((("products"."price") > (0)) AND (("products"."price") < (8)) AND (("products"."price") > (2)) AND (("products"."id") < (5)) AND NOT ((("products"."name") = ('a')) AND (("products"."description") IS NULL))) LIMIT ('20') :: integer) AS "products_0" LIMIT ('20') :: integer) AS "products_0") AS "done_1337";`
+
+	resSQL, err := compileGQLToPSQL(gql)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resSQL != sql {
+		t.Fatal(errNotExpected)
+	}
+}
+
 func withWhereIsNull(t *testing.T) {
 	gql := `query {
 		products(
@@ -276,18 +414,40 @@ func oneToMany(t *testing.T) {
 	}
 }
 
-func belongsTo(t *testing.T) {
+func jsonWhere(t *testing.T) {
+	gql := `query {
+		products(where: { metadata: { color: { eq: "red" }, size: { width: { gt: 10 } }, tags: { has_key: "new" } } }) {
+			id
+		}
+	}`
+
+	sql := `SELECT json_object_agg('products', products) FROM (SELECT coalesce(json_agg("products"), '[]') AS "products" FROM (SELECT row_to_json((SELECT "sel_0" FROM (SELECT "products_0"."id" AS "id") AS "sel_0")) AS "products" FROM (SELECT "products"."id" FROM "products" WHERE ((("products"."price") > (0)) AND (("products"."price") < (8)) AND (("products"."metadata"->>'color') = ('red')) AND ((("products"."metadata"#>>'{size,width}') :: numeric) > (10)) AND (("products"."metadata"->'tags') ? ('new'))) LIMIT ('20') :: integer) AS "products_0" LIMIT ('20') :: integer) AS "products_0") AS "done_1337";`
+
+	resSQL, err := compileGQLToPSQL(gql)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resSQL != sql {
+		t.Fatal(errNotExpected)
+	}
+}
+
+func jsonFields(t *testing.T) {
 	gql := `query {
 		products {
-			name
-			price
-			users {
-				email
+			id
+			metadata {
+				color
+				size {
+					width: w
+					h
+				}
 			}
 		}
 	}`
 
-	sql := `SELECT json_object_agg('products', products) FROM (SELECT coalesce(json_agg("products"), '[]') AS "products" FROM (SELECT row_to_json((SELECT "sel_0" FROM (SELECT "products_0"."name" AS "name", "products_0"."price" AS "price", "users_1.join"."users" AS "users") AS "sel_0")) AS "products" FROM (SELECT "products"."name", "products"."price", "products"."user_id" FROM "products" WHERE ((("products"."price") > (0)) AND (("products"."price") < (8))) LIMIT ('20') :: integer) AS "products_0" LEFT OUTER JOIN LATERAL (SELECT coalesce(json_agg("users"), '[]') AS "users" FROM (SELECT row_to_json((SELECT "sel_1" FROM (SELECT "users_1"."email" AS "email") AS "sel_1")) AS "users" FROM (SELECT "users"."email" FROM "users" WHERE ((("users"."id") = ("products_0"."user_id"))) LIMIT ('20') :: integer) AS "users_1" LIMIT ('20') :: integer) AS "users_1") AS "users_1.join" ON ('true') LIMIT ('20') :: integer) AS "products_0") AS "done_1337";`
+	sql := `SELECT json_object_agg('products', products) FROM (SELECT coalesce(json_agg("products"), '[]') AS "products" FROM (SELECT row_to_json((SELECT "sel_0" FROM (SELECT "products_0"."id" AS "id", jsonb_build_object('color', "products_0"."metadata"->'color', 'size', jsonb_build_object('width', "products_0"."metadata"->'size'->'w', 'h', "products_0"."metadata"->'size'->'h')) AS "metadata") AS "sel_0")) AS "products" FROM (SELECT "products"."id", "products"."metadata" FROM "products" WHERE ((("products"."price") > (0)) AND (("products"."price") < (8))) LIMIT ('20') :: integer) AS "products_0" LIMIT ('20') :: integer) AS "products_0") AS "done_1337";`
 
 	resSQL, err := compileGQLToPSQL(gql)
 	if err != nil {
@@ -299,18 +459,33 @@ func belongsTo(t *testing.T) {
 	}
 }
 
-func manyToMany(t *testing.T) {
-	gql := `query { 
-		products {
+func whereRelated(t *testing.T) {
+	gql := `query {
+		customers(where: { purchases: { quantity: { gt: 1 }, product: { price: { gt: 10 } } } }) {
+			email
+		}
+	}`
+
+	sql := `SELECT json_object_agg('customers', customers) FROM (SELECT coalesce(json_agg("customers"), '[]') AS "customers" FROM (SELECT row_to_json((SELECT "sel_0" FROM (SELECT "customers_0"."email" AS "email") AS "sel_0")) AS "customers" FROM (SELECT "customers"."email" FROM "customers" WHERE (EXISTS (SELECT 1 FROM "purchases" AS "customers.purchases" WHERE ((("customers.purchases"."customer_id") = ("customers"."id"))) AND ((("customers.purchases"."quantity") > (1)) AND EXISTS (SELECT 1 FROM "products" AS "customers.purchases.product" WHERE ((("customers.purchases.product"."id") = ("customers.purchases"."product_id"))) AND ((("customers.purchases.product"."price") > (10))))))) LIMIT ('20') :: integer) AS "customers_0" LIMIT ('20') :: integer) AS "customers_0") AS "done_1337";`
+
+	resSQL, err := compileGQLToPSQL(gql)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resSQL != sql {
+		t.Fatal(errNotExpected)
+	}
+}
+
+func whereRelatedNone(t *testing.T) {
+	gql := `query {
+		products(where: { not: { customers: { email: { like: "%@example.com" } } } }) {
 			name
-			customers {
-				email
-				full_name
-			}
 		}
 	}`
 
-	sql := `SELECT json_object_agg('products', products) FROM (SELECT coalesce(json_agg("products"), '[]') AS "products" FROM (SELECT row_to_json((SELECT "sel_0" FROM (SELECT "products_0"."name" AS "name", "customers_1.join"."customers" AS "customers") AS "sel_0")) AS "products" FROM (SELECT "products"."name", "products"."id" FROM "products" WHERE ((("products"."price") > (0)) AND (("products"."price") < (8))) LIMIT ('20') :: integer) AS "products_0" LEFT OUTER JOIN LATERAL (SELECT coalesce(json_agg("customers"), '[]') AS "customers" FROM (SELECT row_to_json((SELECT "sel_1" FROM (SELECT "customers_1"."email" AS "email", "customers_1"."full_name" AS "full_name") AS "sel_1")) AS "customers" FROM (SELECT "customers"."email", "customers"."full_name" FROM "customers" LEFT OUTER JOIN "purchases" ON (("purchases"."product_id") = ("products_0"."id")) WHERE ((("customers"."id") = ("purchases"."customer_id"))) LIMIT ('20') :: integer) AS "customers_1" LIMIT ('20') :: integer) AS "customers_1") AS "customers_1.join" ON ('true') LIMIT ('20') :: integer) AS "products_0") AS "done_1337";`
+	sql := `SELECT json_object_agg('products', products) FROM (SELECT coalesce(json_agg("products"), '[]') AS "products" FROM (SELECT row_to_json((SELECT "sel_0" FROM (SELECT "products_0"."name" AS "name") AS "sel_0")) AS "products" FROM (SELECT "products"."name" FROM "products" WHERE ((("products"."price") > (0)) AND (("products"."price") < (8)) AND NOT EXISTS (SELECT 1 FROM "customers" AS "products.customers", "purchases" WHERE ((("products.customers"."id") = ("purchases"."customer_id")) AND (("purchases"."product_id") = ("products"."id"))) AND ((("products.customers"."email") LIKE ('%@example.com'))))) LIMIT ('20') :: integer) AS "products_0" LIMIT ('20') :: integer) AS "products_0") AS "done_1337";`
 
 	resSQL, err := compileGQLToPSQL(gql)
 	if err != nil {
@@ -322,18 +497,56 @@ func manyToMany(t *testing.T) {
 	}
 }
 
-func manyToManyReverse(t *testing.T) {
+func orderByRelated(t *testing.T) {
 	gql := `query {
-		customers {
+		products(order_by: { user: { email: asc } }) {
+			name
+		}
+	}`
+
+	sql := `SELECT json_object_agg('products', products) FROM (SELECT coalesce(json_agg("products" ORDER BY "products_0.ob.user.email" ASC), '[]') AS "products" FROM (SELECT row_to_json((SELECT "sel_0" FROM (SELECT "products_0"."name" AS "name") AS "sel_0")) AS "products", "products_0"."user.email" AS "products_0.ob.user.email" FROM (SELECT "products"."name", (SELECT "products.user"."email" FROM "users" AS "products.user" WHERE ((("products.user"."id") = ("products"."user_id"))) LIMIT 1) AS "user.email" FROM "products" WHERE ((("products"."price") > (0)) AND (("products"."price") < (8))) ORDER BY "user.email" ASC LIMIT ('20') :: integer) AS "products_0" ORDER BY "products_0.ob.user.email" ASC LIMIT ('20') :: integer) AS "products_0") AS "done_1337";`
+
+	resSQL, err := compileGQLToPSQL(gql)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resSQL != sql {
+		t.Fatal(errNotExpected)
+	}
+}
+
+func orderByAggregate(t *testing.T) {
+	gql := `query {
+		customers(order_by: { purchases_aggregate: { count: desc, sum: { quantity: desc_nulls_last } } }) {
 			email
-			full_name
-			products {
+		}
+	}`
+
+	sql := `SELECT json_object_agg('customers', customers) FROM (SELECT coalesce(json_agg("customers" ORDER BY "customers_0.ob.purchases_aggregate.count" DESC, "customers_0.ob.purchases_aggregate.sum.quantity" DESC NULLS LAST), '[]') AS "customers" FROM (SELECT row_to_json((SELECT "sel_0" FROM (SELECT "customers_0"."email" AS "email") AS "sel_0")) AS "customers", "customers_0"."purchases_aggregate.count" AS "customers_0.ob.purchases_aggregate.count", "customers_0"."purchases_aggregate.sum.quantity" AS "customers_0.ob.purchases_aggregate.sum.quantity" FROM (SELECT "customers"."email", (SELECT count(*) FROM "purchases" AS "customers.purchases_aggregate" WHERE ((("customers.purchases_aggregate"."customer_id") = ("customers"."id")))) AS "purchases_aggregate.count", (SELECT sum("customers.purchases_aggregate"."quantity") FROM "purchases" AS "customers.purchases_aggregate" WHERE ((("customers.purchases_aggregate"."customer_id") = ("customers"."id")))) AS "purchases_aggregate.sum.quantity" FROM "customers" ORDER BY "purchases_aggregate.count" DESC, "purchases_aggregate.sum.quantity" DESC NULLS LAST LIMIT ('20') :: integer) AS "customers_0" ORDER BY "customers_0.ob.purchases_aggregate.count" DESC, "customers_0.ob.purchases_aggregate.sum.quantity" DESC NULLS LAST LIMIT ('20') :: integer) AS "customers_0") AS "done_1337";`
+
+	resSQL, err := compileGQLToPSQL(gql)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resSQL != sql {
+		t.Fatal(errNotExpected)
+	}
+}
+
+func computedFields(t *testing.T) {
+	gql := `query {
+		users(where: { display_name: { ilike: "%doe%" } }, order_by: { display_name: asc }) {
+			id
+			display_name
+			products(order_by: { discount: desc }) {
 				name
 			}
 		}
 	}`
 
-	sql := `SELECT json_object_agg('customers', customers) FROM (SELECT coalesce(json_agg("customers"), '[]') AS "customers" FROM (SELECT row_to_json((SELECT "sel_0" FROM (SELECT "customers_0"."email" AS "email", "customers_0"."full_name" AS "full_name", "products_1.join"."products" AS "products") AS "sel_0")) AS "customers" FROM (SELECT "customers"."email", "customers"."full_name", "customers"."id" FROM "customers" LIMIT ('20') :: integer) AS "customers_0" LEFT OUTER JOIN LATERAL (SELECT coalesce(json_agg("products"), '[]') AS "products" FROM (SELECT row_to_json((SELECT "sel_1" FROM (SELECT "products_1"."name" AS "name") AS "sel_1")) AS "products" FROM (SELECT "products"."name" FROM "products" LEFT OUTER JOIN "purchases" ON (("purchases"."customer_id") = ("customers_0"."id")) WHERE ((("products"."id") = ("purchases"."product_id"))) LIMIT ('20') :: integer) AS "products_1" LIMIT ('20') :: integer) AS "products_1") AS "products_1.join" ON ('true') LIMIT ('20') :: integer) AS "customers_0") AS "done_1337";`
+	sql := `SELECT json_object_agg('users', users) FROM (SELECT coalesce(json_agg("users" ORDER BY "users_0.ob.display_name" ASC), '[]') AS "users" FROM (SELECT row_to_json((SELECT "sel_0" FROM (SELECT "users_0"."id" AS "id", "users_0"."display_name" AS "display_name", "products_1.join"."products" AS "products") AS "sel_0")) AS "users", "users_0"."display_name" AS "users_0.ob.display_name" FROM (SELECT "users"."id", "full_name"("users") AS display_name FROM "users" WHERE ((("users"."id") = ('{{user_id}}')) AND (("full_name"("users")) ILIKE ('%doe%'))) ORDER BY "display_name" ASC LIMIT ('20') :: integer) AS "users_0" LEFT OUTER JOIN LATERAL (SELECT coalesce(json_agg("products" ORDER BY "products_1.ob.discount" DESC), '[]') AS "products" FROM (SELECT row_to_json((SELECT "sel_1" FROM (SELECT "products_1"."name" AS "name") AS "sel_1")) AS "products", "products_1"."discount" AS "products_1.ob.discount" FROM (SELECT "products"."name", "product_discount"("products", '{{user_id}}') AS discount FROM "products" WHERE ((("products"."user_id") = ("users_0"."id"))) ORDER BY "discount" DESC LIMIT ('20') :: integer) AS "products_1" ORDER BY "products_1.ob.discount" DESC LIMIT ('20') :: integer) AS "products_1") AS "products_1.join" ON ('true') ORDER BY "users_0.ob.display_name" ASC LIMIT ('20') :: integer) AS "users_0") AS "done_1337";`
 
 	resSQL, err := compileGQLToPSQL(gql)
 	if err != nil {
@@ -345,15 +558,14 @@ func manyToManyReverse(t *testing.T) {
 	}
 }
 
-func fetchByID(t *testing.T) {
+func whereInjection(t *testing.T) {
 	gql := `query {
-		product(id: 15) {
+		products(where: { name: { eq: "x') OR ('1'='1" }, description: { in: ["a", "b') OR true --"] } }) {
 			id
-			name
 		}
 	}`
 
-	sql := `SELECT json_object_agg('product', products) FROM (SELECT row_to_json((SELECT "sel_0" FROM (SELECT "products_0"."id" AS "id", "products_0"."name" AS "name") AS "sel_0")) AS "products" FROM (SELECT "products"."id", "products"."name" FROM "products" WHERE ((("products"."price") > (0)) AND (("products"."price") < (8)) AND (("id") = ('15'))) LIMIT ('1') :: integer) AS "products_0" LIMIT ('1') :: integer) AS "done_1337";`
+	sql := `SELECT json_object_agg('products', products) FROM (SELECT coalesce(json_agg("products"), '[]') AS "products" FROM (SELECT row_to_json((SELECT "sel_0" FROM (SELECT "products_0"."id" AS "id") AS "sel_0")) AS "products" FROM (SELECT "products"."id" FROM "products" WHERE ((("products"."price") > (0)) AND (("products"."price") < (8)) AND (("products"."name") = ('x'') OR (''1''=''1')) AND (("products"."description") IN ('a', 'b'') OR true --'))) LIMIT ('20') :: integer) AS "products_0" LIMIT ('20') :: integer) AS "products_0") AS "done_1337";`
 
 	resSQL, err := compileGQLToPSQL(gql)
 	if err != nil {
@@ -365,35 +577,79 @@ func fetchByID(t *testing.T) {
 	}
 }
 
-func searchQuery(t *testing.T) {
+func whereTemplateTag(t *testing.T) {
 	gql := `query {
-		products(search: "Imperial") {
+		products(where: { name: { eq: "{{user_id}}" }, description: { in: ["{{", "a\b {{{"] } }, search: "}} {{") {
 			id
-			name
 		}
 	}`
 
-	sql := `SELECT json_object_agg('products', products) FROM (SELECT coalesce(json_agg("products"), '[]') AS "products" FROM (SELECT row_to_json((SELECT "sel_0" FROM (SELECT "products_0"."id" AS "id", "products_0"."name" AS "name") AS "sel_0")) AS "products" FROM (SELECT "products"."id", "products"."name" FROM "products" WHERE ((("products"."price") > (0)) AND (("products"."price") < (8)) AND (("tsv") @@ to_tsquery('Imperial'))) LIMIT ('20') :: integer) AS "products_0" LIMIT ('20') :: integer) AS "products_0") AS "done_1337";`
+	sql := `SELECT json_object_agg('products', products) FROM (SELECT coalesce(json_agg("products"), '[]') AS "products" FROM (SELECT row_to_json((SELECT "sel_0" FROM (SELECT "products_0"."id" AS "id") AS "sel_0")) AS "products" FROM (SELECT "products"."id" FROM "products" WHERE ((("products"."price") > (0)) AND (("products"."price") < (8)) AND (("products"."tsv") @@ websearch_to_tsquery(E'}} {\u007b')) AND (("products"."name") = (E'{\u007buser_id}}')) AND (("products"."description") IN (E'{\u007b', E'a\\b {\u007b{'))) LIMIT ('20') :: integer) AS "products_0" LIMIT ('20') :: integer) AS "products_0") AS "done_1337";`
 
 	resSQL, err := compileGQLToPSQL(gql)
 	if err != nil {
 		t.Fatal(err)
 	}
 
+	if strings.Contains(resSQL, "{{") {
+		t.Fatal("expected no template tags in the values")
+	}
+
 	if resSQL != sql {
 		t.Fatal(errNotExpected)
 	}
 }
 
-func aggFunction(t *testing.T) {
+func fetchByIDInjection(t *testing.T) {
 	gql := `query {
-		products {
+		product(id: "15') OR ('1'='1") {
+			id
+		}
+	}`
+
+	sql := `SELECT json_object_agg('product', products) FROM (SELECT row_to_json((SELECT "sel_0" FROM (SELECT "products_0"."id" AS "id") AS "sel_0")) AS "products" FROM (SELECT "products"."id" FROM "products" WHERE ((("products"."price") > (0)) AND (("products"."price") < (8)) AND (("id") = ('15'') OR (''1''=''1'))) LIMIT ('1') :: integer) AS "products_0" LIMIT ('1') :: integer) AS "done_1337";`
+
+	resSQL, err := compileGQLToPSQL(gql)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resSQL != sql {
+		t.Fatal(errNotExpected)
+	}
+}
+
+func tableFunctionInjection(t *testing.T) {
+	gql := `query {
+		search_products(q: "x' :: text) AS t --") {
+			id
+		}
+	}`
+
+	sql := `SELECT json_object_agg('search_products', search_products) FROM (SELECT coalesce(json_agg("search_products"), '[]') AS "search_products" FROM (SELECT row_to_json((SELECT "sel_0" FROM (SELECT "search_products_0"."id" AS "id") AS "sel_0")) AS "search_products" FROM (SELECT "search_products"."id" FROM "search_products"("q" => 'x'' :: text) AS t --' :: text) AS "search_products" WHERE ((("search_products"."price") > (0)) AND (("search_products"."price") < (8))) LIMIT ('20') :: integer) AS "search_products_0" LIMIT ('20') :: integer) AS "search_products_0") AS "done_1337";`
+
+	resSQL, err := compileGQLToPSQL(gql)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resSQL != sql {
+		t.Fatal(errNotExpected)
+	}
+}
+
+func tableFunction(t *testing.T) {
+	gql := `query {
+		search_products(q: "it's", where: { price: { lt: 10 } }, order_by: { price: desc }, limit: 5) {
+			id
 			name
-			count_price
+			user {
+				email
+			}
 		}
 	}`
 
-	sql := `SELECT json_object_agg('products', products) FROM (SELECT coalesce(json_agg("products"), '[]') AS "products" FROM (SELECT row_to_json((SELECT "sel_0" FROM (SELECT "products_0"."name" AS "name", "products_0"."count_price" AS "count_price") AS "sel_0")) AS "products" FROM (SELECT "products"."name", count("products"."price") AS count_price FROM "products" WHERE ((("products"."price") > (0)) AND (("products"."price") < (8))) GROUP BY "products"."name" LIMIT ('20') :: integer) AS "products_0" LIMIT ('20') :: integer) AS "products_0") AS "done_1337";`
+	sql := `SELECT json_object_agg('search_products', search_products) FROM (SELECT coalesce(json_agg("search_products" ORDER BY "search_products_0.ob.price" DESC), '[]') AS "search_products" FROM (SELECT row_to_json((SELECT "sel_0" FROM (SELECT "search_products_0"."id" AS "id", "search_products_0"."name" AS "name", "users_1.join"."users" AS "user") AS "sel_0")) AS "search_products", "search_products_0"."price" AS "search_products_0.ob.price" FROM (SELECT "search_products"."id", "search_products"."name", "search_products"."user_id", "search_products"."price" FROM "search_products"("q" => 'it''s' :: text) AS "search_products" WHERE ((("search_products"."price") > (0)) AND (("search_products"."price") < (8)) AND (("search_products"."price") < (10))) ORDER BY "search_products"."price" DESC LIMIT ('5') :: integer) AS "search_products_0" LEFT OUTER JOIN LATERAL (SELECT row_to_json((SELECT "sel_1" FROM (SELECT "users_1"."email" AS "email") AS "sel_1")) AS "users" FROM (SELECT "users"."email" FROM "users" WHERE ((("users"."id") = ("search_products_0"."user_id"))) LIMIT ('1') :: integer) AS "users_1" LIMIT ('1') :: integer) AS "users_1.join" ON ('true') ORDER BY "search_products_0.ob.price" DESC LIMIT ('5') :: integer) AS "search_products_0") AS "done_1337";`
 
 	resSQL, err := compileGQLToPSQL(gql)
 	if err != nil {
@@ -405,15 +661,31 @@ func aggFunction(t *testing.T) {
 	}
 }
 
-func aggFunctionWithFilter(t *testing.T) {
+func tableFunctionArgs(t *testing.T) {
 	gql := `query {
-		products(where: { id: { gt: 10 } }) {
+		search_products(query: "shoes") {
 			id
-			max_price
 		}
 	}`
 
-	sql := `SELECT json_object_agg('products', products) FROM (SELECT coalesce(json_agg("products"), '[]') AS "products" FROM (SELECT row_to_json((SELECT "sel_0" FROM (SELECT "products_0"."id" AS "id", "products_0"."max_price" AS "max_price") AS "sel_0")) AS "products" FROM (SELECT "products"."id", max("products"."price") AS max_price FROM "products" WHERE ((("products"."price") > (0)) AND (("products"."price") < (8)) AND (("products"."id") > (10))) GROUP BY "products"."id" LIMIT ('20') :: integer) AS "products_0" LIMIT ('20') :: integer) AS "products_0") AS "done_1337";`
+	_, err := compileGQLToPSQL(gql)
+	if err == nil {
+		t.Fatal("expecting an error for a missing function argument")
+	}
+}
+
+func functionMutation(t *testing.T) {
+	gql := `mutation {
+		checkout(cart_id: 5) {
+			id
+			quantity
+			product {
+				name
+			}
+		}
+	}`
+
+	sql := `SELECT json_object_agg('checkout', checkouts) FROM (SELECT row_to_json((SELECT "sel_0" FROM (SELECT "checkouts_0"."id" AS "id", "checkouts_0"."quantity" AS "quantity", "products_1.join"."products" AS "product") AS "sel_0")) AS "checkouts" FROM (SELECT "checkouts"."id", "checkouts"."quantity", "checkouts"."product_id" FROM "checkout"("cart_id" => 5 :: bigint) AS "checkouts" WHERE ((("checkouts"."user_id") = ('{{user_id}}'))) LIMIT ('1') :: integer) AS "checkouts_0" LEFT OUTER JOIN LATERAL (SELECT row_to_json((SELECT "sel_1" FROM (SELECT "products_1"."name" AS "name") AS "sel_1")) AS "products" FROM (SELECT "products"."name" FROM "products" WHERE ((("products"."id") = ("checkouts_0"."product_id"))) LIMIT ('1') :: integer) AS "products_1" LIMIT ('1') :: integer) AS "products_1.join" ON ('true') LIMIT ('1') :: integer) AS "done_1337";`
 
 	resSQL, err := compileGQLToPSQL(gql)
 	if err != nil {
@@ -425,14 +697,105 @@ func aggFunctionWithFilter(t *testing.T) {
 	}
 }
 
-func syntheticTables(t *testing.T) {
+func functionMutationErrors(t *testing.T) {
+	gqls := []string{
+		`query { checkout(cart_id: 5) { id } }`,
+		`mutation { products { id } }`,
+		`mutation { search_products(q: "ale") { id } }`,
+	}
+
+	for _, gql := range gqls {
+		if _, err := compileGQLToPSQL(gql); err == nil {
+			t.Fatalf("expecting an error for '%s'", gql)
+		}
+	}
+
+	// Volatile functions not in the config cannot be called
+	qc, err := qcompile.CompileQuery(`mutation { checkout(cart_id: 5) { id } }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sb strings.Builder
+	pc := NewCompiler(Config{Schema: pcompile.schema})
+
+	if err := pc.Compile(&sb, qc); err == nil || !strings.Contains(err.Error(), "allowed") {
+		t.Fatalf("expecting an error for a mutation not allowed got %v", err)
+	}
+}
+
+func queryTables(t *testing.T) {
+	tests := []struct {
+		gql    string
+		tables []string
+		known  bool
+	}{
+		{`query {
+			me {
+				email
+				products {
+					name
+					buyers {
+						email
+					}
+				}
+			}
+		}`, []string{"users", "products", "purchases", "customers"}, true},
+
+		{`query {
+			customers(where: { purchases: { product: { price: { gt: 10 } } } }) {
+				email
+			}
+		}`, []string{"customers", "purchases", "products"}, true},
+
+		{`query {
+			products(order_by: { user: { email: asc } }) {
+				name
+			}
+		}`, []string{"products", "users"}, true},
+
+		{`query {
+			users(where: { display_name: { ilike: "%doe%" } }) {
+				id
+			}
+		}`, []string{"users"}, false},
+
+		{`query {
+			search_products(q: "shoes") {
+				id
+			}
+		}`, []string{"products"}, false},
+	}
+
+	for _, tt := range tests {
+		qc, err := qcompile.CompileQuery(tt.gql)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tables, known, err := pcompile.Tables(qc)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(tables, tt.tables) || known != tt.known {
+			t.Fatalf("expecting tables %v (%t) got %v (%t)", tt.tables, tt.known, tables, known)
+		}
+	}
+}
+
+func belongsTo(t *testing.T) {
 	gql := `query {
-		me {
-			email
+		products {
+			name
+			price
+			users {
+				email
+			}
 		}
 	}`
 
-	sql := `SELECT json_object_agg('me', mes) FROM (SELECT row_to_json((SELECT "sel_0" FROM (SELECT "mes_0"."email" AS "email") AS "sel_0")) AS "mes" FROM (SELECT "mes"."email" FROM "users" AS "mes" WHERE ((("mes"."id") = ('{{user_id}}'))) LIMIT ('1') :: integer) AS "mes_0" LIMIT ('1') :: integer) AS "done_1337";`
+	sql := `SELECT json_object_agg('products', products) FROM (SELECT coalesce(json_agg("products"), '[]') AS "products" FROM (SELECT row_to_json((SELECT "sel_0" FROM (SELECT "products_0"."name" AS "name", "products_0"."price" AS "price", "users_1.join"."users" AS "users") AS "sel_0")) AS "products" FROM (SELECT "products"."name", "products"."price", "products"."user_id" FROM "products" WHERE ((("products"."price") > (0)) AND (("products"."price") < (8))) LIMIT ('20') :: integer) AS "products_0" LEFT OUTER JOIN LATERAL (SELECT coalesce(json_agg("users"), '[]') AS "users" FROM (SELECT row_to_json((SELECT "sel_1" FROM (SELECT "users_1"."email" AS "email") AS "sel_1")) AS "users" FROM (SELECT "users"."email" FROM "users" WHERE ((("users"."id") = ("products_0"."user_id"))) LIMIT ('20') :: integer) AS "users_1" LIMIT ('20') :: integer) AS "users_1") AS "users_1.join" ON ('true') LIMIT ('20') :: integer) AS "products_0") AS "done_1337";`
 
 	resSQL, err := compileGQLToPSQL(gql)
 	if err != nil {
@@ -444,20 +807,677 @@ func syntheticTables(t *testing.T) {
 	}
 }
 
-func TestCompileGQL(t *testing.T) {
-	t.Run("withComplexArgs", withComplexArgs)
-	t.Run("withWhereAndList", withWhereAndList)
-	t.Run("withWhereIsNull", withWhereIsNull)
-	t.Run("withWhereMultiOr", withWhereMultiOr)
-	t.Run("fetchByID", fetchByID)
-	t.Run("searchQuery", searchQuery)
-	t.Run("belongsTo", belongsTo)
+func manyToMany(t *testing.T) {
+	gql := `query { 
+		products {
+			name
+			customers {
+				email
+				full_name
+			}
+		}
+	}`
+
+	sql := `SELECT json_object_agg('products', products) FROM (SELECT coalesce(json_agg("products"), '[]') AS "products" FROM (SELECT row_to_json((SELECT "sel_0" FROM (SELECT "products_0"."name" AS "name", "customers_1.join"."customers" AS "customers") AS "sel_0")) AS "products" FROM (SELECT "products"."name", "products"."id" FROM "products" WHERE ((("products"."price") > (0)) AND (("products"."price") < (8))) LIMIT ('20') :: integer) AS "products_0" LEFT OUTER JOIN LATERAL (SELECT coalesce(json_agg("customers"), '[]') AS "customers" FROM (SELECT row_to_json((SELECT "sel_1" FROM (SELECT "customers_1"."email" AS "email", "customers_1"."full_name" AS "full_name") AS "sel_1")) AS "customers" FROM (SELECT "customers"."email", "customers"."full_name" FROM "customers" LEFT OUTER JOIN "purchases" ON (("purchases"."product_id") = ("products_0"."id")) WHERE ((("customers"."id") = ("purchases"."customer_id"))) LIMIT ('20') :: integer) AS "customers_1" LIMIT ('20') :: integer) AS "customers_1") AS "customers_1.join" ON ('true') LIMIT ('20') :: integer) AS "products_0") AS "done_1337";`
+
+	resSQL, err := compileGQLToPSQL(gql)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resSQL != sql {
+		t.Fatal(errNotExpected)
+	}
+}
+
+func manyToManyReverse(t *testing.T) {
+	gql := `query {
+		customers {
+			email
+			full_name
+			products {
+				name
+			}
+		}
+	}`
+
+	sql := `SELECT json_object_agg('customers', customers) FROM (SELECT coalesce(json_agg("customers"), '[]') AS "customers" FROM (SELECT row_to_json((SELECT "sel_0" FROM (SELECT "customers_0"."email" AS "email", "customers_0"."full_name" AS "full_name", "products_1.join"."products" AS "products") AS "sel_0")) AS "customers" FROM (SELECT "customers"."email", "customers"."full_name", "customers"."id" FROM "customers" LIMIT ('20') :: integer) AS "customers_0" LEFT OUTER JOIN LATERAL (SELECT coalesce(json_agg("products"), '[]') AS "products" FROM (SELECT row_to_json((SELECT "sel_1" FROM (SELECT "products_1"."name" AS "name") AS "sel_1")) AS "products" FROM (SELECT "products"."name" FROM "products" LEFT OUTER JOIN "purchases" ON (("purchases"."customer_id") = ("customers_0"."id")) WHERE ((("products"."id") = ("purchases"."product_id"))) LIMIT ('20') :: integer) AS "products_1" LIMIT ('20') :: integer) AS "products_1") AS "products_1.join" ON ('true') LIMIT ('20') :: integer) AS "customers_0") AS "done_1337";`
+
+	resSQL, err := compileGQLToPSQL(gql)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resSQL != sql {
+		t.Fatal(errNotExpected)
+	}
+}
+
+func fetchByID(t *testing.T) {
+	gql := `query {
+		product(id: 15) {
+			id
+			name
+		}
+	}`
+
+	sql := `SELECT json_object_agg('product', products) FROM (SELECT row_to_json((SELECT "sel_0" FROM (SELECT "products_0"."id" AS "id", "products_0"."name" AS "name") AS "sel_0")) AS "products" FROM (SELECT "products"."id", "products"."name" FROM "products" WHERE ((("products"."price") > (0)) AND (("products"."price") < (8)) AND (("id") = ('15'))) LIMIT ('1') :: integer) AS "products_0" LIMIT ('1') :: integer) AS "done_1337";`
+
+	resSQL, err := compileGQLToPSQL(gql)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resSQL != sql {
+		t.Fatal(errNotExpected)
+	}
+}
+
+func searchQuery(t *testing.T) {
+	gql := `query {
+		products(search: "Imperial") {
+			id
+			name
+		}
+	}`
+
+	sql := `SELECT json_object_agg('products', products) FROM (SELECT coalesce(json_agg("products"), '[]') AS "products" FROM (SELECT row_to_json((SELECT "sel_0" FROM (SELECT "products_0"."id" AS "id", "products_0"."name" AS "name") AS "sel_0")) AS "products" FROM (SELECT "products"."id", "products"."name" FROM "products" WHERE ((("products"."price") > (0)) AND (("products"."price") < (8)) AND (("products"."tsv") @@ websearch_to_tsquery('Imperial'))) LIMIT ('20') :: integer) AS "products_0" LIMIT ('20') :: integer) AS "products_0") AS "done_1337";`
+
+	resSQL, err := compileGQLToPSQL(gql)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resSQL != sql {
+		t.Fatal(errNotExpected)
+	}
+}
+
+func searchOptions(t *testing.T) {
+	gql := `query {
+		products(search: { query: "red 'shoes'", column: "description_tsv", language: "english", parser: "plain", normalization: 32 }) {
+			id
+			search_rank
+			search_headline_description
+		}
+	}`
+
+	sql := `SELECT json_object_agg('products', products) FROM (SELECT coalesce(json_agg("products"), '[]') AS "products" FROM (SELECT row_to_json((SELECT "sel_0" FROM (SELECT "products_0"."id" AS "id", "products_0"."search_rank" AS "search_rank", "products_0"."search_headline_description" AS "search_headline_description") AS "sel_0")) AS "products" FROM (SELECT "products"."id", ts_rank("products"."description_tsv", plainto_tsquery('english', 'red ''shoes'''), 32) AS search_rank, ts_headline('english', "products"."description", plainto_tsquery('english', 'red ''shoes''')) AS search_headline_description FROM "products" WHERE ((("products"."price") > (0)) AND (("products"."price") < (8)) AND (("products"."description_tsv") @@ plainto_tsquery('english', 'red ''shoes'''))) LIMIT ('20') :: integer) AS "products_0" LIMIT ('20') :: integer) AS "products_0") AS "done_1337";`
+
+	resSQL, err := compileGQLToPSQL(gql)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resSQL != sql {
+		t.Fatal(errNotExpected)
+	}
+}
+
+func searchNested(t *testing.T) {
+	gql := `query {
+		users {
+			email
+			products(search: "red shoes") {
+				name
+			}
+		}
+	}`
+
+	sql := `SELECT json_object_agg('users', users) FROM (SELECT coalesce(json_agg("users"), '[]') AS "users" FROM (SELECT row_to_json((SELECT "sel_0" FROM (SELECT "users_0"."email" AS "email", "products_1.join"."products" AS "products") AS "sel_0")) AS "users" FROM (SELECT "users"."email", "users"."id" FROM "users" WHERE ((("users"."id") = ('{{user_id}}'))) LIMIT ('20') :: integer) AS "users_0" LEFT OUTER JOIN LATERAL (SELECT coalesce(json_agg("products"), '[]') AS "products" FROM (SELECT row_to_json((SELECT "sel_1" FROM (SELECT "products_1"."name" AS "name") AS "sel_1")) AS "products" FROM (SELECT "products"."name" FROM "products" WHERE ((("products"."user_id") = ("users_0"."id")) AND (("products"."tsv") @@ websearch_to_tsquery('red shoes'))) LIMIT ('20') :: integer) AS "products_1" LIMIT ('20') :: integer) AS "products_1") AS "products_1.join" ON ('true') LIMIT ('20') :: integer) AS "users_0") AS "done_1337";`
+
+	resSQL, err := compileGQLToPSQL(gql)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resSQL != sql {
+		t.Fatal(errNotExpected)
+	}
+}
+
+func aggFunction(t *testing.T) {
+	gql := `query {
+		products {
+			name
+			count_price
+		}
+	}`
+
+	sql := `SELECT json_object_agg('products', products) FROM (SELECT coalesce(json_agg("products"), '[]') AS "products" FROM (SELECT row_to_json((SELECT "sel_0" FROM (SELECT "products_0"."name" AS "name", "products_0"."count_price" AS "count_price") AS "sel_0")) AS "products" FROM (SELECT "products"."name", count("products"."price") AS count_price FROM "products" WHERE ((("products"."price") > (0)) AND (("products"."price") < (8))) GROUP BY "products"."name" LIMIT ('20') :: integer) AS "products_0" LIMIT ('20') :: integer) AS "products_0") AS "done_1337";`
+
+	resSQL, err := compileGQLToPSQL(gql)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resSQL != sql {
+		t.Fatal(errNotExpected)
+	}
+}
+
+func aggFunctionWithFilter(t *testing.T) {
+	gql := `query {
+		products(where: { id: { gt: 10 } }) {
+			id
+			max_price
+		}
+	}`
+
+	sql := `SELECT json_object_agg('products', products) FROM (SELECT coalesce(json_agg("products"), '[]') AS "products" FROM (SELECT row_to_json((SELECT "sel_0" FROM (SELECT "products_0"."id" AS "id", "products_0"."max_price" AS "max_price") AS "sel_0")) AS "products" FROM (SELECT "products"."id", max("products"."price") AS max_price FROM "products" WHERE ((("products"."price") > (0)) AND (("products"."price") < (8)) AND (("products"."id") > (10))) GROUP BY "products"."id" LIMIT ('20') :: integer) AS "products_0" LIMIT ('20') :: integer) AS "products_0") AS "done_1337";`
+
+	resSQL, err := compileGQLToPSQL(gql)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resSQL != sql {
+		t.Fatal(errNotExpected)
+	}
+}
+
+func syntheticTables(t *testing.T) {
+	gql := `query {
+		me {
+			email
+		}
+	}`
+
+	sql := `SELECT json_object_agg('me', mes) FROM (SELECT row_to_json((SELECT "sel_0" FROM (SELECT "mes_0"."email" AS "email") AS "sel_0")) AS "mes" FROM (SELECT "mes"."email" FROM "users" AS "mes" WHERE ((("mes"."id") = ('{{user_id}}'))) LIMIT ('1') :: integer) AS "mes_0" LIMIT ('1') :: integer) AS "done_1337";`
+
+	resSQL, err := compileGQLToPSQL(gql)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resSQL != sql {
+		t.Fatal(errNotExpected)
+	}
+}
+
+func multipleForeignKeys(t *testing.T) {
+	gql := `query {
+		orders {
+			id
+			billing_address {
+				street
+			}
+			shipping_address {
+				street
+			}
+		}
+	}`
+
+	sql := `SELECT json_object_agg('orders', orders) FROM (SELECT coalesce(json_agg("orders"), '[]') AS "orders" FROM (SELECT row_to_json((SELECT "sel_0" FROM (SELECT "orders_0"."id" AS "id", "shipping_addresses_1.join"."shipping_addresses" AS "shipping_address", "billing_addresses_2.join"."billing_addresses" AS "billing_address") AS "sel_0")) AS "orders" FROM (SELECT "orders"."id", "orders"."shipping_address_id", "orders"."billing_address_id" FROM "orders" WHERE ((("orders"."user_id") = ('{{user_id}}'))) LIMIT ('20') :: integer) AS "orders_0" LEFT OUTER JOIN LATERAL (SELECT row_to_json((SELECT "sel_2" FROM (SELECT "billing_addresses_2"."street" AS "street") AS "sel_2")) AS "billing_addresses" FROM (SELECT "billing_addresses"."street" FROM "addresses" AS "billing_addresses" WHERE ((("billing_addresses"."id") = ("orders_0"."billing_address_id"))) LIMIT ('1') :: integer) AS "billing_addresses_2" LIMIT ('1') :: integer) AS "billing_addresses_2.join" ON ('true') LEFT OUTER JOIN LATERAL (SELECT row_to_json((SELECT "sel_1" FROM (SELECT "shipping_addresses_1"."street" AS "street") AS "sel_1")) AS "shipping_addresses" FROM (SELECT "shipping_addresses"."street" FROM "addresses" AS "shipping_addresses" WHERE ((("shipping_addresses"."id") = ("orders_0"."shipping_address_id"))) LIMIT ('1') :: integer) AS "shipping_addresses_1" LIMIT ('1') :: integer) AS "shipping_addresses_1.join" ON ('true') LIMIT ('20') :: integer) AS "orders_0") AS "done_1337";`
+
+	resSQL, err := compileGQLToPSQL(gql)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resSQL != sql {
+		t.Fatal(errNotExpected)
+	}
+}
+
+func compositeForeignKey(t *testing.T) {
+	gql := `query {
+		stocks {
+			quantity
+			reservations {
+				id
+			}
+		}
+	}`
+
+	sql := `SELECT json_object_agg('stocks', stocks) FROM (SELECT coalesce(json_agg("stocks"), '[]') AS "stocks" FROM (SELECT row_to_json((SELECT "sel_0" FROM (SELECT "stocks_0"."quantity" AS "quantity", "reservations_1.join"."reservations" AS "reservations") AS "sel_0")) AS "stocks" FROM (SELECT "stocks"."quantity", "stocks"."warehouse_code", "stocks"."product_code" FROM "stocks" WHERE ((("stocks"."user_id") = ('{{user_id}}'))) LIMIT ('20') :: integer) AS "stocks_0" LEFT OUTER JOIN LATERAL (SELECT coalesce(json_agg("reservations"), '[]') AS "reservations" FROM (SELECT row_to_json((SELECT "sel_1" FROM (SELECT "reservations_1"."id" AS "id") AS "sel_1")) AS "reservations" FROM (SELECT "reservations"."id" FROM "reservations" WHERE ((("reservations"."warehouse") = ("stocks_0"."warehouse_code")) AND (("reservations"."product") = ("stocks_0"."product_code"))) LIMIT ('20') :: integer) AS "reservations_1" LIMIT ('20') :: integer) AS "reservations_1") AS "reservations_1.join" ON ('true') LIMIT ('20') :: integer) AS "stocks_0") AS "done_1337";`
+
+	resSQL, err := compileGQLToPSQL(gql)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resSQL != sql {
+		t.Fatal(errNotExpected)
+	}
+}
+
+func selfReference(t *testing.T) {
+	gql := `query {
+		comments {
+			body
+			parent {
+				body
+			}
+			children {
+				body
+			}
+			parent_comments {
+				id
+			}
+		}
+	}`
+
+	sql := `SELECT json_object_agg('comments', comments) FROM (SELECT coalesce(json_agg("comments"), '[]') AS "comments" FROM (SELECT row_to_json((SELECT "sel_0" FROM (SELECT "comments_0"."body" AS "body", "parent_comments_1.join"."parent_comments" AS "parent_comments", "children_2.join"."children" AS "children", "parents_3.join"."parents" AS "parent") AS "sel_0")) AS "comments" FROM (SELECT "comments"."body", "comments"."id", "comments"."parent_id" FROM "comments" LIMIT ('20') :: integer) AS "comments_0" LEFT OUTER JOIN LATERAL (SELECT row_to_json((SELECT "sel_3" FROM (SELECT "parents_3"."body" AS "body") AS "sel_3")) AS "parents" FROM (SELECT "parents"."body" FROM "comments" AS "parents" WHERE ((("parents"."id") = ("comments_0"."parent_id"))) LIMIT ('1') :: integer) AS "parents_3" LIMIT ('1') :: integer) AS "parents_3.join" ON ('true') LEFT OUTER JOIN LATERAL (SELECT coalesce(json_agg("children"), '[]') AS "children" FROM (SELECT row_to_json((SELECT "sel_2" FROM (SELECT "children_2"."body" AS "body") AS "sel_2")) AS "children" FROM (SELECT "children"."body" FROM "comments" AS "children" WHERE ((("children"."parent_id") = ("comments_0"."id"))) LIMIT ('20') :: integer) AS "children_2" LIMIT ('20') :: integer) AS "children_2") AS "children_2.join" ON ('true') LEFT OUTER JOIN LATERAL (SELECT coalesce(json_agg("parent_comments"), '[]') AS "parent_comments" FROM (SELECT row_to_json((SELECT "sel_1" FROM (SELECT "parent_comments_1"."id" AS "id") AS "sel_1")) AS "parent_comments" FROM (SELECT "parent_comments"."id" FROM "comments" AS "parent_comments" WHERE ((("parent_comments"."parent_id") = ("comments_0"."id"))) LIMIT ('20') :: integer) AS "parent_comments_1" LIMIT ('20') :: integer) AS "parent_comments_1") AS "parent_comments_1.join" ON ('true') LIMIT ('20') :: integer) AS "comments_0") AS "done_1337";`
+
+	resSQL, err := compileGQLToPSQL(gql)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resSQL != sql {
+		t.Fatal(errNotExpected)
+	}
+}
+
+func recursiveChildren(t *testing.T) {
+	gql := `query {
+		comment(id: 1) {
+			body
+			replies(depth: 3) {
+				id
+				body
+				parent_id
+			}
+		}
+	}`
+
+	sql := `SELECT json_object_agg('comment', comments) FROM (SELECT row_to_json((SELECT "sel_0" FROM (SELECT "comments_0"."body" AS "body", "replies_1.join"."replies" AS "replies") AS "sel_0")) AS "comments" FROM (SELECT "comments"."body", "comments"."id" FROM "comments" WHERE ((("id") = ('1'))) LIMIT ('1') :: integer) AS "comments_0" LEFT OUTER JOIN LATERAL (SELECT coalesce(json_agg("replies"), '[]') AS "replies" FROM (SELECT row_to_json((SELECT "sel_1" FROM (SELECT "replies_1"."id" AS "id", "replies_1"."body" AS "body", "replies_1"."parent_id" AS "parent_id") AS "sel_1")) AS "replies" FROM (SELECT "replies"."id", "replies"."body", "replies"."parent_id" FROM (WITH RECURSIVE "replies_1.rec" AS (SELECT "comments".*, 1 AS "replies_1.depth" FROM "comments" WHERE ((("comments"."parent_id") = ("comments_0"."id"))) UNION ALL SELECT "comments".*, "replies_1.rec"."replies_1.depth" + 1 FROM "comments", "replies_1.rec" WHERE ((("comments"."parent_id") = ("replies_1.rec"."id")) AND (("replies_1.rec"."replies_1.depth") < ('3') :: integer))) SELECT * FROM "replies_1.rec") AS "replies" LIMIT ('20') :: integer) AS "replies_1" LIMIT ('20') :: integer) AS "replies_1") AS "replies_1.join" ON ('true') LIMIT ('1') :: integer) AS "done_1337";`
+
+	resSQL, err := compileGQLToPSQL(gql)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resSQL != sql {
+		t.Fatal(errNotExpected)
+	}
+}
+
+func recursiveParents(t *testing.T) {
+	gql := `query {
+		comment(id: 5) {
+			body
+			parents(recursive: true) {
+				id
+				body
+			}
+		}
+	}`
+
+	sql := `SELECT json_object_agg('comment', comments) FROM (SELECT row_to_json((SELECT "sel_0" FROM (SELECT "comments_0"."body" AS "body", "parents_1.join"."parents" AS "parents") AS "sel_0")) AS "comments" FROM (SELECT "comments"."body", "comments"."parent_id" FROM "comments" WHERE ((("id") = ('5'))) LIMIT ('1') :: integer) AS "comments_0" LEFT OUTER JOIN LATERAL (SELECT coalesce(json_agg("parents"), '[]') AS "parents" FROM (SELECT row_to_json((SELECT "sel_1" FROM (SELECT "parents_1"."id" AS "id", "parents_1"."body" AS "body") AS "sel_1")) AS "parents" FROM (SELECT "parents"."id", "parents"."body" FROM (WITH RECURSIVE "parents_1.rec" AS (SELECT "comments".*, 1 AS "parents_1.depth" FROM "comments" WHERE ((("comments"."id") = ("comments_0"."parent_id"))) UNION ALL SELECT "comments".*, "parents_1.rec"."parents_1.depth" + 1 FROM "comments", "parents_1.rec" WHERE ((("comments"."id") = ("parents_1.rec"."parent_id")) AND (("parents_1.rec"."parents_1.depth") < ('10') :: integer))) SELECT * FROM "parents_1.rec") AS "parents" LIMIT ('20') :: integer) AS "parents_1" LIMIT ('20') :: integer) AS "parents_1") AS "parents_1.join" ON ('true') LIMIT ('1') :: integer) AS "done_1337";`
+
+	resSQL, err := compileGQLToPSQL(gql)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resSQL != sql {
+		t.Fatal(errNotExpected)
+	}
+}
+
+func relJSONArray(t *testing.T) {
+	gql := `query {
+		products {
+			name
+			tags {
+				name
+			}
+		}
+	}`
+
+	sql := `SELECT json_object_agg('products', products) FROM (SELECT coalesce(json_agg("products"), '[]') AS "products" FROM (SELECT row_to_json((SELECT "sel_0" FROM (SELECT "products_0"."name" AS "name", "tags_1.join"."tags" AS "tags") AS "sel_0")) AS "products" FROM (SELECT "products"."name", "products"."tag_ids" FROM "products" WHERE ((("products"."price") > (0)) AND (("products"."price") < (8))) LIMIT ('20') :: integer) AS "products_0" LEFT OUTER JOIN LATERAL (SELECT coalesce(json_agg("tags"), '[]') AS "tags" FROM (SELECT row_to_json((SELECT "sel_1" FROM (SELECT "tags_1"."name" AS "name") AS "sel_1")) AS "tags" FROM (SELECT "tags"."name" FROM "tags" WHERE ((("products_0"."tag_ids")::jsonb @> to_jsonb("tags"."id"))) LIMIT ('20') :: integer) AS "tags_1" LIMIT ('20') :: integer) AS "tags_1") AS "tags_1.join" ON ('true') LIMIT ('20') :: integer) AS "products_0") AS "done_1337";`
+
+	resSQL, err := compileGQLToPSQL(gql)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resSQL != sql {
+		t.Fatal(errNotExpected)
+	}
+}
+
+func relJSONArrayReverse(t *testing.T) {
+	gql := `query {
+		tags {
+			name
+			products {
+				name
+			}
+		}
+	}`
+
+	sql := `SELECT json_object_agg('tags', tags) FROM (SELECT coalesce(json_agg("tags"), '[]') AS "tags" FROM (SELECT row_to_json((SELECT "sel_0" FROM (SELECT "tags_0"."name" AS "name", "products_1.join"."products" AS "products") AS "sel_0")) AS "tags" FROM (SELECT "tags"."name", "tags"."id" FROM "tags" WHERE ((("tags"."user_id") = ('{{user_id}}'))) LIMIT ('20') :: integer) AS "tags_0" LEFT OUTER JOIN LATERAL (SELECT coalesce(json_agg("products"), '[]') AS "products" FROM (SELECT row_to_json((SELECT "sel_1" FROM (SELECT "products_1"."name" AS "name") AS "sel_1")) AS "products" FROM (SELECT "products"."name" FROM "products" WHERE ((("products"."tag_ids")::jsonb @> to_jsonb("tags_0"."id"))) LIMIT ('20') :: integer) AS "products_1" LIMIT ('20') :: integer) AS "products_1") AS "products_1.join" ON ('true') LIMIT ('20') :: integer) AS "tags_0") AS "done_1337";`
+
+	resSQL, err := compileGQLToPSQL(gql)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resSQL != sql {
+		t.Fatal(errNotExpected)
+	}
+}
+
+func relTypeColumn(t *testing.T) {
+	gql := `query {
+		products {
+			name
+			comments {
+				body
+			}
+		}
+	}`
+
+	sql := `SELECT json_object_agg('products', products) FROM (SELECT coalesce(json_agg("products"), '[]') AS "products" FROM (SELECT row_to_json((SELECT "sel_0" FROM (SELECT "products_0"."name" AS "name", "comments_1.join"."comments" AS "comments") AS "sel_0")) AS "products" FROM (SELECT "products"."name", "products"."id" FROM "products" WHERE ((("products"."price") > (0)) AND (("products"."price") < (8))) LIMIT ('20') :: integer) AS "products_0" LEFT OUTER JOIN LATERAL (SELECT coalesce(json_agg("comments"), '[]') AS "comments" FROM (SELECT row_to_json((SELECT "sel_1" FROM (SELECT "comments_1"."body" AS "body") AS "sel_1")) AS "comments" FROM (SELECT "comments"."body" FROM "comments" WHERE ((("comments"."commentable_id") = ("products_0"."id")) AND (("comments"."commentable_type") = ('Product'))) LIMIT ('20') :: integer) AS "comments_1" LIMIT ('20') :: integer) AS "comments_1") AS "comments_1.join" ON ('true') LIMIT ('20') :: integer) AS "products_0") AS "done_1337";`
+
+	resSQL, err := compileGQLToPSQL(gql)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resSQL != sql {
+		t.Fatal(errNotExpected)
+	}
+}
+
+func relManyToManyNamed(t *testing.T) {
+	gql := `query {
+		products {
+			name
+			buyers {
+				email
+			}
+		}
+	}`
+
+	sql := `SELECT json_object_agg('products', products) FROM (SELECT coalesce(json_agg("products"), '[]') AS "products" FROM (SELECT row_to_json((SELECT "sel_0" FROM (SELECT "products_0"."name" AS "name", "buyers_1.join"."buyers" AS "buyers") AS "sel_0")) AS "products" FROM (SELECT "products"."name", "products"."id" FROM "products" WHERE ((("products"."price") > (0)) AND (("products"."price") < (8))) LIMIT ('20') :: integer) AS "products_0" LEFT OUTER JOIN LATERAL (SELECT coalesce(json_agg("buyers"), '[]') AS "buyers" FROM (SELECT row_to_json((SELECT "sel_1" FROM (SELECT "buyers_1"."email" AS "email") AS "sel_1")) AS "buyers" FROM (SELECT "buyers"."email" FROM "customers" AS "buyers" LEFT OUTER JOIN "purchases" ON (("purchases"."product_id") = ("products_0"."id")) WHERE ((("buyers"."id") = ("purchases"."customer_id"))) LIMIT ('20') :: integer) AS "buyers_1" LIMIT ('20') :: integer) AS "buyers_1") AS "buyers_1.join" ON ('true') LIMIT ('20') :: integer) AS "products_0") AS "done_1337";`
+
+	resSQL, err := compileGQLToPSQL(gql)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resSQL != sql {
+		t.Fatal(errNotExpected)
+	}
+}
+
+func polymorphicUnion(t *testing.T) {
+	gql := `query {
+		comments {
+			body
+			commentable {
+				__typename
+				... on Product {
+					name
+				}
+				... on User {
+					email
+				}
+			}
+		}
+	}`
+
+	sql := `SELECT json_object_agg('comments', comments) FROM (SELECT coalesce(json_agg("comments"), '[]') AS "comments" FROM (SELECT row_to_json((SELECT "sel_0" FROM (SELECT "comments_0"."body" AS "body", coalesce("users_2.join"."users", "products_3.join"."products") AS "commentable") AS "sel_0")) AS "comments" FROM (SELECT "comments"."body", "comments"."commentable_id", "comments"."commentable_type" FROM "comments" LIMIT ('20') :: integer) AS "comments_0" LEFT OUTER JOIN LATERAL (SELECT row_to_json((SELECT "sel_3" FROM (SELECT "products_3"."__typename" AS "__typename", "products_3"."name" AS "name") AS "sel_3")) AS "products" FROM (SELECT 'Product' AS __typename, "products"."name" FROM "products" WHERE ((("products"."id") = ("comments_0"."commentable_id")) AND (("comments_0"."commentable_type") = ('Product'))) LIMIT ('1') :: integer) AS "products_3" LIMIT ('1') :: integer) AS "products_3.join" ON ('true') LEFT OUTER JOIN LATERAL (SELECT row_to_json((SELECT "sel_2" FROM (SELECT "users_2"."__typename" AS "__typename", "users_2"."email" AS "email") AS "sel_2")) AS "users" FROM (SELECT 'User' AS __typename, "users"."email" FROM "users" WHERE ((("users"."id") = ("comments_0"."commentable_id")) AND (("comments_0"."commentable_type") = ('User'))) LIMIT ('1') :: integer) AS "users_2" LIMIT ('1') :: integer) AS "users_2.join" ON ('true') LIMIT ('20') :: integer) AS "comments_0") AS "done_1337";`
+
+	resSQL, err := compileGQLToPSQL(gql)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resSQL != sql {
+		t.Fatal(errNotExpected)
+	}
+}
+
+func polymorphicNoPrimaryKey(t *testing.T) {
+	gql := `query {
+		comments {
+			commentable {
+				... on Event {
+					name
+				}
+			}
+		}
+	}`
+
+	_, err := compileGQLToPSQL(gql)
+	if err == nil {
+		t.Fatal("expected an error for a type without a primary key")
+	}
+}
+
+func insertMutation(t *testing.T) {
+	gql := `mutation {
+		products(insert: $data) {
+			id
+			name
+			user {
+				email
+			}
+		}
+	}`
+
+	vars := map[string]json.RawMessage{
+		"data": json.RawMessage(`[{ "name": "Apple's {{pie}}", "price": 2.5, "user_id": 5 }]`),
+	}
+
+	sql := `WITH "products" AS (INSERT INTO "products" ("name", "price", "user_id") SELECT "t"."name", "t"."price", "t"."user_id" FROM json_populate_recordset(NULL::"products", '[{ "name": "Apple''s {\u007bpie}}", "price": 2.5, "user_id": 5 }]' :: json) AS "t" RETURNING *) SELECT json_object_agg('products', products) FROM (SELECT coalesce(json_agg("products"), '[]') AS "products" FROM (SELECT row_to_json((SELECT "sel_0" FROM (SELECT "products_0"."id" AS "id", "products_0"."name" AS "name", "users_1.join"."users" AS "user") AS "sel_0")) AS "products" FROM (SELECT "products"."id", "products"."name", "products"."user_id" FROM "products") AS "products_0" LEFT OUTER JOIN LATERAL (SELECT row_to_json((SELECT "sel_1" FROM (SELECT "users_1"."email" AS "email") AS "sel_1")) AS "users" FROM (SELECT "users"."email" FROM "users" WHERE ((("users"."id") = ("products_0"."user_id"))) LIMIT ('1') :: integer) AS "users_1" LIMIT ('1') :: integer) AS "users_1.join" ON ('true')) AS "products_0") AS "done_1337";`
+
+	qc, err := qcompile.CompileQuery(gql)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var resSQL strings.Builder
+
+	if err := pcompile.CompileVars(&resSQL, qc, vars); err != nil {
+		t.Fatal(err)
+	}
+
+	if resSQL.String() != sql {
+		t.Fatal(errNotExpected)
+	}
+}
+
+func aggregateField(t *testing.T) {
+	gql := `query {
+		products_aggregate {
+			count
+			sum {
+				price
+			}
+			max {
+				price
+				id
+			}
+		}
+	}`
+
+	sql := `SELECT json_object_agg('products_aggregate', products) FROM (SELECT row_to_json((SELECT "sel_0" FROM (SELECT "products_0"."count" AS "count", json_build_object('price', "products_0"."sum_price") AS "sum", json_build_object('price', "products_0"."max_price", 'id', "products_0"."max_id") AS "max") AS "sel_0")) AS "products" FROM (SELECT count(*) AS "count", sum("products"."price") AS "sum_price", max("products"."price") AS "max_price", max("products"."id") AS "max_id" FROM "products" WHERE ((("products"."price") > (0)) AND (("products"."price") < (8))) LIMIT ('20') :: integer) AS "products_0" LIMIT ('20') :: integer) AS "done_1337";`
+
+	resSQL, err := compileGQLToPSQL(gql)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resSQL != sql {
+		t.Fatal(errNotExpected)
+	}
+}
+
+func aggregateGroupBy(t *testing.T) {
+	gql := `query {
+		products_aggregate(group_by: [user_id]) {
+			user_id
+			count
+			avg {
+				price
+			}
+		}
+	}`
+
+	sql := `SELECT json_object_agg('products_aggregate', products) FROM (SELECT coalesce(json_agg("products"), '[]') AS "products" FROM (SELECT row_to_json((SELECT "sel_0" FROM (SELECT "products_0"."user_id" AS "user_id", "products_0"."count" AS "count", json_build_object('price', "products_0"."avg_price") AS "avg") AS "sel_0")) AS "products" FROM (SELECT "products"."user_id", count(*) AS "count", avg("products"."price") AS "avg_price" FROM "products" WHERE ((("products"."price") > (0)) AND (("products"."price") < (8))) GROUP BY "products"."user_id" LIMIT ('20') :: integer) AS "products_0" LIMIT ('20') :: integer) AS "products_0") AS "done_1337";`
+
+	resSQL, err := compileGQLToPSQL(gql)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resSQL != sql {
+		t.Fatal(errNotExpected)
+	}
+}
+
+func aggregateNested(t *testing.T) {
+	gql := `query {
+		users {
+			email
+			products_aggregate {
+				count
+			}
+		}
+	}`
+
+	sql := `SELECT json_object_agg('users', users) FROM (SELECT coalesce(json_agg("users"), '[]') AS "users" FROM (SELECT row_to_json((SELECT "sel_0" FROM (SELECT "users_0"."email" AS "email", "products_1.join"."products" AS "products_aggregate") AS "sel_0")) AS "users" FROM (SELECT "users"."email", "users"."id" FROM "users" WHERE ((("users"."id") = ('{{user_id}}'))) LIMIT ('20') :: integer) AS "users_0" LEFT OUTER JOIN LATERAL (SELECT row_to_json((SELECT "sel_1" FROM (SELECT "products_1"."count" AS "count") AS "sel_1")) AS "products" FROM (SELECT count(*) AS "count" FROM "products" WHERE ((("products"."user_id") = ("users_0"."id"))) LIMIT ('20') :: integer) AS "products_1" LIMIT ('20') :: integer) AS "products_1.join" ON ('true') LIMIT ('20') :: integer) AS "users_0") AS "done_1337";`
+
+	resSQL, err := compileGQLToPSQL(gql)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resSQL != sql {
+		t.Fatal(errNotExpected)
+	}
+}
+
+func TestCompileGQL(t *testing.T) {
+	t.Run("withComplexArgs", withComplexArgs)
+	t.Run("withWhereAndList", withWhereAndList)
+	t.Run("withWhereIsNull", withWhereIsNull)
+	t.Run("withWhereMultiOr", withWhereMultiOr)
+	t.Run("whereMultipleKeys", whereMultipleKeys)
+	t.Run("fetchByID", fetchByID)
+	t.Run("searchQuery", searchQuery)
+	t.Run("searchOptions", searchOptions)
+	t.Run("searchNested", searchNested)
+	t.Run("jsonWhere", jsonWhere)
+	t.Run("jsonFields", jsonFields)
+	t.Run("whereRelated", whereRelated)
+	t.Run("whereRelatedNone", whereRelatedNone)
+	t.Run("orderByRelated", orderByRelated)
+	t.Run("orderByAggregate", orderByAggregate)
+	t.Run("computedFields", computedFields)
+	t.Run("tableFunction", tableFunction)
+	t.Run("tableFunctionArgs", tableFunctionArgs)
+	t.Run("whereInjection", whereInjection)
+	t.Run("whereTemplateTag", whereTemplateTag)
+	t.Run("fetchByIDInjection", fetchByIDInjection)
+	t.Run("tableFunctionInjection", tableFunctionInjection)
+	t.Run("functionMutation", functionMutation)
+	t.Run("functionMutationErrors", functionMutationErrors)
+	t.Run("queryTables", queryTables)
+	t.Run("belongsTo", belongsTo)
 	t.Run("oneToMany", oneToMany)
 	t.Run("manyToMany", manyToMany)
 	t.Run("manyToManyReverse", manyToManyReverse)
 	t.Run("aggFunction", aggFunction)
 	t.Run("aggFunctionWithFilter", aggFunctionWithFilter)
 	t.Run("syntheticTables", syntheticTables)
+	t.Run("multipleForeignKeys", multipleForeignKeys)
+	t.Run("compositeForeignKey", compositeForeignKey)
+	t.Run("selfReference", selfReference)
+	t.Run("recursiveChildren", recursiveChildren)
+	t.Run("recursiveParents", recursiveParents)
+	t.Run("relJSONArray", relJSONArray)
+	t.Run("relJSONArrayReverse", relJSONArrayReverse)
+	t.Run("relTypeColumn", relTypeColumn)
+	t.Run("relManyToManyNamed", relManyToManyNamed)
+	t.Run("polymorphicUnion", polymorphicUnion)
+	t.Run("polymorphicNoPrimaryKey", polymorphicNoPrimaryKey)
+	t.Run("insertMutation", insertMutation)
+	t.Run("aggregateField", aggregateField)
+	t.Run("aggregateGroupBy", aggregateGroupBy)
+	t.Run("aggregateNested", aggregateNested)
+}
+
+func TestAddRelationshipsInvalid(t *testing.T) {
+	rels := []RelConfig{
+		RelConfig{Type: "belongs_to", Table: "products", ForeignTable: "nothing"},
+		RelConfig{Type: "belongs_to", Table: "products", Columns: []string{"nothing_id"}, ForeignTable: "users"},
+		RelConfig{Type: "has_many", Table: "users", ForeignTable: "products", ForeignColumns: []string{"user_id", "id"}},
+		RelConfig{Type: "has_one", Table: "users", ForeignTable: "products", ForeignColumns: []string{"user_id"}},
+		RelConfig{Type: "belongs_to", Table: "products", ForeignTable: "users"},
+		RelConfig{Type: "has_many", Table: "users", ForeignTable: "products"},
+		RelConfig{Type: "many_to_many", Table: "products", Through: "purchases", ForeignTable: "customers"},
+	}
+
+	for i := range rels {
+		if err := pcompile.schema.AddRelationships(rels[i : i+1]); err == nil {
+			t.Fatalf("expected an error for relationship %d", i)
+		}
+	}
+}
+
+func TestAddRelationshipsReplace(t *testing.T) {
+	schema := testSnapshot.Schema()
+
+	err := schema.AddRelationships([]RelConfig{
+		RelConfig{Name: "users", Type: "belongs_to", Table: "products", Columns: []string{"id"}, ForeignTable: "users"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rel := schema.RelMap[TTKey{"users", "products"}]; rel.Col2[0] != "id" {
+		t.Errorf("expected the declared relationship got %+v", rel)
+	}
+
+	if rel := schema.RelMap[TTKey{"products", "users"}]; rel.Col1[0] != "id" {
+		t.Errorf("expected the declared reverse relationship got %+v", rel)
+	}
+}
+
+func TestAddRelationshipsSameTables(t *testing.T) {
+	schema := testSnapshot.Schema()
+
+	err := schema.AddRelationships([]RelConfig{
+		RelConfig{Name: "owner", Type: "belongs_to", Table: "products", Columns: []string{"user_id"}, ForeignTable: "users"},
+		RelConfig{Name: "buyer", Type: "belongs_to", Table: "products", Columns: []string{"id"}, ForeignTable: "users"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rel := schema.RelMap[TTKey{"products", "users"}]; rel.Col1[0] != "user_id" {
+		t.Errorf("expected the first declared reverse relationship got %+v", rel)
+	}
+
+	if rel := schema.RelMap[TTKey{"owner_products", "users"}]; rel == nil || rel.Col1[0] != "user_id" {
+		t.Errorf("expected the reverse relationship of owner got %+v", rel)
+	}
+
+	if rel := schema.RelMap[TTKey{"buyer_products", "users"}]; rel == nil || rel.Col1[0] != "id" {
+		t.Errorf("expected the reverse relationship of buyer got %+v", rel)
+	}
+
+	qc, err := qcompile.CompileQuery(`query { users { buyer_products { id } } }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sb strings.Builder
+
+	if err := NewCompiler(Config{Schema: schema}).Compile(&sb, qc); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(sb.String(), `(("buyer_products"."id") = ("users_0"."id"))`) {
+		t.Errorf("expected buyer_products to join on the id got %s", sb.String())
+	}
 }
 
 func BenchmarkCompileGQLToSQL(b *testing.B) {
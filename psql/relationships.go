@@ -0,0 +1,306 @@
+package psql
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RelConfig declares a relationship that has no foreign key constraint
+// in the database. Name is the field used to fetch ForeignTable from
+// Table and defaults to the name of the foreign table.
+//
+// belongs_to: Columns of Table reference ForeignColumns of ForeignTable
+// has_many: ForeignColumns of ForeignTable reference Columns of Table
+// many_to_many: ThroughColumns of the Through table reference Columns of
+// Table and ThroughForeignColumns reference ForeignColumns
+//
+// polymorphic: Columns and TypeColumn of Table hold the id and type name
+// of a row in any table, Name is required and the columns default to
+// the name followed by '_id' and '_type'.
+//
+// Columns and ForeignColumns default to the primary key where they are
+// the referenced side, the referencing columns and the through columns
+// are required. A single array or jsonb column holding a list of
+// ids can be used in place of an id column. TypeColumn and TypeValue are
+// for Rails style polymorphic columns like 'commentable_type'.
+type RelConfig struct {
+	Name                  string
+	Type                  string
+	Table                 string
+	Columns               []string
+	Through               string
+	ThroughColumns        []string
+	ThroughForeignColumns []string
+	ForeignTable          string
+	ForeignColumns        []string
+	TypeColumn            string
+	TypeValue             string
+}
+
+// AddRelationships validates the relationships against the tables and
+// columns in the schema and merges them into the RelMap. Declared
+// relationships replace any found using foreign keys, both the named
+// field and the reverse one. The reverse of a named relationship is also
+// exposed as '<name>_<table>' on the foreign table, when more than one
+// is declared between the same tables like 'billing_user' and
+// 'shipping_user' the field named after the table is the first one.
+func (s *DBSchema) AddRelationships(rels []RelConfig) error {
+	rev := make(map[TTKey]struct{}, len(rels))
+
+	for i := range rels {
+		if err := s.addRelConfig(&rels[i], rev); err != nil {
+			return fmt.Errorf("relationship '%s.%s': %s",
+				rels[i].Table, rels[i].Name, err)
+		}
+	}
+	return nil
+}
+
+func (s *DBSchema) addRelConfig(rc *RelConfig, rev map[TTKey]struct{}) error {
+	t := strings.ToLower(rc.Table)
+	ft := strings.ToLower(rc.ForeignTable)
+
+	ti, err := s.GetTable(t)
+	if err != nil {
+		return err
+	}
+
+	if strings.EqualFold(rc.Type, "polymorphic") {
+		return s.addRelConfigPoly(rc, ti)
+	}
+
+	fti, err := s.GetTable(ft)
+	if err != nil {
+		return err
+	}
+
+	name := rc.Name
+	if len(name) == 0 {
+		name = ft
+	}
+
+	// Defaulting the referencing side to the primary key would join
+	// on the wrong column
+	typ := strings.ToLower(rc.Type)
+
+	switch {
+	case typ == "belongs_to" && len(rc.Columns) == 0:
+		return fmt.Errorf("columns referencing '%s' are required", fti.Name)
+
+	case typ == "has_many" && len(rc.ForeignColumns) == 0:
+		return fmt.Errorf("foreign_columns referencing '%s' are required", ti.Name)
+
+	case (typ == "many_to_many" || typ == "has_many_through") &&
+		(len(rc.ThroughColumns) == 0 || len(rc.ThroughForeignColumns) == 0):
+		return fmt.Errorf("through_columns and through_foreign_columns are required")
+	}
+
+	cols, err := relColumns(ti, rc.Columns)
+	if err != nil {
+		return err
+	}
+
+	fcols, err := relColumns(fti, rc.ForeignColumns)
+	if err != nil {
+		return err
+	}
+
+	if len(cols) != len(fcols) {
+		return fmt.Errorf("columns and foreign_columns must be the same length")
+	}
+
+	switch typ {
+	case "belongs_to":
+		rel1 := &DBRel{Type: RelOneToMany, Table: ft, Col1: fcols, Col2: cols}
+		rel2 := &DBRel{Type: RelBelongTo, Table: t, Col1: cols, Col2: fcols}
+
+		if err := setRelArrays(rel1, fti, ti); err != nil {
+			return err
+		}
+		if err := setRelArrays(rel2, ti, fti); err != nil {
+			return err
+		}
+
+		if len(rc.TypeColumn) != 0 {
+			if _, ok := ti.Columns[strings.ToLower(rc.TypeColumn)]; !ok {
+				return fmt.Errorf("unknown column '%s'", rc.TypeColumn)
+			}
+			rel1.TypeCol, rel1.TypeVal = rc.TypeColumn, rc.TypeValue
+			rel2.TypeCol, rel2.TypeVal = rc.TypeColumn, rc.TypeValue
+		}
+
+		s.RelMap[relFieldKey(name, t)] = rel1
+		s.addRevRel(rev, rc.Name, t, ft, rel2)
+
+	case "has_many":
+		rel1 := &DBRel{Type: RelBelongTo, Table: ft, Col1: fcols, Col2: cols}
+		rel2 := &DBRel{Type: RelOneToMany, Table: t, Col1: cols, Col2: fcols}
+
+		if err := setRelArrays(rel1, fti, ti); err != nil {
+			return err
+		}
+		if err := setRelArrays(rel2, ti, fti); err != nil {
+			return err
+		}
+
+		if len(rc.TypeColumn) != 0 {
+			if _, ok := fti.Columns[strings.ToLower(rc.TypeColumn)]; !ok {
+				return fmt.Errorf("unknown column '%s'", rc.TypeColumn)
+			}
+			rel1.TypeCol, rel1.TypeVal = rc.TypeColumn, rc.TypeValue
+			rel2.TypeCol, rel2.TypeVal = rc.TypeColumn, rc.TypeValue
+		}
+
+		s.RelMap[relFieldKey(name, t)] = rel1
+		s.addRevRel(rev, rc.Name, t, ft, rel2)
+
+	case "many_to_many", "has_many_through":
+		tti, err := s.GetTable(strings.ToLower(rc.Through))
+		if err != nil {
+			return err
+		}
+
+		tcols, err := relColumns(tti, rc.ThroughColumns)
+		if err != nil {
+			return err
+		}
+
+		tfcols, err := relColumns(tti, rc.ThroughForeignColumns)
+		if err != nil {
+			return err
+		}
+
+		if len(tcols) != len(cols) || len(tfcols) != len(fcols) {
+			return fmt.Errorf("through columns must be the same length as the columns they reference")
+		}
+
+		rel1 := &DBRel{
+			Type:    RelOneToManyThrough,
+			Table:   ft,
+			Through: tti.Name,
+			ColT1:   tfcols,
+			ColT2:   tcols,
+			Col1:    fcols,
+			Col2:    cols,
+		}
+		rel2 := &DBRel{
+			Type:    RelOneToManyThrough,
+			Table:   t,
+			Through: tti.Name,
+			ColT1:   tcols,
+			ColT2:   tfcols,
+			Col1:    cols,
+			Col2:    fcols,
+		}
+
+		s.RelMap[relFieldKey(name, t)] = rel1
+		s.addRevRel(rev, rc.Name, t, ft, rel2)
+
+	default:
+		return fmt.Errorf("unknown type '%s' (valid types: belongs_to, has_many, many_to_many, polymorphic)", rc.Type)
+	}
+
+	return nil
+}
+
+// addRevRel adds the reverse of a relationship from table t to ft, the
+// first one declared between the tables gets the field named after t.
+func (s *DBSchema) addRevRel(rev map[TTKey]struct{}, name, t, ft string, rel *DBRel) {
+	k := TTKey{t, ft}
+
+	if _, ok := rev[k]; !ok {
+		s.RelMap[k] = rel
+		rev[k] = struct{}{}
+	}
+
+	if len(name) == 0 {
+		return
+	}
+
+	if k := relFieldKey(name+"_"+t, ft); k.Table1 != t {
+		s.RelMap[k] = rel
+	}
+}
+
+func (s *DBSchema) addRelConfigPoly(rc *RelConfig, ti *DBTableInfo) error {
+	if len(rc.Name) == 0 {
+		return fmt.Errorf("polymorphic relationships need a name")
+	}
+
+	cols := rc.Columns
+	if len(cols) == 0 {
+		cols = []string{rc.Name + "_id"}
+	}
+
+	cols, err := relColumns(ti, cols)
+	if err != nil {
+		return err
+	}
+
+	if len(cols) != 1 {
+		return fmt.Errorf("polymorphic relationships use a single id column")
+	}
+
+	tc := rc.TypeColumn
+	if len(tc) == 0 {
+		tc = rc.Name + "_type"
+	}
+
+	if _, ok := ti.Columns[strings.ToLower(tc)]; !ok {
+		return fmt.Errorf("unknown column '%s.%s'", ti.Name, tc)
+	}
+
+	s.RelMap[relFieldKey(rc.Name, strings.ToLower(rc.Table))] = &DBRel{
+		Type:    RelPolymorphic,
+		Col2:    cols,
+		TypeCol: tc,
+	}
+
+	return nil
+}
+
+// relColumns checks the columns exist in the table, when none are
+// given the primary key is used.
+func relColumns(ti *DBTableInfo, cols []string) ([]string, error) {
+	if len(cols) == 0 {
+		if len(ti.PrimaryCol) == 0 {
+			return nil, fmt.Errorf("no primary key column defined for %s", ti.Name)
+		}
+		return []string{ti.PrimaryCol}, nil
+	}
+
+	for i := range cols {
+		if _, ok := ti.Columns[strings.ToLower(cols[i])]; !ok {
+			return nil, fmt.Errorf("unknown column '%s.%s'", ti.Name, cols[i])
+		}
+	}
+
+	return cols, nil
+}
+
+// setRelArrays marks the relationship columns that hold a list of ids,
+// only single column relationships can use them.
+func setRelArrays(rel *DBRel, ti1, ti2 *DBTableInfo) error {
+	rel.Array1 = relArray(ti1.Columns[strings.ToLower(rel.Col1[0])])
+	rel.Array2 = relArray(ti2.Columns[strings.ToLower(rel.Col2[0])])
+
+	if rel.Array1 == RelArrayNone && rel.Array2 == RelArrayNone {
+		return nil
+	}
+
+	if len(rel.Col1) != 1 || rel.Array1 != RelArrayNone && rel.Array2 != RelArrayNone {
+		return fmt.Errorf("only a single array column can be used")
+	}
+
+	return nil
+}
+
+func relArray(c *DBColumn) RelArray {
+	switch {
+	case c.Type == "jsonb" || c.Type == "json":
+		return RelArrayJSON
+	case strings.HasSuffix(c.Type, "[]"):
+		return RelArrayNative
+	}
+	return RelArrayNone
+}
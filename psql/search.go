@@ -0,0 +1,102 @@
+package psql
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/dosco/super-graph/qcode"
+)
+
+// tsvColumn returns the tsvector column to search, the one set in the
+// search options or else the default one for the table.
+func (v *selectBlock) tsvColumn() (string, error) {
+	cn := v.sel.Search.Column
+
+	if len(cn) == 0 {
+		if len(v.ti.TSVCol) == 0 {
+			return "", fmt.Errorf("no tsv column defined for %s", v.sel.Table)
+		}
+		return v.ti.TSVCol, nil
+	}
+
+	c, ok := v.ti.Columns[strings.ToLower(cn)]
+	if !ok || c.Type != "tsvector" {
+		return "", fmt.Errorf("'%s' is not a tsvector column of %s", cn, v.sel.Table)
+	}
+
+	return c.Name, nil
+}
+
+func (v *selectBlock) renderSearch(w io.Writer) error {
+	cn, err := v.tsvColumn()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, `(("%s"."%s") @@ `, v.sel.Table, cn)
+	renderTsQuery(w, v.sel.Search)
+	io.WriteString(w, `)`)
+
+	return nil
+}
+
+func (v *selectBlock) renderSearchRank(w io.Writer, col *qcode.Column) error {
+	cn, err := v.tsvColumn()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, `ts_rank("%s"."%s", `, v.sel.Table, cn)
+	renderTsQuery(w, v.sel.Search)
+
+	if len(v.sel.Search.RankNorm) != 0 {
+		fmt.Fprintf(w, `, %s`, v.sel.Search.RankNorm)
+	}
+
+	fmt.Fprintf(w, `) AS %s`, col.Name)
+
+	return nil
+}
+
+func (v *selectBlock) renderSearchHeadline(w io.Writer, col *qcode.Column) error {
+	cn := col.Name[16:]
+
+	if _, ok := v.ti.Columns[cn]; !ok {
+		return fmt.Errorf("unknown column '%s.%s' in %s", v.sel.Table, cn, col.Name)
+	}
+
+	io.WriteString(w, `ts_headline(`)
+
+	if len(v.sel.Search.Lang) != 0 {
+		fmt.Fprintf(w, `'%s', `, v.sel.Search.Lang)
+	}
+
+	fmt.Fprintf(w, `"%s"."%s", `, v.sel.Table, cn)
+	renderTsQuery(w, v.sel.Search)
+	fmt.Fprintf(w, `) AS %s`, col.Name)
+
+	return nil
+}
+
+// renderTsQuery renders the search text as a tsquery, the websearch
+// parser is used by default since unlike to_tsquery it accepts any
+// text a user might type.
+func renderTsQuery(w io.Writer, s *qcode.Search) {
+	switch strings.ToLower(s.Parser) {
+	case "plain":
+		io.WriteString(w, `plainto_tsquery(`)
+	case "phrase":
+		io.WriteString(w, `phraseto_tsquery(`)
+	case "raw":
+		io.WriteString(w, `to_tsquery(`)
+	default:
+		io.WriteString(w, `websearch_to_tsquery(`)
+	}
+
+	if len(s.Lang) != 0 {
+		fmt.Fprintf(w, `'%s', `, s.Lang)
+	}
+
+	fmt.Fprintf(w, `%s)`, sqlString(s.Query))
+}
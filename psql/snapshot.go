@@ -0,0 +1,151 @@
+package psql
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-pg/pg"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Snapshot holds the tables, columns and functions returning rows of a
+// table read from the database, the foreign keys of the columns are used
+// to find the relationships when building a schema from it. Saved to a
+// file it lets the schema be built without connecting to the database.
+type Snapshot struct {
+	Tables    []*SnapshotTable `json:"tables" yaml:"tables"`
+	Functions []*DBTableFunc   `json:"functions,omitempty" yaml:"functions,omitempty"`
+}
+
+type SnapshotTable struct {
+	Name    string      `json:"name" yaml:"name"`
+	Type    string      `json:"type" yaml:"type"`
+	Columns []*DBColumn `json:"columns" yaml:"columns"`
+}
+
+func NewSnapshot(db *pg.DB) (*Snapshot, error) {
+	tables, err := GetTables(db)
+	if err != nil {
+		return nil, err
+	}
+
+	snap := &Snapshot{Tables: make([]*SnapshotTable, len(tables))}
+
+	for i, t := range tables {
+		cols, err := GetColumns(db, "public", t.Name)
+		if err != nil {
+			return nil, err
+		}
+		snap.Tables[i] = &SnapshotTable{t.Name, t.Type, cols}
+	}
+
+	if snap.Functions, err = GetTableFuncs(db); err != nil {
+		return nil, err
+	}
+
+	return snap, nil
+}
+
+// Schema builds the schema from the tables, columns and functions in the
+// snapshot. Functions returning rows of a table not in it are skipped.
+func (s *Snapshot) Schema() *DBSchema {
+	tables := make([]*DBTable, len(s.Tables))
+	columns := make([][]*DBColumn, len(s.Tables))
+
+	for i, t := range s.Tables {
+		tables[i] = &DBTable{Name: t.Name, Type: t.Type}
+		columns[i] = t.Columns
+	}
+
+	schema := newDBSchema(tables, columns)
+	schema.TableFuncs = make(map[string]*DBTableFunc, len(s.Functions))
+
+	for _, f := range s.Functions {
+		if _, ok := schema.Tables[strings.ToLower(f.Table)]; ok {
+			schema.TableFuncs[strings.ToLower(f.Name)] = f
+		}
+	}
+
+	return schema
+}
+
+// Encode writes the snapshot as json or yaml.
+func (s *Snapshot) Encode(w io.Writer, format string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(s)
+
+	case "yaml":
+		return yaml.NewEncoder(w).Encode(s)
+	}
+
+	return fmt.Errorf("unknown snapshot format '%s'", format)
+}
+
+// DecodeSnapshot reads a snapshot written by Encode.
+func DecodeSnapshot(r io.Reader, format string) (*Snapshot, error) {
+	snap := &Snapshot{}
+
+	switch format {
+	case "json":
+		if err := json.NewDecoder(r).Decode(snap); err != nil {
+			return nil, err
+		}
+
+	case "yaml":
+		if err := yaml.NewDecoder(r).Decode(snap); err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown snapshot format '%s'", format)
+	}
+
+	return snap, nil
+}
+
+// SaveSnapshot writes the snapshot to a file, the format is picked using
+// the file extension.
+func SaveSnapshot(file string, s *Snapshot) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+
+	if err := s.Encode(f, snapshotFormat(file)); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// LoadSnapshot reads a snapshot file saved by SaveSnapshot.
+func LoadSnapshot(file string) (*Snapshot, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	snap, err := DecodeSnapshot(f, snapshotFormat(file))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+
+	return snap, nil
+}
+
+func snapshotFormat(file string) string {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yml", ".yaml":
+		return "yaml"
+	}
+	return "json"
+}
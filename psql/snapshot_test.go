@@ -0,0 +1,26 @@
+package psql
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	for _, format := range []string{"json", "yaml"} {
+		var b bytes.Buffer
+
+		if err := testSnapshot.Encode(&b, format); err != nil {
+			t.Fatal(err)
+		}
+
+		snap, err := DecodeSnapshot(&b, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(snap.Schema(), testSnapshot.Schema()) {
+			t.Fatalf("%s: schema loaded from snapshot does not match", format)
+		}
+	}
+}
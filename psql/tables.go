@@ -5,8 +5,13 @@ import (
 	"strings"
 
 	"github.com/go-pg/pg"
+	"github.com/gobuffalo/flect"
 )
 
+// selfRefField is the field for the rows of a table that point to a row
+// of the same table, like the children of a category or a comment
+const selfRefField = "children"
+
 type TCKey struct {
 	Table, Column string
 }
@@ -16,8 +21,9 @@ type TTKey struct {
 }
 
 type DBSchema struct {
-	Tables map[string]*DBTableInfo
-	RelMap map[TTKey]*DBRel
+	Tables     map[string]*DBTableInfo
+	RelMap     map[TTKey]*DBRel
+	TableFuncs map[string]*DBTableFunc
 }
 
 type DBTableInfo struct {
@@ -25,6 +31,7 @@ type DBTableInfo struct {
 	PrimaryCol string
 	TSVCol     string
 	Columns    map[string]*DBColumn
+	Funcs      map[string]*DBFunction
 }
 
 type RelType int
@@ -33,48 +40,115 @@ const (
 	RelBelongTo RelType = iota + 1
 	RelOneToMany
 	RelOneToManyThrough
+	RelPolymorphic
+)
+
+type RelArray int
+
+const (
+	RelArrayNone RelArray = iota
+	RelArrayNative
+	RelArrayJSON
 )
 
+// DBRel describes how the table behind a field (Table1 in the RelMap key)
+// joins to its parent table (Table2). Col1 are columns of Table1 and Col2
+// the matching columns of Table2. For relationships through a join table
+// ColT1 are the join table columns matching Col1 and ColT2 those matching
+// Col2. All column lists are the same length and in key order.
+//
+// Polymorphic relationships only have Col2 and TypeCol set, the table
+// joined in depends on the type named in the query.
+//
+// Array1 and Array2 are set when Col1 or Col2 is a single array or jsonb
+// column holding a list of ids. Polymorphic relationships also compare
+// TypeCol with TypeVal, the column is in Table1 for RelBelongTo and in
+// Table2 for RelOneToMany.
 type DBRel struct {
 	Type    RelType
+	Table   string
 	Through string
-	ColT    string
-	Col1    string
-	Col2    string
+	ColT1   []string
+	ColT2   []string
+	Col1    []string
+	Col2    []string
+	Array1  RelArray
+	Array2  RelArray
+	TypeCol string
+	TypeVal string
+}
+
+// dbFKey is a foreign key constraint, one or more columns of Table
+// referencing the same number of columns in FKeyTable.
+type dbFKey struct {
+	Table     string
+	FKeyTable string
+	Cols      []string
+	FKeyCols  []string
 }
 
 func NewDBSchema(db *pg.DB) (*DBSchema, error) {
+	snap, err := NewSnapshot(db)
+	if err != nil {
+		return nil, err
+	}
+
+	return snap.Schema(), nil
+}
+
+func newDBSchema(tables []*DBTable, columns [][]*DBColumn) *DBSchema {
 	schema := &DBSchema{
 		Tables: make(map[string]*DBTableInfo),
 		RelMap: make(map[TTKey]*DBRel),
 	}
 
-	tables, err := GetTables(db)
-	if err != nil {
-		return nil, err
+	colByID := make(map[string]map[int]*DBColumn, len(tables))
+
+	for i, t := range tables {
+		colByID[strings.ToLower(t.Name)] = schema.updateSchema(t, columns[i])
 	}
 
-	for _, t := range tables {
-		cols, err := GetColumns(db, "public", t.Name)
-		if err != nil {
-			return nil, err
+	// Relationships can only be resolved once the columns of
+	// every table are known as foreign keys point across tables
+	fkeys := make([][]*dbFKey, len(tables))
+
+	for i, t := range tables {
+		fkeys[i] = getFKeys(t, columns[i], colByID)
+
+		for _, fk := range fkeys[i] {
+			schema.updateSchemaFKey(fk)
 		}
 
-		schema.updateSchema(t, cols)
+		schema.updateSchemaPoly(t, columns[i])
+	}
+
+	// If table contains multiple foreign keys it's a possible
+	// join table for many-to-many relationships or multiple one-to-many
+	// relations. These are added last so direct foreign keys always
+	// take precedence.
+	for i := range fkeys {
+		if len(fkeys[i]) < 2 {
+			continue
+		}
+		for n := range fkeys[i] {
+			for m := range fkeys[i] {
+				if n != m {
+					schema.updateSchemaOTMT(fkeys[i][n], fkeys[i][m])
+				}
+			}
+		}
 	}
 
-	return schema, nil
+	return schema
 }
 
-func (s *DBSchema) updateSchema(t *DBTable, cols []*DBColumn) {
+func (s *DBSchema) updateSchema(t *DBTable, cols []*DBColumn) map[int]*DBColumn {
 	// Current table
 	ti := &DBTableInfo{
 		Name:    t.Name,
 		Columns: make(map[string]*DBColumn, len(cols)),
 	}
 
-	// Foreign key columns in current table
-	var jcols []*DBColumn
 	colByID := make(map[int]*DBColumn)
 
 	for i := range cols {
@@ -88,81 +162,201 @@ func (s *DBSchema) updateSchema(t *DBTable, cols []*DBColumn) {
 
 	for _, c := range cols {
 		switch {
+		// The default tsvector column to search is the one named
+		// 'tsv' or else the first one found
 		case c.Type == "tsvector":
-			s.Tables[ct].TSVCol = c.Name
+			if len(ti.TSVCol) == 0 || strings.EqualFold(c.Name, "tsv") {
+				ti.TSVCol = c.Name
+			}
 
 		case c.PrimaryKey:
 			s.Tables[ct].PrimaryCol = c.Name
+		}
+	}
 
-		case len(c.FKeyTable) != 0:
-			if len(c.FKeyColID) == 0 {
-				continue
-			}
+	return colByID
+}
+
+// getFKeys groups the foreign key columns of a table by constraint
+// and resolves the columns they reference in the foreign table.
+func getFKeys(t *DBTable, cols []*DBColumn,
+	colByID map[string]map[int]*DBColumn) []*dbFKey {
+
+	var fkeys []*dbFKey
+	fkmap := make(map[string]*dbFKey)
 
-			// Foreign key column name
-			ft := strings.ToLower(c.FKeyTable)
-			fc, ok := colByID[c.FKeyColID[0]]
-			if !ok {
-				continue
+	ct := strings.ToLower(t.Name)
+
+	for _, c := range cols {
+		if len(c.FKeyTable) == 0 || len(c.FKeyColID) == 0 {
+			continue
+		}
+
+		ft := strings.ToLower(c.FKeyTable)
+
+		fcols, ok := colByID[ft]
+		if !ok {
+			continue
+		}
+
+		// Position of this column in the constraint, the referenced
+		// column is at the same position in the foreign table
+		pos := 0
+		for i, id := range c.FKeySrcColID {
+			if id == c.ID {
+				pos = i
+				break
 			}
+		}
 
-			// Belongs-to relation between current table and the
-			// table in the foreign key
-			rel1 := &DBRel{RelBelongTo, "", "", c.Name, fc.Name}
-			s.RelMap[TTKey{ct, ft}] = rel1
+		if pos >= len(c.FKeyColID) {
+			continue
+		}
 
-			// One-to-many relation between the foreign key table and the
-			// the current table
-			rel2 := &DBRel{RelOneToMany, "", "", fc.Name, c.Name}
-			s.RelMap[TTKey{ft, ct}] = rel2
+		fc, ok := fcols[c.FKeyColID[pos]]
+		if !ok {
+			continue
+		}
 
-			jcols = append(jcols, c)
+		name := c.FKeyName
+		if len(name) == 0 {
+			name = c.Name
 		}
-	}
 
-	// If table contains multiple foreign key columns it's a possible
-	// join table for many-to-many relationships or multiple one-to-many
-	// relations
-
-	// Below one-to-many relations use the current table as the
-	// join table aka through table.
-	if len(jcols) > 1 {
-		for i := range jcols {
-			for n := range jcols {
-				if n != i {
-					s.updateSchemaOTMT(ct, jcols[i], jcols[n], colByID)
-				}
+		fk, ok := fkmap[name]
+		if !ok {
+			n := len(c.FKeyColID)
+			fk = &dbFKey{
+				Table:     ct,
+				FKeyTable: ft,
+				Cols:      make([]string, n),
+				FKeyCols:  make([]string, n),
 			}
+			fkmap[name] = fk
+			fkeys = append(fkeys, fk)
 		}
+
+		fk.Cols[pos] = c.Name
+		fk.FKeyCols[pos] = fc.Name
 	}
-}
 
-func (s *DBSchema) updateSchemaOTMT(
-	ct string, col1, col2 *DBColumn, colByID map[int]*DBColumn) {
+	return fkeys
+}
 
-	t1 := strings.ToLower(col1.FKeyTable)
-	t2 := strings.ToLower(col2.FKeyTable)
+func (s *DBSchema) updateSchemaFKey(fk *dbFKey) {
+	ct := fk.Table
+	ft := fk.FKeyTable
+
+	// Belongs-to relation between current table and the
+	// table in the foreign key
+	rel1 := &DBRel{Type: RelBelongTo, Table: ct, Col1: fk.Cols, Col2: fk.FKeyCols}
+	s.addRel(TTKey{ct, ft}, rel1)
+
+	// One-to-many relation between the foreign key table and the
+	// the current table
+	rel2 := &DBRel{Type: RelOneToMany, Table: ft, Col1: fk.FKeyCols, Col2: fk.Cols}
+	s.addRel(TTKey{ft, ct}, rel2)
+
+	// A foreign key to the same table like 'comments.parent_id' uses the
+	// same key for both sides, the rows pointing to a row are also
+	// exposed as 'children' unless there is a table by that name. With
+	// more than one the first gets it, each is also named after its
+	// column below like 'parent_comments'.
+	if ct == ft {
+		if _, ok := s.Tables[selfRefField]; !ok {
+			s.addRel(relFieldKey(selfRefField, ct), &DBRel{
+				Type: RelBelongTo, Table: ct, Col1: fk.Cols, Col2: fk.FKeyCols})
+		}
+	}
 
-	fc1, ok := colByID[col1.FKeyColID[0]]
-	if !ok {
+	// Single column foreign keys like 'billing_address_id' are also
+	// exposed as a field named after the column 'billing_address' and
+	// the reverse as 'billing_address_orders'. This allows multiple
+	// foreign keys between the same pair of tables.
+	if len(fk.Cols) != 1 || !strings.HasSuffix(fk.Cols[0], "_id") {
 		return
 	}
-	fc2, ok := colByID[col2.FKeyColID[0]]
-	if !ok {
-		return
+	fn := strings.TrimSuffix(fk.Cols[0], "_id")
+
+	if k := relFieldKey(fn, ct); k.Table1 != ft {
+		s.addRel(k, &DBRel{Type: RelOneToMany, Table: ft, Col1: fk.FKeyCols, Col2: fk.Cols})
 	}
 
+	if k := relFieldKey(fn+"_"+ct, ft); k.Table1 != ct {
+		s.addRel(k, &DBRel{Type: RelBelongTo, Table: ct, Col1: fk.Cols, Col2: fk.FKeyCols})
+	}
+}
+
+// updateSchemaPoly adds Rails style polymorphic relationships for
+// column pairs like 'commentable_type' and 'commentable_id'.
+func (s *DBSchema) updateSchemaPoly(t *DBTable, cols []*DBColumn) {
+	ct := strings.ToLower(t.Name)
+	ti := s.Tables[ct]
+
+	for _, c := range cols {
+		cn := strings.ToLower(c.Name)
+		if !strings.HasSuffix(cn, "_type") {
+			continue
+		}
+		fn := strings.TrimSuffix(cn, "_type")
+
+		ic, ok := ti.Columns[fn+"_id"]
+		if !ok || len(ic.FKeyTable) != 0 {
+			continue
+		}
+
+		s.addRel(relFieldKey(fn, ct), &DBRel{
+			Type:    RelPolymorphic,
+			Col2:    []string{ic.Name},
+			TypeCol: c.Name,
+		})
+	}
+}
+
+func (s *DBSchema) updateSchemaOTMT(fk1, fk2 *dbFKey) {
+	t1 := fk1.FKeyTable
+	t2 := fk2.FKeyTable
+
 	// One-to-many-through relation between 1nd foreign key table and the
 	// 2nd foreign key table
-	//rel1 := &DBRel{RelOneToManyThrough, ct, fc1.Name, col1.Name}
-	rel1 := &DBRel{RelOneToManyThrough, ct, col2.Name, fc2.Name, col1.Name}
-	s.RelMap[TTKey{t1, t2}] = rel1
+	rel1 := &DBRel{
+		Type:    RelOneToManyThrough,
+		Table:   t1,
+		Through: fk1.Table,
+		ColT1:   fk1.Cols,
+		ColT2:   fk2.Cols,
+		Col1:    fk1.FKeyCols,
+		Col2:    fk2.FKeyCols,
+	}
+	s.addRel(TTKey{t1, t2}, rel1)
 
 	// One-to-many-through relation between 2nd foreign key table and the
 	// 1nd foreign key table
-	//rel2 := &DBRel{RelOneToManyThrough, ct, col2.Name, fc2.Name}
-	rel2 := &DBRel{RelOneToManyThrough, ct, col1.Name, fc1.Name, col2.Name}
-	s.RelMap[TTKey{t2, t1}] = rel2
+	rel2 := &DBRel{
+		Type:    RelOneToManyThrough,
+		Table:   t2,
+		Through: fk2.Table,
+		ColT1:   fk2.Cols,
+		ColT2:   fk1.Cols,
+		Col1:    fk2.FKeyCols,
+		Col2:    fk1.FKeyCols,
+	}
+	s.addRel(TTKey{t2, t1}, rel2)
+}
+
+// addRel adds a relationship unless one already exists for the same
+// key, the first foreign key found wins.
+func (s *DBSchema) addRel(k TTKey, rel *DBRel) {
+	if _, ok := s.RelMap[k]; ok {
+		return
+	}
+	s.RelMap[k] = rel
+}
+
+// relFieldKey returns the RelMap key for a field on a table, field
+// names are pluralized the same way the query compiler does it.
+func relFieldKey(field, table string) TTKey {
+	return TTKey{flect.Pluralize(strings.ToLower(field)), table}
 }
 
 type DBTable struct {
@@ -198,14 +392,16 @@ WHERE c.relkind IN ('r','v','m','f','')
 }
 
 type DBColumn struct {
-	ID         int    `sql:"id"`
-	Name       string `sql:"name"`
-	Type       string `sql:"type"`
-	NotNull    bool   `sql:"notnull"`
-	PrimaryKey bool   `sql:"primarykey"`
-	Uniquekey  bool   `sql:"uniquekey"`
-	FKeyTable  string `sql:"foreignkey"`
-	FKeyColID  []int  `sql:"foreignkey_fieldnum,array"`
+	ID           int    `sql:"id" json:"id" yaml:"id"`
+	Name         string `sql:"name" json:"name" yaml:"name"`
+	Type         string `sql:"type" json:"type" yaml:"type"`
+	NotNull      bool   `sql:"notnull" json:"not_null,omitempty" yaml:"not_null,omitempty"`
+	PrimaryKey   bool   `sql:"primarykey" json:"primary_key,omitempty" yaml:"primary_key,omitempty"`
+	Uniquekey    bool   `sql:"uniquekey" json:"unique_key,omitempty" yaml:"unique_key,omitempty"`
+	FKeyTable    string `sql:"foreignkey" json:"foreign_key,omitempty" yaml:"foreign_key,omitempty"`
+	FKeyColID    []int  `sql:"foreignkey_fieldnum,array" json:"foreign_key_columns,omitempty" yaml:"foreign_key_columns,omitempty,flow"`
+	FKeyName     string `sql:"foreignkey_name" json:"foreign_key_name,omitempty" yaml:"foreign_key_name,omitempty"`
+	FKeySrcColID []int  `sql:"foreignkey_src_fieldnum,array" json:"foreign_key_source_columns,omitempty" yaml:"foreign_key_source_columns,omitempty,flow"`
 }
 
 func GetColumns(db *pg.DB, schema, table string) ([]*DBColumn, error) {
@@ -228,7 +424,13 @@ func GetColumns(db *pg.DB, schema, table string) ([]*DBColumn, error) {
     END AS foreignkey,
     CASE
         WHEN p.contype = 'f' THEN p.confkey
-    END AS foreignkey_fieldnum
+    END AS foreignkey_fieldnum,
+    CASE
+        WHEN p.contype = 'f' THEN p.conname
+    END AS foreignkey_name,
+    CASE
+        WHEN p.contype = 'f' THEN p.conkey
+    END AS foreignkey_src_fieldnum
 FROM pg_attribute f  
     JOIN pg_class c ON c.oid = f.attrelid  
     JOIN pg_type t ON t.oid = f.atttypid  
@@ -256,6 +458,57 @@ WHERE c.relkind = 'r'::char
 	return t, nil
 }
 
+// DBTableFunc is a function that returns a set of rows of Table, its
+// arguments have to be named. The last Defaults arguments are optional.
+// Volatile functions can change data and are only called from mutations.
+type DBTableFunc struct {
+	Name     string   `sql:"name" json:"name" yaml:"name"`
+	Table    string   `sql:"table" json:"table" yaml:"table"`
+	ArgNames []string `sql:"arg_names,array" json:"arg_names,omitempty" yaml:"arg_names,omitempty,flow"`
+	ArgTypes []string `sql:"arg_types,array" json:"arg_types,omitempty" yaml:"arg_types,omitempty,flow"`
+	Defaults int      `sql:"defaults" json:"defaults,omitempty" yaml:"defaults,omitempty"`
+	Volatile bool     `sql:"volatile" json:"volatile,omitempty" yaml:"volatile,omitempty"`
+}
+
+// GetTableFuncs returns the functions in the public schema that return a
+// set of rows of a table. Overloaded functions and ones with unnamed or
+// output arguments are left out.
+func GetTableFuncs(db *pg.DB) ([]*DBTableFunc, error) {
+	sqlStmt := `
+SELECT
+  p.proname AS "name",
+  c.relname AS "table",
+  coalesce(p.proargnames, '{}') AS "arg_names",
+  array(SELECT format_type(a.t, NULL)
+    FROM unnest(p.proargtypes::oid[]) WITH ORDINALITY AS a(t, i)
+    ORDER BY a.i) AS "arg_types",
+  p.pronargdefaults AS "defaults",
+  p.provolatile = 'v' AS "volatile"
+FROM pg_catalog.pg_proc p
+  JOIN pg_catalog.pg_namespace n ON n.oid = p.pronamespace
+  JOIN pg_catalog.pg_type t ON t.oid = p.prorettype
+  JOIN pg_catalog.pg_class c ON c.oid = t.typrelid
+WHERE n.nspname = 'public'
+  AND p.proretset
+  AND p.proargmodes IS NULL
+  AND c.relkind IN ('r','v','m','f','p')
+  AND coalesce(array_length(p.proargnames, 1), 0) = p.pronargs
+  AND '' <> ALL(coalesce(p.proargnames, '{}'))
+  AND (SELECT count(*) FROM pg_catalog.pg_proc o
+    WHERE o.proname = p.proname AND o.pronamespace = p.pronamespace) = 1
+ORDER BY p.proname;
+`
+
+	var f []*DBTableFunc
+	_, err := db.Query(&f, sqlStmt)
+
+	if err != nil {
+		return nil, fmt.Errorf("Error fetching functions: %s", err)
+	}
+
+	return f, nil
+}
+
 func (s *DBSchema) GetTable(table string) (*DBTableInfo, error) {
 	t, ok := s.Tables[table]
 	if !ok {
@@ -263,3 +516,11 @@ func (s *DBSchema) GetTable(table string) (*DBTableInfo, error) {
 	}
 	return t, nil
 }
+
+func (s *DBSchema) GetRel(child, parent string) (*DBRel, error) {
+	rel, ok := s.RelMap[TTKey{child, parent}]
+	if !ok {
+		return nil, fmt.Errorf("no relationship found between '%s' and '%s'", child, parent)
+	}
+	return rel, nil
+}
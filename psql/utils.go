@@ -1,6 +1,9 @@
 package psql
 
-import "regexp"
+import (
+	"regexp"
+	"strings"
+)
 
 func NewVariables(varlist map[string]string) map[string]string {
 	re := regexp.MustCompile(`(?mi)\$([a-zA-Z0-9_.]+)`)
@@ -11,3 +14,18 @@ func NewVariables(varlist map[string]string) map[string]string {
 	}
 	return vars
 }
+
+// sqlString returns the value as a quoted SQL string literal, quotes in
+// the value are doubled so it cannot end the literal. The SQL is used as
+// a template where '{{' starts a tag so values with one are written as
+// an escape string with the second brace as '\u007b' like in quoteJSON.
+func sqlString(v string) string {
+	v = strings.Replace(v, `'`, `''`, -1)
+
+	if !strings.Contains(v, `{{`) {
+		return `'` + v + `'`
+	}
+
+	v = strings.Replace(v, `\`, `\\`, -1)
+	return `E'` + strings.Replace(v, `{{`, `{\u007b`, -1) + `'`
+}
@@ -1,6 +1,7 @@
 package qcode
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 	"unicode"
@@ -215,7 +216,7 @@ func lex(input string) (*lexer, error) {
 	l.run()
 
 	if last := l.items[len(l.items)-1]; last.typ == itemError {
-		return nil, fmt.Errorf(last.val)
+		return nil, errors.New(last.val)
 	}
 	return l, nil
 }
@@ -325,6 +326,9 @@ func lexName(l *lexer) stateFn {
 // lexString scans a string.
 func lexString(l *lexer) stateFn {
 	if l.accept("\"'") {
+		// The string ends at the same kind of quote it started with
+		// so "it's" is a valid string
+		q := l.input[l.pos-1 : l.pos]
 		l.ignore()
 
 		for {
@@ -333,10 +337,10 @@ func lexString(l *lexer) stateFn {
 				l.emit(itemEOF)
 				return nil
 			}
-			if r == '\'' || r == '"' {
+			if string(r) == q {
 				l.backup()
 				l.emit(itemStringVal)
-				if l.accept("\"'") {
+				if l.accept(q) {
 					l.ignore()
 				}
 				break
@@ -0,0 +1,40 @@
+package qcode
+
+import "testing"
+
+func TestLexString(t *testing.T) {
+	tests := []struct {
+		input string
+		val   string
+	}{
+		{`"red shoes"`, `red shoes`},
+		{`'red shoes'`, `red shoes`},
+		{`"it's"`, `it's`},
+		{`'say "hi"'`, `say "hi"`},
+		{`""`, ``},
+	}
+
+	for _, tt := range tests {
+		l, err := lex(`{ products(search: ` + tt.input + `) { id } }`)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.input, err)
+		}
+
+		var vals []string
+		for _, it := range l.items {
+			if it.typ == itemStringVal {
+				vals = append(vals, it.val)
+			}
+		}
+
+		if len(vals) != 1 || vals[0] != tt.val {
+			t.Errorf("%s: expected string %q got %q", tt.input, tt.val, vals)
+		}
+	}
+}
+
+func TestLexError(t *testing.T) {
+	if _, err := lex(`{ products(id: %) { id } }`); err == nil {
+		t.Fatal("expected an error for an unknown character")
+	}
+}
@@ -3,6 +3,8 @@ package qcode
 import (
 	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/dosco/super-graph/util"
 )
@@ -71,6 +73,7 @@ type Field struct {
 	Name     string
 	Alias    string
 	Args     []*Arg
+	Fragment bool
 	Parent   *Field
 	Children []*Field
 }
@@ -111,8 +114,43 @@ func Parse(gql string) (*Operation, error) {
 	return p.parseOp()
 }
 
+// ParseQuery parses a query, mutation or subscription, operations
+// without a type like '{ users { id } }' are queries.
 func ParseQuery(gql string) (*Operation, error) {
-	return parseByType(gql, opQuery)
+	return parseQuery(gql, nil)
+}
+
+func parseQuery(gql string, fn PhaseFunc) (*Operation, error) {
+	st := time.Now()
+
+	l, err := lex(gql)
+	if err != nil {
+		return nil, err
+	}
+
+	if fn != nil {
+		fn("lex", st, time.Now())
+		st = time.Now()
+	}
+
+	p := &Parser{
+		pos:   -1,
+		items: l.items,
+	}
+
+	var op *Operation
+
+	if p.peek(itemName) && opType(p.items[0].val) != 0 {
+		op, err = p.parseOp()
+	} else {
+		op, err = p.parseOpByType(opQuery)
+	}
+
+	if fn != nil && err == nil {
+		fn("parse", st, time.Now())
+	}
+
+	return op, err
 }
 
 func ParseArgValue(argVal string) (*Node, error) {
@@ -218,23 +256,32 @@ func (p *Parser) parseOpByType(ty parserType) (*Operation, error) {
 }
 
 func (p *Parser) parseOp() (*Operation, error) {
-	if p.peek(itemQuery, itemMutation, itemSub) == false {
+	if p.peek(itemName) == false {
 		err := fmt.Errorf("expecting a query, mutation or subscription (not '%s')", p.next().val)
 		return nil, err
 	}
 
 	item := p.next()
 
-	switch item.typ {
-	case itemQuery:
-		return p.parseOpByType(opQuery)
-	case itemMutation:
-		return p.parseOpByType(opMutate)
-	case itemSub:
-		return p.parseOpByType(opSub)
+	if ty := opType(item.val); ty != 0 {
+		return p.parseOpByType(ty)
 	}
 
-	return nil, errors.New("unknown operation type")
+	return nil, fmt.Errorf("expecting a query, mutation or subscription (not '%s')", item.val)
+}
+
+// opType returns the operation type named by the keyword at the start
+// of an operation.
+func opType(name string) parserType {
+	switch strings.ToLower(name) {
+	case "query":
+		return opQuery
+	case "mutation":
+		return opMutate
+	case "subscription":
+		return opSub
+	}
+	return 0
 }
 
 func (p *Parser) parseFields() ([]*Field, int16, error) {
@@ -257,11 +304,23 @@ func (p *Parser) parseFields() ([]*Field, int16, error) {
 			return nil, 0, errors.New("too many fields")
 		}
 
-		if p.peek(itemName) == false {
+		var field *Field
+		var err error
+
+		switch {
+		case p.peek(itemSpread):
+			if st.Len() == 0 {
+				return nil, 0, errors.New("inline fragments must be within a field")
+			}
+			field, err = p.parseFragment()
+
+		case p.peek(itemName):
+			field, err = p.parseField()
+
+		default:
 			return nil, 0, errors.New("expecting an alias or field name")
 		}
 
-		field, err := p.parseField()
 		if err != nil {
 			return nil, 0, err
 		}
@@ -315,6 +374,27 @@ func (p *Parser) parseField() (*Field, error) {
 	return field, nil
 }
 
+// parseFragment parses an inline fragment '... on Post { title }' into
+// a field named after the type.
+func (p *Parser) parseFragment() (*Field, error) {
+	p.ignore()
+
+	if p.peek(itemName) == false || p.next().val != "on" {
+		return nil, errors.New("expecting 'on' after '...'")
+	}
+
+	if p.peek(itemName) == false {
+		return nil, errors.New("expecting a type name for the inline fragment")
+	}
+	field := &Field{Name: p.next().val, Fragment: true}
+
+	if p.peek(itemObjOpen) == false {
+		return nil, errors.New("expecting a selection for the inline fragment")
+	}
+
+	return field, nil
+}
+
 func (p *Parser) parseArgs() ([]*Arg, error) {
 	var args []*Arg
 	var err error
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func compareOp(op1, op2 Operation) error {
@@ -48,6 +49,144 @@ func compareOp(op1, op2 Operation) error {
 func TestParse(t *testing.T) {
 }
 
+func TestParseFragment(t *testing.T) {
+	gql := `{
+		comments {
+			body
+			commentable {
+				__typename
+				... on Product {
+					name
+				}
+				... on User {
+					email
+				}
+			}
+		}
+	}`
+
+	op, err := ParseQuery(gql)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := op.Fields[0].Children[1]
+	if c.Name != "commentable" || len(c.Children) != 3 {
+		t.Fatalf("expected commentable with 3 fields got %+v", c)
+	}
+
+	for i, name := range []string{"Product", "User"} {
+		f := c.Children[i+1]
+
+		if f.Name != name || !f.Fragment || f.Parent != c {
+			t.Errorf("expected a fragment on %s got %+v", name, f)
+		}
+		if len(f.Children) != 1 || f.Children[0].Fragment {
+			t.Errorf("expected one field in the fragment on %s", name)
+		}
+	}
+
+	com, err := NewCompiler(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	qc, err := com.CompileQuery(gql)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sel := qc.Query.Select.Joins[0]
+	if !sel.Union || len(sel.Joins) != 2 {
+		t.Fatalf("expected a union of 2 types got %+v", sel)
+	}
+
+	tables := map[string]string{"Product": "products", "User": "users"}
+
+	for _, frag := range sel.Joins {
+		if tables[frag.Type] != frag.Table {
+			t.Errorf("expected the fragment on %s to select from its table got %s", frag.Type, frag.Table)
+		}
+		if frag.FieldName != "commentable" || len(frag.Cols) != 2 {
+			t.Errorf("expected the fragment to share the fields of commentable got %+v", frag)
+		}
+	}
+}
+
+func TestParseFragmentInvalid(t *testing.T) {
+	gqls := []string{
+		`{ ... on User { id } }`,
+		`{ comments { ... User { id } } }`,
+		`{ comments { ... on { id } } }`,
+		`{ comments { ... on User } }`,
+	}
+
+	for _, gql := range gqls {
+		if _, err := ParseQuery(gql); err == nil {
+			t.Errorf("expected an error for %s", gql)
+		}
+	}
+}
+
+func TestCompileQueryPhases(t *testing.T) {
+	com, err := NewCompiler(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var phases []string
+
+	fn := func(phase string, st, et time.Time) {
+		if et.Before(st) {
+			t.Errorf("%s: ends before it starts", phase)
+		}
+		phases = append(phases, phase)
+	}
+
+	if _, err := com.CompileQueryPhases(`{ products { id } }`, fn); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(phases, []string{"lex", "parse", "compile"}) {
+		t.Errorf("expected lex, parse and compile got %v", phases)
+	}
+
+	// Phases that fail are not reported
+	phases = nil
+
+	if _, err := com.CompileQueryPhases(`{ products { id: } }`, fn); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if !reflect.DeepEqual(phases, []string{"lex"}) {
+		t.Errorf("expected only lex got %v", phases)
+	}
+}
+
+func TestCompileGroupByBlacklist(t *testing.T) {
+	com, err := NewCompiler(Config{Blacklist: []string{"secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string][]string{
+		`{ users_aggregate(group_by: [Secret, name]) { count } }`: []string{"name"},
+		`{ users_aggregate(group_by: secret) { count } }`:         nil,
+		`{ users_aggregate(group_by: name) { count } }`:           []string{"name"},
+	}
+
+	for gql, want := range tests {
+		qc, err := com.CompileQuery(gql)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if g := qc.Query.Select.GroupBy; !reflect.DeepEqual(g, want) {
+			t.Errorf("%s: expected %v got %v", gql, want, g)
+		}
+	}
+}
+
 func BenchmarkParse(b *testing.B) {
 
 }
@@ -3,12 +3,21 @@ package qcode
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/dosco/super-graph/util"
 	"github.com/gobuffalo/flect"
 )
 
+type QType int
+
+const (
+	QTQuery QType = iota + 1
+	QTMutation
+)
+
 type QCode struct {
+	Type  QType
 	Query *Query
 }
 
@@ -20,6 +29,7 @@ type Column struct {
 	Table     string
 	Name      string
 	FieldName string
+	Agg       string
 }
 
 type Select struct {
@@ -34,18 +44,60 @@ type Select struct {
 	OrderBy    []*OrderBy
 	DistinctOn []string
 	Paging     Paging
+	Recursive  bool
+	Depth      string
+	Union      bool
+	Type       string
+	Action     Action
+	ActionVar  string
+	Aggregate  bool
+	GroupBy    []string
+	Search     *Search
+	Params     []*Param
 	Joins      []*Select
 }
 
+// Param is an argument of a field that is not one of the known arguments
+// like where or limit, for example an argument of a function that returns
+// the rows of a table.
+type Param struct {
+	Name string
+	Type ValType
+	Val  string
+}
+
+// Search holds the options for a full text search, Column is the
+// tsvector column to search and Lang the text search config. Parser is
+// one of websearch, plain, phrase or raw (to_tsquery). RankNorm is the
+// normalization option passed to ts_rank.
+type Search struct {
+	Query    string
+	Column   string
+	Lang     string
+	Parser   string
+	RankNorm string
+}
+
+// Action is the change a mutation makes to the table of the root
+// select, the rows are taken from the variable named in ActionVar.
+type Action int
+
+const (
+	ActionNone Action = iota
+	ActionInsert
+)
+
+// Exp is a filter expression, Path holds the keys of a nested where
+// like '{ metadata: { color: { eq: "red" } } }' that follow Col.
 type Exp struct {
-	Op        ExpOp
-	Col       string
-	NestedCol bool
-	Type      ValType
-	Val       string
-	ListType  ValType
-	ListVal   []string
-	Children  []*Exp
+	Op       ExpOp
+	Col      string
+	Path     []string
+	Type     ValType
+	Val      string
+	ListType ValType
+	ListVal  []string
+	Children []*Exp
 }
 
 type OrderBy struct {
@@ -186,12 +238,35 @@ type Config struct {
 	Filter    []string
 	FilterMap map[string][]string
 	Blacklist []string
+	SearchMap map[string]Search
+
+	// FuncMap maps the fields that call a function to the table it returns
+	// rows of, without a filter of their own they use the one of the table.
+	FuncMap map[string]string
+}
+
+const aggSuffix = "_aggregate"
+
+var aggFuncs = map[string]struct{}{
+	"count":       struct{}{},
+	"sum":         struct{}{},
+	"avg":         struct{}{},
+	"min":         struct{}{},
+	"max":         struct{}{},
+	"stddev":      struct{}{},
+	"stddev_pop":  struct{}{},
+	"stddev_samp": struct{}{},
+	"variance":    struct{}{},
+	"var_pop":     struct{}{},
+	"var_samp":    struct{}{},
 }
 
 type Compiler struct {
 	fl *Exp
 	fm map[string]*Exp
 	bl map[string]struct{}
+	sm map[string]Search
+	fn map[string]string
 }
 
 func NewCompiler(conf Config) (*Compiler, error) {
@@ -216,22 +291,54 @@ func NewCompiler(conf Config) (*Compiler, error) {
 		fm[strings.ToLower(k)] = fil
 	}
 
-	return &Compiler{fl, fm, bl}, nil
+	sm := make(map[string]Search, len(conf.SearchMap))
+
+	for k, v := range conf.SearchMap {
+		if err := validSearch(&v); err != nil {
+			return nil, fmt.Errorf("search config for %s: %s", k, err)
+		}
+		sm[strings.ToLower(k)] = v
+	}
+
+	fn := make(map[string]string, len(conf.FuncMap))
+
+	for k, v := range conf.FuncMap {
+		fn[strings.ToLower(k)] = strings.ToLower(v)
+	}
+
+	return &Compiler{fl, fm, bl, sm, fn}, nil
 }
 
+// PhaseFunc is called with the start and end time of each phase of
+// compiling a query, the phases are lex, parse and compile.
+type PhaseFunc func(phase string, st, et time.Time)
+
 func (com *Compiler) CompileQuery(query string) (*QCode, error) {
+	return com.CompileQueryPhases(query, nil)
+}
+
+// CompileQueryPhases is CompileQuery calling fn after each phase.
+func (com *Compiler) CompileQueryPhases(query string, fn PhaseFunc) (*QCode, error) {
 	var qc QCode
 	var err error
 
-	op, err := ParseQuery(query)
+	op, err := parseQuery(query, fn)
 	if err != nil {
 		return nil, err
 	}
 
+	st := time.Now()
+
 	switch op.Type {
 	case opQuery:
+		qc.Type = QTQuery
 		qc.Query, err = com.compileQuery(op)
+		if err == nil && qc.Query.Select.Action != ActionNone {
+			err = fmt.Errorf("insert can only be used in a mutation")
+		}
 	case opMutate:
+		qc.Type = QTMutation
+		qc.Query, err = com.compileMutate(op)
 	case opSub:
 	default:
 		err = fmt.Errorf("Unknown operation type %d", op.Type)
@@ -241,6 +348,10 @@ func (com *Compiler) CompileQuery(query string) (*QCode, error) {
 		return nil, err
 	}
 
+	if fn != nil {
+		fn("compile", st, time.Now())
+	}
+
 	return &qc, nil
 }
 
@@ -268,14 +379,24 @@ func (com *Compiler) compileQuery(op *Operation) (*Query, error) {
 		}
 
 		fn := strings.ToLower(field.Name)
+		if field.Fragment {
+			fn = flect.Underscore(field.Name)
+		}
+
+		isAgg := strings.HasSuffix(fn, aggSuffix)
+		if isAgg {
+			fn = strings.TrimSuffix(fn, aggSuffix)
+		}
+
 		if _, ok := com.bl[fn]; ok {
 			continue
 		}
 		tn := flect.Pluralize(fn)
 
 		s := &Select{
-			ID:    id,
-			Table: tn,
+			ID:        id,
+			Table:     tn,
+			Aggregate: isAgg,
 		}
 
 		if fn == tn {
@@ -284,20 +405,35 @@ func (com *Compiler) compileQuery(op *Operation) (*Query, error) {
 			s.Singular = fn
 		}
 
-		if fn == s.Table {
+		switch {
+		case isAgg:
+			// Aggregates return a single row unless grouped
+		case fn == s.Table:
 			s.AsList = true
-		} else {
+		default:
 			s.Paging.Limit = "1"
 		}
 
 		if len(field.Alias) != 0 {
 			s.FieldName = field.Alias
+		} else if isAgg {
+			s.FieldName = tn + aggSuffix
 		} else if s.AsList {
 			s.FieldName = s.Table
 		} else {
 			s.FieldName = s.Singular
 		}
 
+		// Inline fragments on a polymorphic field select from the
+		// table of the fragment type and share the fields selected
+		// outside the fragments.
+		if field.Fragment {
+			sp := fs[field.Parent.ID]
+			s.Type = field.Name
+			s.FieldName = sp.FieldName
+			s.Cols = append(s.Cols, sp.Cols...)
+		}
+
 		id++
 		fs[field.ID] = s
 
@@ -314,6 +450,17 @@ func (com *Compiler) compileQuery(op *Operation) (*Query, error) {
 				continue
 			}
 
+			if f.Fragment {
+				s.Union = true
+			}
+
+			if s.Aggregate {
+				if err := com.compileAggField(s, f); err != nil {
+					return nil, err
+				}
+				continue
+			}
+
 			if f.Children == nil {
 				col := &Column{Name: fn}
 				if len(f.Alias) != 0 {
@@ -338,7 +485,13 @@ func (com *Compiler) compileQuery(op *Operation) (*Query, error) {
 
 	fil, ok := com.fm[selRoot.Table]
 	if !ok {
-		fil = com.fl
+		fil = com.funcFilter(selRoot)
+	}
+
+	// The rows returned by an insert are the ones it inserted, the rows
+	// returned by a function are filtered like the rows of its table
+	if op.Type == opMutate && selRoot.Action != ActionNone {
+		fil = nil
 	}
 
 	if fil != nil && fil.Op != OpNop {
@@ -352,6 +505,25 @@ func (com *Compiler) compileQuery(op *Operation) (*Query, error) {
 	return &Query{selRoot}, nil
 }
 
+// funcFilter returns the filter of the table a field calling a function
+// returns rows of, or the default filter for other fields.
+func (com *Compiler) funcFilter(sel *Select) *Exp {
+	name := sel.Singular
+	if sel.AsList {
+		name = sel.Table
+	}
+
+	t, ok := com.fn[name]
+	if !ok {
+		return com.fl
+	}
+
+	if fil, ok := com.fm[t]; ok {
+		return fil
+	}
+	return com.fl
+}
+
 func (com *Compiler) compileArgs(sel *Select, args []*Arg) error {
 	var err error
 
@@ -383,6 +555,16 @@ func (com *Compiler) compileArgs(sel *Select, args []*Arg) error {
 			err = com.compileArgLimit(sel, args[i])
 		case "offset":
 			err = com.compileArgOffset(sel, args[i])
+		case "recursive":
+			err = com.compileArgRecursive(sel, args[i])
+		case "depth":
+			err = com.compileArgDepth(sel, args[i])
+		case "insert":
+			err = com.compileArgAction(sel, args[i], ActionInsert)
+		case "group_by", "groupby":
+			err = com.compileArgGroupBy(sel, args[i])
+		default:
+			compileArgParam(sel, an, args[i])
 		}
 
 		if err != nil {
@@ -395,6 +577,29 @@ func (com *Compiler) compileArgs(sel *Select, args []*Arg) error {
 	return nil
 }
 
+// compileArgParam keeps the other arguments with a single value, they
+// are left to the consumer to validate.
+func compileArgParam(sel *Select, name string, arg *Arg) {
+	p := &Param{Name: name, Val: arg.Val.Val}
+
+	switch arg.Val.Type {
+	case nodeStr:
+		p.Type = ValStr
+	case nodeInt:
+		p.Type = ValInt
+	case nodeFloat:
+		p.Type = ValFloat
+	case nodeBool:
+		p.Type = ValBool
+	case nodeVar:
+		p.Type = ValVar
+	default:
+		return
+	}
+
+	sel.Params = append(sel.Params, p)
+}
+
 type expT struct {
 	parent *Exp
 	node   *Node
@@ -412,7 +617,7 @@ func (com *Compiler) compileArgNode(val *Node) (*Exp, error) {
 	st := util.NewStack()
 	var root *Exp
 
-	st.Push(&expT{nil, val.Children[0]})
+	st.Push(&expT{nil, val})
 
 	for {
 		if st.Len() == 0 {
@@ -466,18 +671,59 @@ func (com *Compiler) compileArgID(sel *Select, arg *Arg) error {
 	case nodeFloat:
 		ex.Type = ValFloat
 	default:
-		fmt.Errorf("expecting an string, int or float")
+		return fmt.Errorf("expecting a string, int or float")
 	}
 
 	sel.Where = ex
 	return nil
 }
 
+// compileArgSearch takes the search text or an object like
+// '{ query: "red shoes", column: "title_tsv", parser: "plain" }', the
+// options not set come from the search config of the table.
 func (com *Compiler) compileArgSearch(sel *Select, arg *Arg) error {
+	node := arg.Val
+	search := com.sm[sel.Table]
+
+	switch node.Type {
+	case nodeStr:
+		search.Query = node.Val
+
+	case nodeObj:
+		for _, c := range node.Children {
+			switch strings.ToLower(c.Name) {
+			case "query":
+				search.Query = c.Val
+			case "column":
+				search.Column = c.Val
+			case "language", "lang":
+				search.Lang = c.Val
+			case "parser":
+				search.Parser = c.Val
+			case "normalization":
+				search.RankNorm = c.Val
+			default:
+				return fmt.Errorf("unknown search option '%s'", c.Name)
+			}
+		}
+
+	default:
+		return fmt.Errorf("expecting a string or an object")
+	}
+
+	if len(search.Query) == 0 {
+		return fmt.Errorf("search query missing")
+	}
+
+	if err := validSearch(&search); err != nil {
+		return err
+	}
+	sel.Search = &search
+
 	ex := &Exp{
 		Op:   OpTsQuery,
 		Type: ValStr,
-		Val:  arg.Val.Val,
+		Val:  search.Query,
 	}
 
 	if sel.Where != nil {
@@ -488,6 +734,29 @@ func (com *Compiler) compileArgSearch(sel *Select, arg *Arg) error {
 	return nil
 }
 
+// validSearch checks the options that are used in the SQL as is.
+func validSearch(s *Search) error {
+	switch strings.ToLower(s.Parser) {
+	case "", "websearch", "plain", "phrase", "raw":
+	default:
+		return fmt.Errorf("unknown search parser '%s' (valid parsers: websearch, plain, phrase, raw)", s.Parser)
+	}
+
+	for _, c := range s.Lang {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_') {
+			return fmt.Errorf("invalid search language '%s'", s.Lang)
+		}
+	}
+
+	for _, c := range s.RankNorm {
+		if c < '0' || c > '9' {
+			return fmt.Errorf("search normalization has to be an integer")
+		}
+	}
+
+	return nil
+}
+
 func (com *Compiler) compileArgWhere(sel *Select, arg *Arg) error {
 	var err error
 
@@ -512,7 +781,8 @@ func (com *Compiler) compileArgOrderBy(sel *Select, arg *Arg) error {
 
 	st := util.NewStack()
 
-	for i := range arg.Val.Children {
+	// Pushed in reverse so the columns are ordered by in the order listed
+	for i := len(arg.Val.Children) - 1; i >= 0; i-- {
 		st.Push(arg.Val.Children[i])
 	}
 
@@ -533,7 +803,7 @@ func (com *Compiler) compileArgOrderBy(sel *Select, arg *Arg) error {
 		}
 
 		if node.Type == nodeObj {
-			for i := range node.Children {
+			for i := len(node.Children) - 1; i >= 0; i-- {
 				st.Push(node.Children[i])
 			}
 			continue
@@ -560,6 +830,10 @@ func (com *Compiler) compileArgOrderBy(sel *Select, arg *Arg) error {
 		}
 
 		setOrderByColName(ob, node)
+
+		if err := checkOrderByAgg(ob.Col); err != nil {
+			return err
+		}
 		sel.OrderBy = append(sel.OrderBy, ob)
 	}
 	return nil
@@ -611,8 +885,132 @@ func (com *Compiler) compileArgOffset(sel *Select, arg *Arg) error {
 	return nil
 }
 
-func compileMutate() (*Query, error) {
-	return nil, nil
+func (com *Compiler) compileArgRecursive(sel *Select, arg *Arg) error {
+	node := arg.Val
+
+	if node.Type != nodeBool {
+		return fmt.Errorf("expecting a boolean")
+	}
+
+	sel.Recursive = strings.EqualFold(node.Val, "true")
+
+	return nil
+}
+
+func (com *Compiler) compileArgDepth(sel *Select, arg *Arg) error {
+	node := arg.Val
+
+	if node.Type != nodeInt {
+		return fmt.Errorf("expecting an integer")
+	}
+
+	sel.Recursive = true
+	sel.Depth = node.Val
+
+	return nil
+}
+
+func (com *Compiler) compileArgGroupBy(sel *Select, arg *Arg) error {
+	node := arg.Val
+
+	if !sel.Aggregate {
+		return fmt.Errorf("group_by can only be used on aggregate fields like '%s%s'", sel.Table, aggSuffix)
+	}
+
+	if node.Type != nodeList && node.Type != nodeStr {
+		return fmt.Errorf("expecting a list of strings or just a string")
+	}
+
+	cols := []string{node.Val}
+	if node.Type == nodeList {
+		cols = cols[:0]
+		for i := range node.Children {
+			cols = append(cols, node.Children[i].Val)
+		}
+	}
+
+	// Blacklisted columns are skipped like in the select and the where
+	for _, c := range cols {
+		if _, ok := com.bl[strings.ToLower(c)]; !ok {
+			sel.GroupBy = append(sel.GroupBy, c)
+		}
+	}
+
+	// A row is returned for every group
+	sel.AsList = true
+
+	return nil
+}
+
+// compileAggField adds the columns for a field of an aggregate like
+// 'count', 'sum { price }' or a column listed in group_by.
+func (com *Compiler) compileAggField(sel *Select, f *Field) error {
+	fn := strings.ToLower(f.Name)
+
+	if f.Children == nil {
+		if fn == "count" {
+			sel.Cols = append(sel.Cols, &Column{Name: "*", FieldName: fieldName(f), Agg: fn})
+			return nil
+		}
+
+		for _, g := range sel.GroupBy {
+			if strings.EqualFold(g, fn) {
+				sel.Cols = append(sel.Cols, &Column{Name: fn, FieldName: fieldName(f)})
+				return nil
+			}
+		}
+
+		return fmt.Errorf("'%s' is not an aggregate function or a group_by column", f.Name)
+	}
+
+	if _, ok := aggFuncs[fn]; !ok {
+		return fmt.Errorf("unknown aggregate function '%s'", f.Name)
+	}
+
+	for _, c := range f.Children {
+		cn := strings.ToLower(c.Name)
+
+		if c.Children != nil {
+			return fmt.Errorf("expecting a column in '%s' (not '%s')", f.Name, c.Name)
+		}
+
+		if _, ok := com.bl[cn]; ok {
+			continue
+		}
+
+		sel.Cols = append(sel.Cols, &Column{Name: cn, FieldName: fieldName(c), Agg: fn})
+	}
+
+	return nil
+}
+
+func fieldName(f *Field) string {
+	if len(f.Alias) != 0 {
+		return f.Alias
+	}
+	return f.Name
+}
+
+func (com *Compiler) compileArgAction(sel *Select, arg *Arg, action Action) error {
+	if sel.ID != 0 {
+		return fmt.Errorf("%s can only be used on the root field", arg.Name)
+	}
+
+	if arg.Val.Type != nodeVar {
+		return fmt.Errorf("expecting a variable")
+	}
+
+	sel.Action = action
+	sel.ActionVar = arg.Val.Val
+
+	return nil
+}
+
+// compileMutate compiles a mutation, one without an insert argument calls
+// the function named by the root field which is checked when compiling
+// the SQL.
+func (com *Compiler) compileMutate(op *Operation) (*Query, error) {
+	return com.compileQuery(op)
 }
 
 func compileSub() (*Query, error) {
@@ -624,8 +1022,7 @@ func newExp(st *util.Stack, eT *expT) (*Exp, error) {
 	node := eT.node
 
 	if len(node.Name) == 0 {
-		pushChildren(st, eT.parent, node)
-		return nil, nil
+		return pushFields(st, eT.parent, node), nil
 	}
 
 	name := strings.ToLower(node.Name)
@@ -642,7 +1039,9 @@ func newExp(st *util.Stack, eT *expT) (*Exp, error) {
 		pushChildren(st, ex, node)
 	case "not":
 		ex.Op = OpNot
-		st.Push(&expT{ex, node.Children[0]})
+		if and := pushFields(st, ex, node); and != nil {
+			ex.Children = append(ex.Children, and)
+		}
 	case "eq", "equals":
 		ex.Op = OpEquals
 		ex.Val = node.Val
@@ -704,8 +1103,7 @@ func newExp(st *util.Stack, eT *expT) (*Exp, error) {
 		ex.Op = OpIsNull
 		ex.Val = node.Val
 	default:
-		pushChildren(st, eT.parent, node)
-		return nil, nil // skip node
+		return pushFields(st, eT.parent, node), nil // skip node
 	}
 
 	if ex.Op != OpAnd && ex.Op != OpOr && ex.Op != OpNot {
@@ -725,8 +1123,8 @@ func newExp(st *util.Stack, eT *expT) (*Exp, error) {
 		default:
 			return nil, fmt.Errorf("[Where] valid values include string, int, float, boolean and list: %s", node.Type)
 		}
-		setWhereColName(ex, node)
 	}
+	setWhereColName(ex, node.Parent)
 
 	return ex, nil
 }
@@ -749,9 +1147,13 @@ func setListVal(ex *Exp, node *Node) {
 	}
 }
 
+// setWhereColName sets the path of fields from the root of the where to
+// node, for an operator it's the column or the path to a key of a json
+// column it applies to. For 'and', 'or' and 'not' it's the object they
+// are in which can be a related table.
 func setWhereColName(ex *Exp, node *Node) {
 	var list []string
-	for n := node.Parent; n != nil; n = n.Parent {
+	for n := node; n != nil; n = n.Parent {
 		if n.Type != nodeObj {
 			continue
 		}
@@ -764,12 +1166,11 @@ func setWhereColName(ex *Exp, node *Node) {
 			list = append([]string{k}, list...)
 		}
 	}
-	if len(list) == 1 {
+	if len(list) != 0 {
 		ex.Col = list[0]
-
-	} else if len(list) > 2 {
-		ex.Col = strings.Join(list, ".")
-		ex.NestedCol = true
+	}
+	if len(list) > 1 {
+		ex.Path = list[1:]
 	}
 }
 
@@ -786,6 +1187,56 @@ func setOrderByColName(ob *OrderBy, node *Node) {
 	}
 }
 
+// checkOrderByAgg makes sure ordering by an aggregate of a related table
+// like 'purchases_aggregate.count' or 'purchases_aggregate.sum.quantity'
+// uses a known function and a single column.
+func checkOrderByAgg(col string) error {
+	p := strings.Split(col, ".")
+
+	for i := range p {
+		if !strings.HasSuffix(p[i], aggSuffix) {
+			continue
+		}
+
+		if i+1 == len(p) {
+			return fmt.Errorf("expecting an aggregate function in '%s'", p[i])
+		}
+
+		fn := p[i+1]
+
+		if _, ok := aggFuncs[fn]; !ok {
+			return fmt.Errorf("unknown aggregate function '%s'", fn)
+		}
+
+		if (fn != "count" && i+2 == len(p)) || i+3 < len(p) {
+			return fmt.Errorf("expecting a column in '%s'", fn)
+		}
+		break
+	}
+
+	return nil
+}
+
+// pushFields pushes the children of an object that is not an operator,
+// all the fields listed in an object have to match so when there is more
+// than one they are grouped under an 'and'.
+func pushFields(st *util.Stack, parent *Exp, node *Node) *Exp {
+	if node.Type != nodeObj || len(node.Children) < 2 {
+		pushChildren(st, parent, node)
+		return nil
+	}
+
+	// Pushed in reverse so they come off the stack in the order listed
+	ex := &Exp{Op: OpAnd}
+	setWhereColName(ex, node)
+
+	for i := len(node.Children) - 1; i >= 0; i-- {
+		st.Push(&expT{ex, node.Children[i]})
+	}
+
+	return ex
+}
+
 func pushChildren(st *util.Stack, ex *Exp, node *Node) {
 	for i := range node.Children {
 		st.Push(&expT{ex, node.Children[i]})
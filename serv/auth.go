@@ -6,9 +6,16 @@ import (
 	"strings"
 )
 
-var (
-	userIDProviderKey = struct{}{}
-	userIDKey         = struct{}{}
+type contextkey int
+
+const (
+	userIDProviderKey contextkey = iota
+	userIDKey
+	jwtClaimsKey
+	rateKeyKey
+	spanKey
+	metricsKey
+	roleKey
 )
 
 func headerAuth(r *http.Request, c *config) *http.Request {
@@ -19,10 +19,12 @@ func jwtHandler(next http.HandlerFunc) http.HandlerFunc {
 	var key interface{}
 	var jwtProvider int
 
+	provider := "jwt"
 	cookie := conf.Auth.Cookie
 
 	if conf.Auth.JWT.Provider == "auth0" {
 		jwtProvider = jwtAuth0
+		provider = "auth0"
 	}
 
 	secret := conf.Auth.JWT.Secret
@@ -84,6 +86,7 @@ func jwtHandler(next http.HandlerFunc) http.HandlerFunc {
 		})
 
 		if err != nil {
+			authFailures.inc(provider)
 			next.ServeHTTP(w, r)
 			return
 		}
@@ -93,14 +96,23 @@ func jwtHandler(next http.HandlerFunc) http.HandlerFunc {
 
 			if jwtProvider == jwtAuth0 {
 				sub := strings.Split(claims.Subject, "|")
-				if len(sub) != 2 {
+				if len(sub) == 2 {
 					ctx = context.WithValue(ctx, userIDProviderKey, sub[0])
 					ctx = context.WithValue(ctx, userIDKey, sub[1])
 				}
 			} else {
 				ctx = context.WithValue(ctx, userIDKey, claims.Subject)
 			}
+
+			// The verified claims as json for row level security
+			if p := strings.Split(tok, "."); len(p) == 3 {
+				if c, err := jwt.DecodeSegment(p[1]); err == nil {
+					ctx = context.WithValue(ctx, jwtClaimsKey, string(c))
+				}
+			}
+
 			next.ServeHTTP(w, r.WithContext(ctx))
+			return
 		}
 
 		next.ServeHTTP(w, r)
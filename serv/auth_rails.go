@@ -23,24 +23,8 @@ func railsRedisHandler(next http.HandlerFunc) http.HandlerFunc {
 		log.Fatal(errors.New("no auth.rails.url defined"))
 	}
 
-	rp := &redis.Pool{
-		MaxIdle:   conf.Auth.Rails.MaxIdle,
-		MaxActive: conf.Auth.Rails.MaxActive,
-		Dial: func() (redis.Conn, error) {
-			c, err := redis.DialURL(conf.Auth.Rails.URL)
-			if err != nil {
-				panic(err)
-			}
-
-			pwd := conf.Auth.Rails.Password
-			if len(pwd) != 0 {
-				if _, err := c.Do("AUTH", pwd); err != nil {
-					panic(err)
-				}
-			}
-			return c, err
-		},
-	}
+	rp := newRedisPool(conf.Auth.Rails.URL, conf.Auth.Rails.Password,
+		conf.Auth.Rails.MaxIdle, conf.Auth.Rails.MaxActive)
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		if rn := headerAuth(r, conf); rn != nil {
@@ -57,12 +41,14 @@ func railsRedisHandler(next http.HandlerFunc) http.HandlerFunc {
 		key := fmt.Sprintf("session:%s", ck.Value)
 		sessionData, err := redis.Bytes(rp.Get().Do("GET", key))
 		if err != nil {
+			authFailures.inc("rails")
 			next.ServeHTTP(w, r)
 			return
 		}
 
 		userID, err := rails.ParseCookie(string(sessionData))
 		if err != nil {
+			authFailures.inc("rails")
 			next.ServeHTTP(w, r)
 			return
 		}
@@ -72,6 +58,29 @@ func railsRedisHandler(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// newRedisPool returns a pool of connections to the redis server at url
+// that authenticate using the password when one is set.
+func newRedisPool(url, pwd string, maxIdle, maxActive int) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:   maxIdle,
+		MaxActive: maxActive,
+		Dial: func() (redis.Conn, error) {
+			c, err := redis.DialURL(url)
+			if err != nil {
+				return nil, err
+			}
+
+			if len(pwd) != 0 {
+				if _, err := c.Do("AUTH", pwd); err != nil {
+					c.Close()
+					return nil, err
+				}
+			}
+			return c, nil
+		},
+	}
+}
+
 func railsMemcacheHandler(next http.HandlerFunc) http.HandlerFunc {
 	cookie := conf.Auth.Cookie
 	if len(cookie) == 0 {
@@ -104,12 +113,14 @@ func railsMemcacheHandler(next http.HandlerFunc) http.HandlerFunc {
 		key := fmt.Sprintf("session:%s", ck.Value)
 		item, err := mc.Get(key)
 		if err != nil {
+			authFailures.inc("rails")
 			next.ServeHTTP(w, r)
 			return
 		}
 
 		userID, err := rails.ParseCookie(string(item.Value))
 		if err != nil {
+			authFailures.inc("rails")
 			next.ServeHTTP(w, r)
 			return
 		}
@@ -146,6 +157,7 @@ func railsCookieHandler(next http.HandlerFunc) http.HandlerFunc {
 		userID, err := ra.ParseCookie(ck.Value)
 		if err != nil {
 			logger.Error(err)
+			authFailures.inc("rails")
 			next.ServeHTTP(w, r)
 			return
 		}
@@ -0,0 +1,61 @@
+package serv
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func TestContextKeys(t *testing.T) {
+	ctx := context.WithValue(context.Background(), userIDKey, "5")
+	ctx = context.WithValue(ctx, userIDProviderKey, "auth0")
+
+	if v := ctx.Value(userIDKey); v != "5" {
+		t.Errorf("expected the user id got '%v'", v)
+	}
+
+	if v := ctx.Value(userIDProviderKey); v != "auth0" {
+		t.Errorf("expected the provider got '%v'", v)
+	}
+}
+
+func TestJWTHandler(t *testing.T) {
+	conf = &config{}
+	conf.Auth.JWT.Provider = "auth0"
+	conf.Auth.JWT.Secret = "secret"
+
+	tok, err := jwt.NewWithClaims(jwt.SigningMethodHS256,
+		jwt.StandardClaims{Subject: "github|42"}).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var calls int
+	var userID, provider, claims interface{}
+
+	h := jwtHandler(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		userID = r.Context().Value(userIDKey)
+		provider = r.Context().Value(userIDProviderKey)
+		claims = r.Context().Value(jwtClaimsKey)
+	})
+
+	r := httptest.NewRequest("POST", "/api/v1/graphql", nil)
+	r.Header.Set("Authorization", "Bearer "+tok)
+	h(httptest.NewRecorder(), r)
+
+	if calls != 1 {
+		t.Fatalf("expected the next handler to be called once got %d", calls)
+	}
+
+	if userID != "42" || provider != "github" {
+		t.Errorf("expected user 42 from github got '%v' from '%v'", userID, provider)
+	}
+
+	if claims != `{"sub":"github|42"}` {
+		t.Errorf("expected the claims got '%v'", claims)
+	}
+}
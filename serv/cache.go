@@ -0,0 +1,356 @@
+package serv
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dosco/super-graph/qcode"
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	// cacheChannel is the channel triggers send the name of a table to
+	// when its rows change
+	cacheChannel = "super_graph_cache"
+
+	cachePrefix = "sg:cache:"
+
+	// cacheAll is a version every result depends on, bumping it flushes
+	// the cache
+	cacheAll = "*"
+)
+
+var cache cacheStore
+
+// cacheStore holds query results along with a version for each table,
+// bumping the version of a table makes the results that read from it
+// unreachable till they expire.
+type cacheStore interface {
+	get(key string) ([]byte, error)
+	set(key string, val []byte, ttl time.Duration) error
+	versions(tables []string) ([]int64, error)
+	bump(table string) error
+}
+
+func initCache(c *config) {
+	if !c.Cache.Enable {
+		return
+	}
+
+	if len(c.Cache.URL) == 0 {
+		cache = newMemCache(c.Cache.MaxEntries)
+	} else {
+		cache = &redisCache{newRedisPool(c.Cache.URL, c.Cache.Password,
+			c.Cache.MaxIdle, c.Cache.MaxActive)}
+	}
+
+	go invalidateOnNotify()
+}
+
+// queryCached runs the statement or returns its result from the cache.
+// Results of queries are cached and a mutation invalidates the table it
+// changed.
+func queryCached(ctx context.Context, req *gqlReq, qc *qcode.QCode, stmt string) (json.RawMessage, error) {
+	if cache == nil {
+		return queryStmt(ctx, qc, stmt)
+	}
+
+	_, pcompile := getCompilers()
+
+	tables, known, err := pcompile.Tables(qc)
+	if err != nil {
+		return nil, err
+	}
+
+	if qc.Type == qcode.QTMutation {
+		root, err := queryStmt(ctx, qc, stmt)
+		if err != nil {
+			return nil, err
+		}
+
+		// A mutation calling a function can change any table
+		if qc.Query.Select.Action == qcode.ActionNone {
+			tables = []string{cacheAll}
+		}
+
+		for _, t := range tables {
+			if err := cache.bump(t); err != nil {
+				logger.Errorf("cache: %s", err)
+			}
+		}
+		return root, nil
+	}
+
+	// Results of functions can change when any table does
+	if !known {
+		return queryStmt(ctx, qc, stmt)
+	}
+
+	key, ttl, err := cacheKey(ctx, req, tables, stmt)
+	if err != nil {
+		logger.Errorf("cache: %s", err)
+	}
+
+	if ttl <= 0 || err != nil {
+		return queryStmt(ctx, qc, stmt)
+	}
+
+	if val, err := cache.get(key); err != nil {
+		logger.Errorf("cache: %s", err)
+	} else if val != nil {
+		cacheRequests.inc("hit")
+		return val, nil
+	}
+
+	cacheRequests.inc("miss")
+
+	root, err := queryStmt(ctx, qc, stmt)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cache.set(key, root, ttl); err != nil {
+		logger.Errorf("cache: %s", err)
+	}
+
+	return root, nil
+}
+
+// cacheKey returns the key for the result of the statement and how long
+// to keep it, the shortest ttl of the tables it reads from. Along with the
+// statement the key includes the user, the variables and the versions of
+// the tables.
+func cacheKey(ctx context.Context, req *gqlReq, tables []string, stmt string) (string, time.Duration, error) {
+	var ttl time.Duration
+
+	for i, t := range tables {
+		v, ok := conf.Cache.Tables[t]
+		if !ok {
+			v = conf.Cache.TTL
+		}
+
+		if d := time.Duration(v) * time.Second; i == 0 || d < ttl {
+			ttl = d
+		}
+	}
+
+	if ttl <= 0 {
+		return "", 0, nil
+	}
+
+	tables = append([]string{cacheAll}, tables...)
+
+	vers, err := cache.versions(tables)
+	if err != nil {
+		return "", 0, err
+	}
+
+	h := sha256.New()
+	io.WriteString(h, stmt)
+
+	for _, k := range []contextkey{userIDKey, userIDProviderKey, jwtClaimsKey} {
+		writeKeyPart(h, ctx.Value(k))
+	}
+
+	names := make([]string, 0, len(req.Variables))
+	for k := range req.Variables {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	for _, k := range names {
+		writeKeyPart(h, k+"="+req.Variables[k])
+	}
+
+	for i, t := range tables {
+		writeKeyPart(h, fmt.Sprintf("%s:%d", t, vers[i]))
+	}
+
+	return cachePrefix + hex.EncodeToString(h.Sum(nil)), ttl, nil
+}
+
+func writeKeyPart(h hash.Hash, v interface{}) {
+	h.Write([]byte{0})
+	if v != nil {
+		fmt.Fprint(h, v)
+	}
+}
+
+// flushCache makes all the cached results unreachable.
+func flushCache() {
+	if cache == nil {
+		return
+	}
+
+	if err := cache.bump(cacheAll); err != nil {
+		logger.Errorf("cache: %s", err)
+	}
+}
+
+// invalidateOnNotify bumps the version of the tables named in the
+// notifications sent to the cache channel, '*' flushes the cache.
+func invalidateOnNotify() {
+	ln := db.Listen(cacheChannel)
+	defer ln.Close()
+
+	for n := range ln.Channel() {
+		if err := cache.bump(strings.ToLower(n.Payload)); err != nil {
+			logger.Errorf("cache: %s", err)
+		}
+	}
+}
+
+type memEntry struct {
+	val     []byte
+	expires time.Time
+}
+
+// memCache keeps the results in memory, when full a random entry is
+// dropped to make room after removing the expired ones.
+type memCache struct {
+	sync.Mutex
+	max     int
+	entries map[string]memEntry
+	vers    map[string]int64
+}
+
+func newMemCache(max int) *memCache {
+	return &memCache{
+		max:     max,
+		entries: make(map[string]memEntry),
+		vers:    make(map[string]int64),
+	}
+}
+
+func (c *memCache) get(key string) ([]byte, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, nil
+	}
+
+	if time.Now().After(e.expires) {
+		delete(c.entries, key)
+		return nil, nil
+	}
+
+	return e.val, nil
+}
+
+func (c *memCache) set(key string, val []byte, ttl time.Duration) error {
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+
+	if c.max > 0 && len(c.entries) >= c.max {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+
+	if c.max > 0 && len(c.entries) >= c.max {
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+
+	c.entries[key] = memEntry{val, now.Add(ttl)}
+	return nil
+}
+
+func (c *memCache) versions(tables []string) ([]int64, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	vers := make([]int64, len(tables))
+
+	for i, t := range tables {
+		vers[i] = c.vers[t]
+	}
+	return vers, nil
+}
+
+func (c *memCache) bump(table string) error {
+	c.Lock()
+	c.vers[table]++
+	c.Unlock()
+
+	return nil
+}
+
+// redisCache keeps the results in redis so they are shared by all the
+// instances of Super Graph.
+type redisCache struct {
+	pool *redis.Pool
+}
+
+func (c *redisCache) get(key string) ([]byte, error) {
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	val, err := redis.Bytes(conn.Do("GET", key))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	return val, err
+}
+
+func (c *redisCache) set(key string, val []byte, ttl time.Duration) error {
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("SET", key, val, "EX", int64(ttl/time.Second))
+	return err
+}
+
+func (c *redisCache) versions(tables []string) ([]int64, error) {
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	keys := make([]interface{}, len(tables))
+
+	for i, t := range tables {
+		keys[i] = cachePrefix + "version:" + t
+	}
+
+	vals, err := redis.Values(conn.Do("MGET", keys...))
+	if err != nil {
+		return nil, err
+	}
+
+	vers := make([]int64, len(tables))
+
+	for i, v := range vals {
+		if v == nil {
+			continue
+		}
+		if vers[i], err = redis.Int64(v, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return vers, nil
+}
+
+func (c *redisCache) bump(table string) error {
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("INCR", cachePrefix+"version:"+table)
+	return err
+}
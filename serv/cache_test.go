@@ -0,0 +1,52 @@
+package serv
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCacheKeyVersions(t *testing.T) {
+	conf = &config{}
+	conf.Cache.TTL = 60
+	cache = newMemCache(10)
+	defer func() { cache = nil }()
+
+	ctx := context.Background()
+	req := &gqlReq{}
+	tables := []string{"customers", "purchases"}
+
+	key := func() string {
+		k, ttl, err := cacheKey(ctx, req, tables, "SELECT 1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ttl <= 0 {
+			t.Fatal("expecting a ttl")
+		}
+		return k
+	}
+
+	k1 := key()
+	if k := key(); k != k1 {
+		t.Fatal("expecting the same key")
+	}
+
+	// a table used only in a filter
+	cache.bump("purchases")
+	k2 := key()
+	if k2 == k1 {
+		t.Fatal("expecting a new key after a table changed")
+	}
+
+	flushCache()
+	if k := key(); k == k2 {
+		t.Fatal("expecting a new key after a flush")
+	}
+
+	cache.bump("products")
+	k3 := key()
+	cache.bump("products")
+	if k := key(); k != k3 {
+		t.Fatal("expecting the same key after an unrelated table changed")
+	}
+}
@@ -0,0 +1,264 @@
+package serv
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+// version is set when building a release using
+// -ldflags "-X github.com/dosco/super-graph/serv.version=<version>"
+var version = "dev"
+
+const usage = `Usage: super-graph [-path <config folder>] <command> [arguments]
+
+Commands:
+  serve                   start the GraphQL server (default)
+  compile                 read a GraphQL query from stdin and print the SQL
+  schema dump <file>      save the database schema to a json or yaml file
+  conf check              check the config, filters and relationships
+  migrate up              apply the pending migrations
+  migrate down [n]        roll back the last n migrations (default 1)
+  migrate status          list the migrations and if they are applied
+  migrate create <name>   add the files for a new migration
+  seed [file]             insert the data in the seed file (default ./config/seed.yml)
+  version                 print the version
+
+`
+
+// Cmd runs the command given on the command line.
+func Cmd() {
+	path := flag.String("path", "./", "Path to config files")
+
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	args := flag.Args()
+	cmd := "serve"
+
+	if len(args) != 0 {
+		cmd, args = args[0], args[1:]
+	}
+
+	var err error
+
+	switch cmd {
+	case "serve":
+		initAndListen(*path)
+
+	case "compile":
+		err = cmdCompile(*path, args)
+
+	case "schema":
+		err = cmdSchema(*path, args)
+
+	case "conf":
+		err = cmdConf(*path, args)
+
+	case "migrate":
+		err = cmdMigrate(*path, args)
+
+	case "seed":
+		err = cmdSeed(*path, args)
+
+	case "version":
+		fmt.Printf("Super Graph %s\n", version)
+
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func cmdCompile(path string, args []string) error {
+	fs := flag.NewFlagSet("compile", flag.ExitOnError)
+	userID := fs.String("user-id", "", "User id to compile the query for")
+	provider := fs.String("user-id-provider", "", "Auth provider of the user id")
+	role := fs.String("role", "", "Database role to run the query as with row level security")
+	fs.Parse(args)
+
+	if err := initAll(path); err != nil {
+		return err
+	}
+
+	query, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	if len(*userID) != 0 {
+		ctx = context.WithValue(ctx, userIDKey, *userID)
+	}
+
+	if len(*provider) != 0 {
+		ctx = context.WithValue(ctx, userIDProviderKey, *provider)
+	}
+
+	if len(*role) != 0 {
+		if !conf.DB.RLS.Enable {
+			return fmt.Errorf("the -role option needs rls enabled in the config")
+		}
+		ctx = context.WithValue(ctx, roleKey, *role)
+	}
+
+	_, stmt, err := buildStmt(ctx, string(query))
+	if err == errNoUserID {
+		return fmt.Errorf("%s, the query needs the -user-id option", err)
+	}
+	if err != nil {
+		return err
+	}
+
+	// With row level security the query runs after switching to the
+	// role and setting the session variables
+	if conf.DB.RLS.Enable {
+		var f orm.Formatter
+		r, vars := sessionVars(ctx)
+
+		if len(r) != 0 {
+			fmt.Printf("%s;\n", f.FormatQuery(nil, setRoleSQL, pg.F(r)))
+		}
+		fmt.Printf("%s;\n", f.FormatQuery(nil, setVarsSQL, vars...))
+	}
+
+	fmt.Println(stmt)
+	return nil
+}
+
+func cmdSchema(path string, args []string) error {
+	if len(args) != 2 || args[0] != "dump" {
+		return fmt.Errorf("usage: super-graph schema dump <file>")
+	}
+
+	var err error
+
+	conf, err = initConf(path)
+	if err != nil {
+		return err
+	}
+
+	db, err = initDB(conf)
+	if err != nil {
+		return err
+	}
+
+	if err := saveSchema(args[1]); err != nil {
+		return err
+	}
+
+	fmt.Printf("Schema saved to %s\n", args[1])
+	return nil
+}
+
+func cmdConf(path string, args []string) error {
+	if len(args) != 1 || args[0] != "check" {
+		return fmt.Errorf("usage: super-graph conf check")
+	}
+
+	if err := initAll(path); err != nil {
+		return err
+	}
+
+	fmt.Printf("Config for %s is valid\n", conf.Env)
+	return nil
+}
+
+func cmdMigrate(path string, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: super-graph migrate up|down [n]|status|create <name>")
+	}
+
+	var err error
+
+	conf, err = initConf(path)
+	if err != nil {
+		return err
+	}
+
+	dir := conf.DB.MigrationsPath
+
+	if args[0] == "create" {
+		if len(args) != 2 {
+			return fmt.Errorf("usage: super-graph migrate create <name>")
+		}
+		return migrateCreate(dir, args[1])
+	}
+
+	db, err = initDB(conf)
+	if err != nil {
+		return err
+	}
+
+	var n int
+
+	switch args[0] {
+	case "up":
+		n, err = migrateUp(dir)
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of migrations '%s'", args[1])
+			}
+		}
+		n, err = migrateDown(dir, steps)
+
+	case "status":
+		return migrateStatus(os.Stdout, dir)
+
+	default:
+		return fmt.Errorf("unknown migrate command '%s'", args[0])
+	}
+
+	// Migrations that ran before one failed still changed the schema,
+	// a failed migration is reported before a failed notification
+	if n != 0 {
+		if nerr := notifySchemaChange(); nerr != nil {
+			if err != nil {
+				return fmt.Errorf("%s (notifying the schema change also failed: %s)", err, nerr)
+			}
+			return nerr
+		}
+	}
+
+	if err == nil && n == 0 {
+		fmt.Println("no migrations to run")
+	}
+
+	return err
+}
+
+func cmdSeed(path string, args []string) error {
+	file := "./config/seed.yml"
+
+	if len(args) > 1 {
+		return fmt.Errorf("usage: super-graph seed [file]")
+	}
+
+	if len(args) == 1 {
+		file = args[0]
+	}
+
+	if err := initAll(path); err != nil {
+		return err
+	}
+
+	return runSeed(file)
+}
@@ -1,16 +1,22 @@
 package serv
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/dosco/super-graph/psql"
 	"github.com/dosco/super-graph/qcode"
 	"github.com/go-pg/pg"
 	"github.com/gorilla/websocket"
@@ -32,6 +38,9 @@ type gqlReq struct {
 	OpName    string            `json:"operationName"`
 	Query     string            `json:"query"`
 	Variables map[string]string `json:"variables"`
+
+	// set for GET requests which cannot run mutations
+	readOnly bool
 }
 
 type gqlResp struct {
@@ -61,7 +70,7 @@ type resolver struct {
 	ParentType  string        `json:"parentType"`
 	FieldName   string        `json:"fieldName"`
 	ReturnType  string        `json:"returnType"`
-	StartOffset int           `json:"startOffset"`
+	StartOffset time.Duration `json:"startOffset"`
 	Duration    time.Duration `json:"duration"`
 }
 
@@ -73,80 +82,258 @@ func apiv1Http(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	b, err := ioutil.ReadAll(r.Body)
-	defer r.Body.Close()
-	if err != nil {
-		errorResp(w, err)
-		return
-	}
-
 	req := &gqlReq{}
-	if err := json.Unmarshal(b, req); err != nil {
-		errorResp(w, err)
-		return
-	}
 
-	if strings.EqualFold(req.OpName, introspectionQuery) {
-		dat, err := ioutil.ReadFile("test.schema")
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		req.OpName = q.Get("operationName")
+		setOpName(ctx, req.OpName)
+		req.Query = q.Get("query")
+		req.readOnly = true
+
+		if v := q.Get("variables"); len(v) != 0 {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				errorResp(w, err)
+				return
+			}
+		}
+
+	case http.MethodPost:
+		b, err := ioutil.ReadAll(r.Body)
+		defer r.Body.Close()
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			errorResp(w, err)
+			return
+		}
+
+		if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt == "application/graphql" {
+			req.Query = string(b)
+			break
+		}
+
+		if b = bytes.TrimSpace(b); len(b) != 0 && b[0] == '[' {
+			setOpName(ctx, batchOpName)
+			apiv1Batch(ctx, w, b)
 			return
 		}
-		w.Write(dat)
+
+		if err := json.Unmarshal(b, req); err != nil {
+			errorResp(w, err)
+			return
+		}
+		setOpName(ctx, req.OpName)
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	qc, err := qcompile.CompileQuery(req.Query)
-	if err != nil {
+	res, status, err := execReq(ctx, req)
+
+	switch {
+	case err == nil:
+	case status == http.StatusBadRequest:
 		errorResp(w, err)
 		return
+	case status == http.StatusTooManyRequests:
+		w.Header().Set("Retry-After", retryAfter(err.(*rateLimitError).retry))
+		http.Error(w, err.Error(), status)
+		return
+	default:
+		http.Error(w, err.Error(), status)
+		return
 	}
 
-	var sqlStmt strings.Builder
+	w.Header().Set("Content-Type", "application/json")
+
+	if req.readOnly && cacheHeaders(w, r, req, res) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Write(res)
+}
+
+// cacheHeaders sets the headers that let browsers and CDNs cache the
+// response to a GET request, it returns true when the copy the client
+// has is still valid.
+func cacheHeaders(w http.ResponseWriter, r *http.Request, req *gqlReq, res []byte) bool {
+	cc := conf.CacheControl.Default
+
+	if v, ok := conf.CacheControl.Operations[strings.ToLower(req.OpName)]; ok {
+		cc = v
+	}
+
+	if len(cc) != 0 {
+		w.Header().Set("Cache-Control", cc)
+	}
+
+	// The trace in the extensions changes with every request so the
+	// etag is only over the data for it to match
+	if conf.EnableTracing {
+		var resp gqlResp
+		if err := json.Unmarshal(res, &resp); err == nil {
+			res = resp.Data
+		}
+	}
+
+	sum := sha1.Sum(res)
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+
+	w.Header().Set("ETag", etag)
+	w.Header().Add("Vary", "Authorization, Cookie")
+
+	for _, v := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		v = strings.TrimPrefix(strings.TrimSpace(v), "W/")
+		if v == etag || v == "*" {
+			return true
+		}
+	}
 
-	if err := pcompile.Compile(&sqlStmt, qc); err != nil {
+	return false
+}
+
+// apiv1Batch runs the operations of a batch request concurrently and
+// replies with their responses in the same order. An operation that
+// fails gets a response with the error and does not fail the others.
+func apiv1Batch(ctx context.Context, w http.ResponseWriter, b []byte) {
+	var reqs []*gqlReq
+
+	if err := json.Unmarshal(b, &reqs); err != nil {
 		errorResp(w, err)
 		return
 	}
 
-	t := fasttemplate.New(sqlStmt.String(), openVar, closeVar)
-	sqlStmt.Reset()
+	if max := conf.Batch.MaxOperations; max > 0 && len(reqs) > max {
+		errorResp(w, fmt.Errorf("batch has %d operations, the limit is %d", len(reqs), max))
+		return
+	}
 
-	_, err = t.Execute(&sqlStmt, varValues(ctx))
+	n := conf.Batch.Concurrency
+	if n < 1 {
+		n = 1
+	}
+
+	res := make([]json.RawMessage, len(reqs))
+	sem := make(chan struct{}, n)
+
+	var wg sync.WaitGroup
+
+	for i := range reqs {
+		if reqs[i] == nil {
+			res[i], _ = json.Marshal(gqlResp{Error: "operation missing"})
+			continue
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(i int) {
+			defer func() { <-sem; wg.Done() }()
+
+			// net/http does not recover panics in goroutines it did
+			// not start, one would take down the server
+			defer func() {
+				if r := recover(); r != nil {
+					logger.Errorf("batch operation %d: %v", i, r)
+					res[i], _ = json.Marshal(gqlResp{Error: "internal error"})
+				}
+			}()
+
+			data, _, err := execReq(ctx, reqs[i])
+			if err != nil {
+				data, _ = json.Marshal(gqlResp{Error: err.Error()})
+			}
+			res[i] = data
+		}(i)
+	}
+
+	wg.Wait()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// execReq runs a single operation and returns the response, on error
+// the status is the one to reply with when it's not part of a batch.
+func execReq(ctx context.Context, req *gqlReq) (res json.RawMessage, status int, err error) {
+	st := time.Now()
+
+	ctx, sp := startSpan(ctx, "graphql.operation")
+	sp.setAttr("graphql.operation.name", req.OpName)
+
+	defer func() {
+		sp.setError(err)
+		sp.finish()
+	}()
+
+	if err := checkRateLimit(ctx); err != nil {
+		return nil, http.StatusTooManyRequests, err
+	}
+
+	if strings.EqualFold(req.OpName, introspectionQuery) {
+		dat, err := introspection()
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		return dat, http.StatusOK, nil
+	}
+
+	qc, finalSQL, err := buildStmt(ctx, req.Query)
 	if err == errNoUserID &&
 		authFailBlock == authFailBlockPerQuery &&
 		authCheck(ctx) == false {
-		http.Error(w, "Not authorized", 401)
-		return
+		return nil, http.StatusUnauthorized, errors.New("Not authorized")
 	}
 	if err != nil {
-		errorResp(w, err)
-		return
+		return nil, http.StatusBadRequest, err
+	}
+
+	if req.readOnly && qc.Type == qcode.QTMutation {
+		return nil, http.StatusMethodNotAllowed, errors.New("mutations need a POST request")
+	}
+
+	if err := checkQueryCost(ctx, qc); err != nil {
+		return nil, http.StatusTooManyRequests, err
 	}
 
-	finalSQL := sqlStmt.String()
 	if conf.DebugLevel > 0 {
 		fmt.Println(finalSQL)
 	}
-	st := time.Now()
-
-	var root json.RawMessage
-	_, err = db.Query(pg.Scan(&root), finalSQL)
+	dst := time.Now()
 
+	root, err := queryCached(ctx, req, qc, finalSQL)
 	if err != nil {
-		errorResp(w, err)
-		return
+		return nil, http.StatusBadRequest, err
 	}
 
-	et := time.Now()
+	det := time.Now()
 	resp := gqlResp{}
 
 	if conf.EnableTracing {
-		resp.Extensions = &extensions{newTrace(st, et, qc)}
+		var plan map[string]planTime
+
+		if conf.Tracing.Explain && qc.Type == qcode.QTQuery {
+			if plan, err = explainStmt(ctx, qc, finalSQL); err != nil {
+				logger.Errorf("explain: %s", err)
+			}
+		}
+		resp.Extensions = &extensions{newTrace(st, dst, det, qc, plan)}
 	}
 
 	resp.Data = json.RawMessage(root)
-	json.NewEncoder(w).Encode(resp)
+
+	_, jsp := startSpan(ctx, "json.write")
+	res, err = json.Marshal(resp)
+	jsp.finish()
+
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return res, http.StatusOK, nil
 }
 
 /*
@@ -181,15 +368,181 @@ func serve(w http.ResponseWriter, r *http.Request) {
 }
 */
 
+// buildStmt compiles the query to SQL and fills in the values of the
+// session variables like the user id.
+func buildStmt(ctx context.Context, query string) (*qcode.QCode, string, error) {
+	qcompile, pcompile := getCompilers()
+
+	defer func(st time.Time) {
+		compileDuration.observe(time.Since(st).Seconds())
+	}(time.Now())
+
+	qc, err := qcompile.CompileQueryPhases(query, phaseSpans(ctx))
+	if err != nil {
+		return nil, "", err
+	}
+
+	if qc.Type == qcode.QTMutation && qc.Query.Select.Action != qcode.ActionNone {
+		return nil, "", errors.New("only mutations calling a function are supported")
+	}
+
+	if qc.Type == qcode.QTMutation && !authCheck(ctx) && !anonMutation(qc.Query.Select) {
+		return nil, "", errNoUserID
+	}
+
+	_, sp := startSpan(ctx, "sql.compile")
+	defer sp.finish()
+
+	return compileStmt(ctx, qc, pcompile, nil)
+}
+
+func compileStmt(ctx context.Context, qc *qcode.QCode, pcompile *psql.Compiler,
+	vars map[string]json.RawMessage) (*qcode.QCode, string, error) {
+
+	var sqlStmt strings.Builder
+
+	if err := pcompile.CompileVars(&sqlStmt, qc, vars); err != nil {
+		return nil, "", err
+	}
+
+	t, err := fasttemplate.NewTemplate(sqlStmt.String(), openVar, closeVar)
+	if err != nil {
+		return nil, "", err
+	}
+	sqlStmt.Reset()
+
+	if _, err := t.Execute(&sqlStmt, varValues(ctx)); err != nil {
+		return qc, "", err
+	}
+
+	return qc, sqlStmt.String(), nil
+}
+
+// queryStmt runs the statement, a mutation or any statement when row
+// level security is enabled runs in a transaction with the session
+// variables set so the functions and policies can read them like
+// current_setting('sg.user_id', true).
+func queryStmt(ctx context.Context, qc *qcode.QCode, stmt string) (json.RawMessage, error) {
+	_, sp := startSpan(ctx, "db.execute")
+	sp.setKind(spanKindClient)
+	sp.setAttr("db.system", "postgresql")
+
+	if conf.DebugLevel > 0 {
+		sp.setAttr("db.statement", stmt)
+	}
+
+	defer func(st time.Time) {
+		dbDuration.observe(time.Since(st).Seconds())
+		sp.finish()
+	}(time.Now())
+
+	root, err := runStmt(ctx, qc, stmt)
+	sp.setError(err)
+
+	return root, err
+}
+
+func runStmt(ctx context.Context, qc *qcode.QCode, stmt string) (json.RawMessage, error) {
+	var root json.RawMessage
+
+	if qc.Type != qcode.QTMutation && !conf.DB.RLS.Enable {
+		_, err := db.Query(pg.Scan(&root), stmt)
+		return root, err
+	}
+
+	err := db.RunInTransaction(func(tx *pg.Tx) error {
+		if err := setSessionVars(ctx, tx); err != nil {
+			return err
+		}
+		_, err := tx.Query(pg.Scan(&root), stmt)
+		return err
+	})
+
+	return root, err
+}
+
+const (
+	setRoleSQL = `SET LOCAL ROLE ?`
+	setVarsSQL = `SELECT set_config('sg.user_id', ?, true), set_config('sg.user_id_provider', ?, true), set_config('request.jwt.claims', ?, true)`
+)
+
+// setSessionVars sets the user id, its provider and the jwt claims for
+// the rest of the transaction, they are empty when the request is not
+// authenticated. With row level security enabled it also switches to the
+// role for the user or the one for anonymous requests.
+func setSessionVars(ctx context.Context, tx *pg.Tx) error {
+	role, vars := sessionVars(ctx)
+
+	if len(role) != 0 {
+		if _, err := tx.Exec(setRoleSQL, pg.F(role)); err != nil {
+			return err
+		}
+	}
+
+	_, err := tx.Exec(setVarsSQL, vars...)
+	return err
+}
+
+// sessionVars returns the role to switch to, if any, and the values for
+// the session variables. A role in the context set by the compile command
+// takes the place of the one in the config.
+func sessionVars(ctx context.Context) (string, []interface{}) {
+	var role, userID, provider, claims string
+
+	if v := ctx.Value(userIDKey); v != nil {
+		userID = v.(string)
+	}
+
+	if v := ctx.Value(userIDProviderKey); v != nil {
+		provider = v.(string)
+	}
+
+	if v := ctx.Value(jwtClaimsKey); v != nil {
+		claims = v.(string)
+	}
+
+	rls := conf.DB.RLS
+
+	if rls.Enable {
+		role = rls.Role
+		if len(userID) == 0 && len(rls.AnonRole) != 0 {
+			role = rls.AnonRole
+		}
+
+		if v, ok := ctx.Value(roleKey).(string); ok {
+			role = v
+		}
+	}
+
+	return role, []interface{}{userID, provider, claims}
+}
+
 func errorResp(w http.ResponseWriter, err error) {
-	b, _ := json.Marshal(gqlResp{Error: err.Error()})
-	http.Error(w, string(b), http.StatusBadRequest)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(gqlResp{Error: err.Error()})
 }
 
 func authCheck(ctx context.Context) bool {
 	return (ctx.Value(userIDKey) != nil)
 }
 
+// anonMutation returns true when the config allows anonymous users to
+// call the function of the mutation.
+func anonMutation(sel *qcode.Select) bool {
+	name := sel.Singular
+	if sel.AsList {
+		name = sel.Table
+	}
+
+	for _, m := range conf.DB.Mutations {
+		if strings.EqualFold(m.Name, name) {
+			return m.Anonymous
+		}
+	}
+	return false
+}
+
 func varValues(ctx context.Context) map[string]interface{} {
 	uidFn := fasttemplate.TagFunc(func(w io.Writer, _ string) (int, error) {
 		if v := ctx.Value(userIDKey); v != nil {
@@ -213,27 +566,117 @@ func varValues(ctx context.Context) map[string]interface{} {
 	}
 }
 
-func newTrace(st, et time.Time, qc *qcode.QCode) *trace {
-	du := et.Sub(et)
-
+// newTrace returns the apollo tracing extension for an operation that
+// started at st with the database running the statement from dst to det.
+// All the selects are run by the one statement so they share its timing
+// unless the plan has the time taken by a select.
+func newTrace(st, dst, det time.Time, qc *qcode.QCode, plan map[string]planTime) *trace {
 	t := &trace{
 		Version:   1,
 		StartTime: st,
-		EndTime:   et,
-		Duration:  du,
-		Execution: execution{
-			[]resolver{
-				resolver{
-					Path:        []string{qc.Query.Select.Table},
-					ParentType:  "Query",
-					FieldName:   qc.Query.Select.Table,
-					ReturnType:  "object",
-					StartOffset: 1,
-					Duration:    du,
-				},
-			},
-		},
+		EndTime:   det,
+		Duration:  det.Sub(st),
+	}
+
+	parent := "Query"
+	if qc.Type == qcode.QTMutation {
+		parent = "Mutation"
 	}
 
+	var add func(sel *qcode.Select, path []string, parent string)
+
+	add = func(sel *qcode.Select, path []string, parent string) {
+		path = append(path[:len(path):len(path)], sel.FieldName)
+
+		r := resolver{
+			Path:        path,
+			ParentType:  parent,
+			FieldName:   sel.FieldName,
+			ReturnType:  sel.Table,
+			StartOffset: dst.Sub(st),
+			Duration:    det.Sub(dst),
+		}
+
+		if sel.AsList {
+			r.ReturnType = "[" + sel.Table + "]"
+		}
+
+		if pt, ok := plan[fmt.Sprintf("%s_%d", sel.Table, sel.ID)]; ok {
+			r.StartOffset += pt.start
+			r.Duration = pt.total
+		}
+
+		t.Execution.Resolvers = append(t.Execution.Resolvers, r)
+
+		for _, s := range sel.Joins {
+			add(s, path, sel.Table)
+		}
+	}
+
+	add(qc.Query.Select, nil, parent)
+
 	return t
 }
+
+// planTime is when a node of the query plan started returning rows and
+// the time it took, both from EXPLAIN ANALYZE.
+type planTime struct {
+	start time.Duration
+	total time.Duration
+}
+
+type planNode struct {
+	Alias       string     `json:"Alias"`
+	StartupTime float64    `json:"Actual Startup Time"`
+	TotalTime   float64    `json:"Actual Total Time"`
+	Loops       float64    `json:"Actual Loops"`
+	Plans       []planNode `json:"Plans"`
+}
+
+// explainStmt runs the statement again with EXPLAIN ANALYZE and returns
+// the time taken by each select keyed by its alias like products_1. It
+// doubles the work done by the database so it's meant for development.
+func explainStmt(ctx context.Context, qc *qcode.QCode, stmt string) (map[string]planTime, error) {
+	_, sp := startSpan(ctx, "db.explain")
+	defer sp.finish()
+
+	res, err := runStmt(ctx, qc, "EXPLAIN (ANALYZE, FORMAT JSON) "+stmt)
+	if err != nil {
+		return nil, err
+	}
+
+	var ex []struct {
+		Plan planNode `json:"Plan"`
+	}
+
+	if err := json.Unmarshal(res, &ex); err != nil {
+		return nil, err
+	}
+
+	if len(ex) == 0 {
+		return nil, nil
+	}
+
+	ms := func(v float64) time.Duration {
+		return time.Duration(v * float64(time.Millisecond))
+	}
+
+	plan := make(map[string]planTime)
+
+	var walk func(n *planNode)
+
+	walk = func(n *planNode) {
+		// the outermost node with the alias of a select covers all of it
+		if _, ok := plan[n.Alias]; !ok && len(n.Alias) != 0 {
+			plan[n.Alias] = planTime{ms(n.StartupTime), ms(n.TotalTime * n.Loops)}
+		}
+
+		for i := range n.Plans {
+			walk(&n.Plans[i])
+		}
+	}
+
+	walk(&ex[0].Plan)
+
+	return plan, nil
+}
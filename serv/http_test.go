@@ -0,0 +1,231 @@
+package serv
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dosco/super-graph/psql"
+	"github.com/dosco/super-graph/qcode"
+)
+
+func TestCacheHeaders(t *testing.T) {
+	conf = &config{}
+	conf.CacheControl.Default = "public, max-age=60"
+	conf.CacheControl.Operations = map[string]string{"me": "private, max-age=10"}
+
+	res := []byte(`{"data":{"products":[]}}`)
+
+	r := httptest.NewRequest("GET", "/api/v1/graphql", nil)
+	w := httptest.NewRecorder()
+
+	if cacheHeaders(w, r, &gqlReq{OpName: "products"}, res) {
+		t.Fatal("expected no match without If-None-Match")
+	}
+
+	etag := w.Header().Get("ETag")
+	if len(etag) == 0 {
+		t.Fatal("expected an etag")
+	}
+
+	if v := w.Header().Get("Cache-Control"); v != "public, max-age=60" {
+		t.Errorf("expected the default cache-control got '%s'", v)
+	}
+
+	for _, inm := range []string{etag, "W/" + etag, `"other", ` + etag, "*"} {
+		r.Header.Set("If-None-Match", inm)
+
+		if !cacheHeaders(httptest.NewRecorder(), r, &gqlReq{OpName: "products"}, res) {
+			t.Errorf("expected a match for If-None-Match: %s", inm)
+		}
+	}
+
+	r.Header.Set("If-None-Match", `"other"`)
+	w = httptest.NewRecorder()
+
+	if cacheHeaders(w, r, &gqlReq{OpName: "Me"}, res) {
+		t.Error("expected no match for another etag")
+	}
+
+	if v := w.Header().Get("Cache-Control"); v != "private, max-age=10" {
+		t.Errorf("expected the cache-control of the operation got '%s'", v)
+	}
+}
+
+func TestCacheHeadersTracing(t *testing.T) {
+	conf = &config{}
+	conf.EnableTracing = true
+
+	res1 := []byte(`{"data":{"products":[]},"extensions":{"tracing":{"startTime":"2019-06-04T19:53:31Z","duration":1}}}`)
+	res2 := []byte(`{"data":{"products":[]},"extensions":{"tracing":{"startTime":"2019-06-04T19:53:32Z","duration":2}}}`)
+
+	r := httptest.NewRequest("GET", "/api/v1/graphql", nil)
+	w := httptest.NewRecorder()
+	cacheHeaders(w, r, &gqlReq{}, res1)
+
+	r.Header.Set("If-None-Match", w.Header().Get("ETag"))
+
+	if !cacheHeaders(httptest.NewRecorder(), r, &gqlReq{}, res2) {
+		t.Error("expected a match when only the trace changed")
+	}
+
+	res3 := []byte(`{"data":{"products":[{"id":1}]},"extensions":{"tracing":{"startTime":"2019-06-04T19:53:31Z","duration":1}}}`)
+
+	if cacheHeaders(httptest.NewRecorder(), r, &gqlReq{}, res3) {
+		t.Error("expected no match when the data changed")
+	}
+}
+
+func TestSessionVars(t *testing.T) {
+	conf = &config{}
+	conf.DB.RLS.Enable = true
+	conf.DB.RLS.Role = "app_user"
+	conf.DB.RLS.AnonRole = "app_anon"
+
+	ctx := context.Background()
+
+	if role, _ := sessionVars(ctx); role != "app_anon" {
+		t.Errorf("expected the anonymous role got '%s'", role)
+	}
+
+	ctx = context.WithValue(ctx, userIDKey, "5")
+	ctx = context.WithValue(ctx, userIDProviderKey, "auth0")
+
+	role, vars := sessionVars(ctx)
+	if role != "app_user" {
+		t.Errorf("expected the user role got '%s'", role)
+	}
+
+	if !reflect.DeepEqual(vars, []interface{}{"5", "auth0", ""}) {
+		t.Errorf("expected the user id and provider got %v", vars)
+	}
+
+	if role, _ := sessionVars(context.WithValue(ctx, roleKey, "admin")); role != "admin" {
+		t.Errorf("expected the role from the context got '%s'", role)
+	}
+
+	conf.DB.RLS.Enable = false
+
+	if role, _ := sessionVars(context.WithValue(ctx, roleKey, "admin")); role != "" {
+		t.Errorf("expected no role without rls got '%s'", role)
+	}
+}
+
+// initTestCompilers sets compilers for a schema with a products table
+// and a checkout mutation, there is no database so running a query panics.
+func initTestCompilers(t *testing.T) {
+	snap := &psql.Snapshot{
+		Tables: []*psql.SnapshotTable{
+			{Name: "products", Type: "table", Columns: []*psql.DBColumn{
+				{ID: 1, Name: "id", Type: "bigint", NotNull: true, PrimaryKey: true},
+				{ID: 2, Name: "name", Type: "character varying"},
+			}},
+		},
+		Functions: []*psql.DBTableFunc{
+			{Name: "checkout", Table: "products", ArgNames: []string{"cart_id"},
+				ArgTypes: []string{"bigint"}, Volatile: true},
+		},
+	}
+
+	qc, err := qcode.NewCompiler(qcode.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setCompilers(qc, psql.NewCompiler(psql.Config{
+		Schema:    snap.Schema(),
+		Mutations: []string{"checkout"},
+	}))
+}
+
+func TestMutationAuth(t *testing.T) {
+	conf = &config{}
+	initTestCompilers(t)
+
+	query := `mutation { checkout(cart_id: 5) { id } }`
+	ctx := context.Background()
+
+	if _, _, err := buildStmt(ctx, query); err != errNoUserID {
+		t.Errorf("expected anonymous users to be rejected got %v", err)
+	}
+
+	if _, _, err := buildStmt(context.WithValue(ctx, userIDKey, "5"), query); err != nil {
+		t.Error(err)
+	}
+
+	conf.DB.Mutations = append(conf.DB.Mutations, struct {
+		Name      string
+		Anonymous bool
+	}{"checkout", true})
+
+	if _, _, err := buildStmt(ctx, query); err != nil {
+		t.Errorf("expected anonymous users to be allowed got %v", err)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	conf = &config{}
+	conf.Batch.Concurrency = 2
+	conf.Batch.MaxOperations = 4
+
+	logger = initLog()
+	logger.Out = ioutil.Discard
+
+	initTestCompilers(t)
+
+	batch := func(b string) []string {
+		w := httptest.NewRecorder()
+		apiv1Batch(context.Background(), w, []byte(b))
+
+		if w.Code != 200 {
+			t.Fatalf("expected 200 got %d: %s", w.Code, w.Body.String())
+		}
+
+		var res []json.RawMessage
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+
+		out := make([]string, len(res))
+		for i := range res {
+			out[i] = string(res[i])
+		}
+		return out
+	}
+
+	// Each operation gets its own error in the order sent
+	res := batch(`[{"query":"{ foos { id } }"}, null, {"query":"{ bars { id } }"}]`)
+
+	if len(res) != 3 ||
+		!strings.Contains(res[0], "foos") ||
+		!strings.Contains(res[1], "operation missing") ||
+		!strings.Contains(res[2], "bars") {
+		t.Errorf("expected an error for each operation in order got %v", res)
+	}
+
+	// Template tags in values do not break compiling the statement
+	res = batch(`[{"query":"{ products(where: { name: { eq: \"{{\" } }) { id } }"}]`)
+
+	if len(res) != 1 || !strings.Contains(res[0], "error") {
+		t.Errorf("expected an error got %v", res)
+	}
+
+	// Without a database running the query panics, this must not stop
+	// the other operations or the server
+	res = batch(`[{"query":"{ products { id } }"}, {"query":"{ bars { id } }"}]`)
+
+	if len(res) != 2 || !strings.Contains(res[0], "internal error") || !strings.Contains(res[1], "bars") {
+		t.Errorf("expected an error for each operation got %v", res)
+	}
+
+	w := httptest.NewRecorder()
+	apiv1Batch(context.Background(), w, []byte(`[{}, {}, {}, {}, {}]`))
+
+	if w.Code != 400 || !strings.Contains(w.Body.String(), "the limit is 4") {
+		t.Errorf("expected the batch to be over the limit got %d: %s", w.Code, w.Body.String())
+	}
+}
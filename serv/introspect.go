@@ -0,0 +1,94 @@
+package serv
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+
+	"github.com/dosco/super-graph/psql"
+	"github.com/gobuffalo/flect"
+)
+
+// introspection returns the introspection response from the schema file
+// with the computed fields added to the types of their tables.
+func introspection() ([]byte, error) {
+	dat, err := ioutil.ReadFile("test.schema")
+	if err != nil {
+		return nil, err
+	}
+
+	_, pcompile := getCompilers()
+
+	cf := pcompile.ComputedFields()
+	if len(cf) == 0 {
+		return dat, nil
+	}
+
+	return addComputedFields(dat, cf)
+}
+
+// addComputedFields adds the fields to the object types named after their
+// tables like 'User' or 'users', fields already in the type are skipped.
+func addComputedFields(dat []byte, cf []psql.ComputedField) ([]byte, error) {
+	var res map[string]interface{}
+
+	if err := json.Unmarshal(dat, &res); err != nil {
+		return nil, err
+	}
+
+	schema := res
+	if d, ok := res["data"].(map[string]interface{}); ok {
+		schema = d
+	}
+
+	s, ok := schema["__schema"].(map[string]interface{})
+	if !ok {
+		return dat, nil
+	}
+
+	types, _ := s["types"].([]interface{})
+
+	for _, t := range types {
+		typ, ok := t.(map[string]interface{})
+		if !ok || typ["kind"] != "OBJECT" {
+			continue
+		}
+
+		name, _ := typ["name"].(string)
+		fields, _ := typ["fields"].([]interface{})
+
+		for _, f := range cf {
+			if !typeOfTable(name, f.Table) || hasField(fields, f.Name) {
+				continue
+			}
+
+			fields = append(fields, map[string]interface{}{
+				"name":              f.Name,
+				"description":       nil,
+				"args":              []interface{}{},
+				"type":              map[string]interface{}{"kind": "SCALAR", "name": f.Type, "ofType": nil},
+				"isDeprecated":      false,
+				"deprecationReason": nil,
+			})
+		}
+
+		typ["fields"] = fields
+	}
+
+	return json.Marshal(res)
+}
+
+func typeOfTable(name, table string) bool {
+	return strings.EqualFold(name, table) ||
+		strings.EqualFold(name, flect.Pascalize(flect.Singularize(table))) ||
+		strings.EqualFold(name, flect.Pascalize(table))
+}
+
+func hasField(fields []interface{}, name string) bool {
+	for _, f := range fields {
+		if m, ok := f.(map[string]interface{}); ok && m["name"] == name {
+			return true
+		}
+	}
+	return false
+}
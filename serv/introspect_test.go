@@ -0,0 +1,59 @@
+package serv
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/dosco/super-graph/psql"
+)
+
+func TestAddComputedFields(t *testing.T) {
+	dat := []byte(`{"data":{"__schema":{"types":[
+		{"kind":"OBJECT","name":"User","fields":[{"name":"id"}]},
+		{"kind":"OBJECT","name":"products","fields":[{"name":"id"},{"name":"discount"}]},
+		{"kind":"INPUT_OBJECT","name":"UserInput","fields":null}
+	]}}}`)
+
+	cf := []psql.ComputedField{
+		{Table: "products", Name: "discount", Type: "Float"},
+		{Table: "users", Name: "display_name", Type: "String"},
+	}
+
+	out, err := addComputedFields(dat, cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var res struct {
+		Data struct {
+			Schema struct {
+				Types []struct {
+					Name   string
+					Fields []struct {
+						Name string
+						Type struct{ Kind, Name string }
+					}
+				}
+			} `json:"__schema"`
+		}
+	}
+
+	if err := json.Unmarshal(out, &res); err != nil {
+		t.Fatal(err)
+	}
+
+	types := res.Data.Schema.Types
+
+	if f := types[0].Fields; len(f) != 2 || f[1].Name != "display_name" ||
+		f[1].Type.Kind != "SCALAR" || f[1].Type.Name != "String" {
+		t.Errorf("expecting display_name on User got %+v", f)
+	}
+
+	if f := types[1].Fields; len(f) != 2 {
+		t.Errorf("expecting discount not to be added twice got %+v", f)
+	}
+
+	if f := types[2].Fields; len(f) != 0 {
+		t.Errorf("expecting no fields on input types got %+v", f)
+	}
+}
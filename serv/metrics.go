@@ -0,0 +1,331 @@
+package serv
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// metricsMaxOps is the number of operation names tracked, requests
+	// for more are counted under 'other'
+	metricsMaxOps = 500
+
+	// batchOpName is the operation name batch requests are counted under
+	batchOpName = "batch"
+)
+
+// Buckets in seconds for the request, compile and database durations
+var durationBuckets = []float64{
+	.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var (
+	requestsTotal = newCounterVec("super_graph_requests_total",
+		"Requests handled by operation name and status", "operation", "status")
+
+	requestDuration = newHistogramVec("super_graph_request_duration_seconds",
+		"Time taken by a request from reading it to the response", "operation", "status")
+
+	compileDuration = newHistogramVec("super_graph_compile_duration_seconds",
+		"Time taken to compile GraphQL to SQL")
+
+	dbDuration = newHistogramVec("super_graph_db_duration_seconds",
+		"Time taken by the database to run the SQL")
+
+	authFailures = newCounterVec("super_graph_auth_failures_total",
+		"Requests with credentials that failed to authenticate", "provider")
+
+	cacheRequests = newCounterVec("super_graph_cache_requests_total",
+		"Lookups of query results in the cache by result", "result")
+
+	opNames sync.Map
+	opCount int64
+	opMu    sync.Mutex
+)
+
+// reqMetrics is what the handlers learn about a request that is recorded
+// once the response is sent.
+type reqMetrics struct {
+	opName string
+}
+
+// withMetrics records every request including the ones rejected before
+// the query runs like those failing auth or using the wrong method.
+func withMetrics(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		st := time.Now()
+		m := &reqMetrics{}
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next(sw, r.WithContext(context.WithValue(r.Context(), metricsKey, m)))
+
+		observeRequest(m.opName, sw.status, time.Since(st))
+	}
+}
+
+// setOpName sets the operation name the request is recorded under.
+func setOpName(ctx context.Context, name string) {
+	if m, ok := ctx.Value(metricsKey).(*reqMetrics); ok {
+		m.opName = name
+	}
+}
+
+// observeRequest records a request with the status sent.
+func observeRequest(opName string, status int, d time.Duration) {
+	op := opLabel(opName)
+	st := strconv.Itoa(status)
+
+	requestsTotal.inc(op, st)
+	requestDuration.observe(d.Seconds(), op, st)
+}
+
+// opLabel limits the number of operation names so clients cannot add
+// any number of series by naming their operations.
+func opLabel(name string) string {
+	if len(name) == 0 {
+		return "anonymous"
+	}
+
+	if _, ok := opNames.Load(name); ok {
+		return name
+	}
+
+	opMu.Lock()
+	defer opMu.Unlock()
+
+	if _, ok := opNames.Load(name); ok {
+		return name
+	}
+
+	if opCount >= metricsMaxOps {
+		return "other"
+	}
+
+	opNames.Store(name, struct{}{})
+	opCount++
+
+	return name
+}
+
+// metricsHandler writes the metrics in the Prometheus text format, when a
+// token is set it has to be sent in the 'Authorization: Bearer' header.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if t := conf.Metrics.Token; len(t) != 0 {
+		ah := r.Header.Get(authHeader)
+		if subtle.ConstantTimeCompare([]byte(ah), []byte("Bearer "+t)) != 1 {
+			http.Error(w, "Not authorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	requestsTotal.write(w)
+	requestDuration.write(w)
+	compileDuration.write(w)
+	dbDuration.write(w)
+	authFailures.write(w)
+	cacheRequests.write(w)
+
+	if db == nil {
+		return
+	}
+
+	ps := db.PoolStats()
+
+	writeCounter(w, "super_graph_db_pool_hits_total",
+		"Times a free connection was found in the pool", float64(ps.Hits))
+	writeCounter(w, "super_graph_db_pool_misses_total",
+		"Times a free connection was not found in the pool", float64(ps.Misses))
+	writeCounter(w, "super_graph_db_pool_timeouts_total",
+		"Times waiting for a connection timed out", float64(ps.Timeouts))
+	writeCounter(w, "super_graph_db_pool_stale_conns_total",
+		"Stale connections removed from the pool", float64(ps.StaleConns))
+	writeGauge(w, "super_graph_db_pool_conns",
+		"Connections in the pool", float64(ps.TotalConns))
+	writeGauge(w, "super_graph_db_pool_idle_conns",
+		"Idle connections in the pool", float64(ps.IdleConns))
+}
+
+func writeCounter(w io.Writer, name, help string, v float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %s\n",
+		name, help, name, name, formatFloat(v))
+}
+
+func writeGauge(w io.Writer, name, help string, v float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n",
+		name, help, name, name, formatFloat(v))
+}
+
+// metricVec holds the values of a metric for each set of label values
+type metricVec struct {
+	sync.Mutex
+	name   string
+	help   string
+	labels []string
+	vals   map[string][]string
+}
+
+func (m *metricVec) key(lv []string) string {
+	if len(lv) != len(m.labels) {
+		panic(fmt.Errorf("%s: expected %d label values got %d",
+			m.name, len(m.labels), len(lv)))
+	}
+
+	k := strings.Join(lv, "\xff")
+	if _, ok := m.vals[k]; !ok {
+		m.vals[k] = lv
+	}
+	return k
+}
+
+func (m *metricVec) keys() []string {
+	keys := make([]string, 0, len(m.vals))
+	for k := range m.vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// labelPairs renders the labels like {operation="products",status="200"}
+// with the extra pair added at the end.
+func (m *metricVec) labelPairs(k string, extra ...string) string {
+	var sb strings.Builder
+
+	lv := m.vals[k]
+
+	if len(lv) == 0 && len(extra) == 0 {
+		return ""
+	}
+
+	sb.WriteByte('{')
+
+	for i := range lv {
+		if i != 0 {
+			sb.WriteByte(',')
+		}
+		fmt.Fprintf(&sb, "%s=\"%s\"", m.labels[i], escapeLabel(lv[i]))
+	}
+
+	for i := 0; i < len(extra); i += 2 {
+		if len(lv) != 0 || i != 0 {
+			sb.WriteByte(',')
+		}
+		fmt.Fprintf(&sb, "%s=\"%s\"", extra[i], extra[i+1])
+	}
+
+	sb.WriteByte('}')
+
+	return sb.String()
+}
+
+type counterVec struct {
+	metricVec
+	counts map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{
+		metricVec: metricVec{name: name, help: help, labels: labels,
+			vals: make(map[string][]string)},
+		counts: make(map[string]float64),
+	}
+}
+
+func (c *counterVec) inc(lv ...string) {
+	c.Lock()
+	c.counts[c.key(lv)]++
+	c.Unlock()
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.Lock()
+	defer c.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+
+	for _, k := range c.keys() {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelPairs(k), formatFloat(c.counts[k]))
+	}
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	metricVec
+	buckets []float64
+	hists   map[string]*histogram
+}
+
+func newHistogramVec(name, help string, labels ...string) *histogramVec {
+	return &histogramVec{
+		metricVec: metricVec{name: name, help: help, labels: labels,
+			vals: make(map[string][]string)},
+		buckets: durationBuckets,
+		hists:   make(map[string]*histogram),
+	}
+}
+
+func (h *histogramVec) observe(v float64, lv ...string) {
+	h.Lock()
+	defer h.Unlock()
+
+	k := h.key(lv)
+
+	hist, ok := h.hists[k]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.hists[k] = hist
+	}
+
+	for i, b := range h.buckets {
+		if v <= b {
+			hist.counts[i]++
+		}
+	}
+
+	hist.sum += v
+	hist.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+
+	for _, k := range h.keys() {
+		hist := h.hists[k]
+
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n",
+				h.name, h.labelPairs(k, "le", formatFloat(b)), hist.counts[i])
+		}
+
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(k, "le", "+Inf"), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelPairs(k), formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelPairs(k), hist.count)
+	}
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
@@ -0,0 +1,101 @@
+package serv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWithMetrics(t *testing.T) {
+	h := withMetrics(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			http.Error(w, "Not authorized", http.StatusUnauthorized)
+			return
+		}
+		setOpName(r.Context(), "getMetricsTest")
+		w.Write([]byte(`{}`))
+	})
+
+	h(httptest.NewRecorder(), httptest.NewRequest("POST", "/api/v1/graphql", nil))
+
+	r := httptest.NewRequest("POST", "/api/v1/graphql", nil)
+	r.Header.Set("Authorization", "Bearer x")
+	h(httptest.NewRecorder(), r)
+
+	var sb strings.Builder
+	requestsTotal.write(&sb)
+	out := sb.String()
+
+	for _, l := range []string{
+		`super_graph_requests_total{operation="anonymous",status="401"} 1`,
+		`super_graph_requests_total{operation="getMetricsTest",status="200"} 1`,
+	} {
+		if !strings.Contains(out, l+"\n") {
+			t.Errorf("expected '%s' in:\n%s", l, out)
+		}
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	conf = &config{}
+	conf.Metrics.Token = "secret"
+
+	w := httptest.NewRecorder()
+	metricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without the token got %d", w.Code)
+	}
+
+	observeRequest("metricsHandlerTest", 200, 3*time.Millisecond)
+
+	r := httptest.NewRequest("GET", "/metrics", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+
+	w = httptest.NewRecorder()
+	metricsHandler(w, r)
+
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("expected text/plain got '%s'", ct)
+	}
+
+	out := w.Body.String()
+
+	for _, l := range []string{
+		"# HELP super_graph_requests_total Requests handled by operation name and status",
+		"# TYPE super_graph_requests_total counter",
+		`super_graph_requests_total{operation="metricsHandlerTest",status="200"} 1`,
+		"# TYPE super_graph_request_duration_seconds histogram",
+		`super_graph_request_duration_seconds_bucket{operation="metricsHandlerTest",status="200",le="0.0025"} 0`,
+		`super_graph_request_duration_seconds_bucket{operation="metricsHandlerTest",status="200",le="0.005"} 1`,
+		`super_graph_request_duration_seconds_bucket{operation="metricsHandlerTest",status="200",le="+Inf"} 1`,
+		`super_graph_request_duration_seconds_sum{operation="metricsHandlerTest",status="200"} 0.003`,
+		`super_graph_request_duration_seconds_count{operation="metricsHandlerTest",status="200"} 1`,
+		"# TYPE super_graph_compile_duration_seconds histogram",
+		"# TYPE super_graph_cache_requests_total counter",
+	} {
+		if !strings.Contains(out, l+"\n") {
+			t.Errorf("expected '%s' in:\n%s", l, out)
+		}
+	}
+
+	if strings.Contains(out, "websocket") {
+		t.Error("expected no websocket metrics")
+	}
+}
+
+func TestOpLabel(t *testing.T) {
+	if v := opLabel(""); v != "anonymous" {
+		t.Errorf("expected anonymous got '%s'", v)
+	}
+
+	if v := opLabel("opLabelTest"); v != "opLabelTest" {
+		t.Errorf("expected opLabelTest got '%s'", v)
+	}
+
+	if v := escapeLabel("a\"b\\c\nd"); v != `a\"b\\c\nd` {
+		t.Errorf("expected the label to be escaped got '%s'", v)
+	}
+}
@@ -0,0 +1,255 @@
+package serv
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-pg/pg"
+)
+
+const migrationTable = "schema_version"
+
+var migrationRe = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// migration is a pair of files like '20190401120000_add_users.up.sql'
+// and '20190401120000_add_users.down.sql' in the migrations folder.
+type migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+	Applied bool
+}
+
+// loadMigrations reads the migrations folder and marks the migrations
+// already applied to the database, they are sorted by version.
+func loadMigrations(dir string) ([]*migration, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	mm := make(map[int64]*migration)
+
+	for _, f := range files {
+		v := migrationRe.FindStringSubmatch(f.Name())
+		if v == nil {
+			continue
+		}
+
+		ver, err := strconv.ParseInt(v[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := mm[ver]
+		if !ok {
+			m = &migration{Version: ver, Name: v[2]}
+			mm[ver] = m
+		}
+
+		if m.Name != v[2] {
+			return nil, fmt.Errorf("migrations '%s' and '%s' have the same version", m.Name, v[2])
+		}
+
+		if v[3] == "up" {
+			m.Up = filepath.Join(dir, f.Name())
+		} else {
+			m.Down = filepath.Join(dir, f.Name())
+		}
+	}
+
+	applied, err := appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	ms := make([]*migration, 0, len(mm))
+
+	for _, m := range mm {
+		_, m.Applied = applied[m.Version]
+		delete(applied, m.Version)
+		ms = append(ms, m)
+	}
+
+	for ver := range applied {
+		return nil, fmt.Errorf("migration %d is applied but its files are missing", ver)
+	}
+
+	sort.Slice(ms, func(i, j int) bool {
+		return ms[i].Version < ms[j].Version
+	})
+
+	return ms, nil
+}
+
+func appliedMigrations() (map[int64]struct{}, error) {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS ` + migrationTable + ` (
+		version bigint PRIMARY KEY,
+		name text NOT NULL,
+		applied_at timestamptz NOT NULL DEFAULT now())`)
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []int64
+
+	_, err = db.Query(&versions, `SELECT version FROM `+migrationTable)
+	if err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int64]struct{}, len(versions))
+	for _, v := range versions {
+		applied[v] = struct{}{}
+	}
+
+	return applied, nil
+}
+
+// runMigration applies or rolls back a single migration in a
+// transaction along with the change to the version table.
+func runMigration(m *migration, up bool) error {
+	file := m.Up
+	if !up {
+		file = m.Down
+	}
+
+	if len(file) == 0 {
+		return fmt.Errorf("migration %d_%s has no %s file", m.Version, m.Name, direction(up))
+	}
+
+	sql, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	err = db.RunInTransaction(func(tx *pg.Tx) error {
+		if _, err := tx.Exec(string(sql)); err != nil {
+			return err
+		}
+
+		if up {
+			_, err = tx.Exec(`INSERT INTO `+migrationTable+` (version, name) VALUES (?, ?)`,
+				m.Version, m.Name)
+		} else {
+			_, err = tx.Exec(`DELETE FROM `+migrationTable+` WHERE version = ?`,
+				m.Version)
+		}
+		return err
+	})
+
+	if err != nil {
+		return fmt.Errorf("%s: %s", filepath.Base(file), err)
+	}
+
+	fmt.Printf("%s %d_%s\n", direction(up), m.Version, m.Name)
+	return nil
+}
+
+func direction(up bool) string {
+	if up {
+		return "up"
+	}
+	return "down"
+}
+
+// migrateUp applies all the pending migrations in order.
+func migrateUp(dir string) (int, error) {
+	ms, err := loadMigrations(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+
+	for _, m := range ms {
+		if m.Applied {
+			continue
+		}
+		if err := runMigration(m, true); err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+// migrateDown rolls back the last n migrations applied.
+func migrateDown(dir string, n int) (int, error) {
+	ms, err := loadMigrations(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	done := 0
+
+	for i := len(ms) - 1; i >= 0 && done < n; i-- {
+		if !ms[i].Applied {
+			continue
+		}
+		if err := runMigration(ms[i], false); err != nil {
+			return done, err
+		}
+		done++
+	}
+
+	return done, nil
+}
+
+func migrateStatus(w io.Writer, dir string) error {
+	ms, err := loadMigrations(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range ms {
+		status := "pending"
+		if m.Applied {
+			status = "applied"
+		}
+		fmt.Fprintf(w, "%-8s %d_%s\n", status, m.Version, m.Name)
+	}
+
+	return nil
+}
+
+// migrateCreate adds empty up and down files for a new migration
+// versioned using the current time.
+func migrateCreate(dir, name string) error {
+	if !migrationRe.MatchString("0_" + name + ".up.sql") {
+		return fmt.Errorf("migration names can only have letters, numbers and '_'")
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	ver := time.Now().UTC().Format("20060102150405")
+
+	for _, d := range []string{"up", "down"} {
+		file := filepath.Join(dir, fmt.Sprintf("%s_%s.%s.sql", ver, name, d))
+
+		if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+			return err
+		}
+		fmt.Printf("created %s\n", file)
+	}
+
+	return nil
+}
+
+// notifySchemaChange lets running servers with 'reload_on_ddl' enabled
+// know they need to reload the schema.
+func notifySchemaChange() error {
+	_, err := db.Exec(`NOTIFY ` + ddlChannel)
+	return err
+}
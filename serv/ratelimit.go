@@ -0,0 +1,349 @@
+package serv
+
+import (
+	"container/list"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dosco/super-graph/qcode"
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	roleUser   = "user"
+	roleAPIKey = "api_key"
+	roleAnon   = "anon"
+
+	// rateBuckets is the number of buckets kept in memory, after that the
+	// least recently used ones are dropped
+	rateBuckets = 10000
+)
+
+var (
+	limiter        rateLimiter
+	trustedProxies []*net.IPNet
+)
+
+// rateLimiter takes cost tokens from the bucket with the key, when there
+// are not enough it returns how long till there will be.
+type rateLimiter interface {
+	take(key string, rate float64, burst, cost int) (time.Duration, error)
+}
+
+type rateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// rateKey is the bucket a request takes tokens from and the role the
+// limits come from.
+type rateKey struct {
+	key  string
+	role string
+}
+
+type rateLimitError struct {
+	retry time.Duration
+}
+
+func (e *rateLimitError) Error() string {
+	return "rate limit exceeded"
+}
+
+func initRateLimit(c *config) {
+	if !c.RateLimit.Enable {
+		return
+	}
+
+	for _, p := range c.RateLimit.TrustedProxies {
+		if !strings.Contains(p, "/") {
+			if strings.Contains(p, ":") {
+				p += "/128"
+			} else {
+				p += "/32"
+			}
+		}
+
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			logger.Fatalf("rate_limit: invalid trusted proxy '%s'", p)
+		}
+		trustedProxies = append(trustedProxies, n)
+	}
+
+	if len(c.RateLimit.URL) == 0 {
+		limiter = newMemLimiter(rateBuckets)
+	} else {
+		limiter = &redisLimiter{newRedisPool(c.RateLimit.URL, c.RateLimit.Password,
+			c.RateLimit.MaxIdle, c.RateLimit.MaxActive)}
+	}
+}
+
+// withRateLimit picks the bucket of a request using the user id, a valid
+// api key or the client ip in that order. It has to run after the auth
+// handler which sets the user id.
+func withRateLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if limiter == nil {
+			next(w, r)
+			return
+		}
+
+		var rk rateKey
+		ctx := r.Context()
+		h := conf.RateLimit.APIKeyHeader
+
+		if v := ctx.Value(userIDKey); v != nil {
+			rk = rateKey{"user:" + v.(string), roleUser}
+		} else if key := r.Header.Get(h); len(h) != 0 && validAPIKey(key) {
+			rk = rateKey{"key:" + key, roleAPIKey}
+		} else {
+			rk = rateKey{"ip:" + clientIP(r), roleAnon}
+		}
+
+		next(w, r.WithContext(context.WithValue(ctx, rateKeyKey, rk)))
+	}
+}
+
+// validAPIKey checks the key against the configured keys so random keys
+// cannot be used to get a new bucket.
+func validAPIKey(key string) bool {
+	if len(key) == 0 {
+		return false
+	}
+
+	for _, k := range conf.RateLimit.APIKeys {
+		if subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address the request came from. The ip header is
+// only used when the request comes from a trusted proxy, the client ip is
+// then the last address in it that is not a trusted proxy since the
+// addresses before it can be set by the client.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	h := conf.RateLimit.IPHeader
+	if len(h) == 0 || !trustedProxy(host) {
+		return host
+	}
+
+	hops := strings.Split(strings.Join(r.Header[http.CanonicalHeaderKey(h)], ","), ",")
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(hops[i])
+		if len(ip) == 0 {
+			continue
+		}
+		if !trustedProxy(ip) {
+			return ip
+		}
+		host = ip
+	}
+
+	return host
+}
+
+func trustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRateLimit takes a token from the bucket of the request, it's called
+// before the query is compiled so invalid queries are limited too. Roles
+// without limits in the config are not limited.
+func checkRateLimit(ctx context.Context) error {
+	return takeTokens(ctx, 1)
+}
+
+// checkQueryCost takes the rest of the cost of a compiled query when
+// query_cost is set, checkRateLimit has already taken one token.
+func checkQueryCost(ctx context.Context, qc *qcode.QCode) error {
+	if !conf.RateLimit.QueryCost {
+		return nil
+	}
+
+	if cost := queryCost(qc.Query.Select) - 1; cost > 0 {
+		return takeTokens(ctx, cost)
+	}
+	return nil
+}
+
+func takeTokens(ctx context.Context, cost int) error {
+	if limiter == nil {
+		return nil
+	}
+
+	rk, ok := ctx.Value(rateKeyKey).(rateKey)
+	if !ok {
+		return nil
+	}
+
+	lim, ok := conf.RateLimit.Roles[rk.role]
+	if !ok || lim.Rate <= 0 {
+		return nil
+	}
+
+	burst := lim.Burst
+	if burst < 1 {
+		burst = 1
+	}
+
+	// A query costing more than the bucket holds waits for a full one
+	if cost > burst {
+		cost = burst
+	}
+
+	retry, err := limiter.take(rk.key, lim.Rate, burst, cost)
+	if err != nil {
+		logger.Errorf("rate limit: %s", err)
+		return nil
+	}
+
+	if retry > 0 {
+		return &rateLimitError{retry}
+	}
+	return nil
+}
+
+// queryCost is the number of selects in the query, each one is a table
+// or a related table the database has to read.
+func queryCost(sel *qcode.Select) int {
+	n := 1
+	for _, s := range sel.Joins {
+		n += queryCost(s)
+	}
+	return n
+}
+
+func retryAfter(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// memLimiter keeps the buckets in memory so each instance of Super Graph
+// has its own limits. Only the most recently used buckets are kept, a
+// dropped bucket starts again full.
+type memLimiter struct {
+	sync.Mutex
+	max     int
+	buckets map[string]*list.Element
+	lru     *list.List
+}
+
+func newMemLimiter(max int) *memLimiter {
+	return &memLimiter{
+		max:     max,
+		buckets: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (l *memLimiter) take(key string, rate float64, burst, cost int) (time.Duration, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+
+	var b *bucket
+
+	if e, ok := l.buckets[key]; ok {
+		l.lru.MoveToFront(e)
+		b = e.Value.(*bucket)
+	} else {
+		for l.lru.Len() >= l.max {
+			e := l.lru.Back()
+			l.lru.Remove(e)
+			delete(l.buckets, e.Value.(*bucket).key)
+		}
+
+		b = &bucket{key, float64(burst), now}
+		l.buckets[key] = l.lru.PushFront(b)
+	}
+
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	if b.tokens < float64(cost) {
+		d := (float64(cost) - b.tokens) / rate
+		return time.Duration(d * float64(time.Second)), nil
+	}
+
+	b.tokens -= float64(cost)
+	return 0, nil
+}
+
+// redisLimiter keeps the buckets in redis so the limits are shared by
+// all the instances of Super Graph.
+type redisLimiter struct {
+	pool *redis.Pool
+}
+
+var takeScript = redis.NewScript(1, `
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local cost = tonumber(ARGV[3])
+local now = tonumber(ARGV[4])
+local b = redis.call('HMGET', KEYS[1], 'tokens', 'last')
+local tokens = tonumber(b[1]) or burst
+local last = tonumber(b[2]) or now
+local retry = 0
+tokens = math.min(burst, tokens + math.max(0, now - last) * rate)
+if tokens < cost then
+  retry = (cost - tokens) / rate
+else
+  tokens = tokens - cost
+end
+redis.call('HMSET', KEYS[1], 'tokens', tokens, 'last', now)
+redis.call('EXPIRE', KEYS[1], math.ceil(burst / rate) + 1)
+return tostring(retry)
+`)
+
+func (l *redisLimiter) take(key string, rate float64, burst, cost int) (time.Duration, error) {
+	conn := l.pool.Get()
+	defer conn.Close()
+
+	now := float64(time.Now().UnixNano()) / float64(time.Second)
+
+	v, err := redis.String(takeScript.Do(conn, "sg:rate:"+key,
+		rate, burst, cost, fmt.Sprintf("%.6f", now)))
+	if err != nil {
+		return 0, err
+	}
+
+	d, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(d * float64(time.Second)), nil
+}
@@ -0,0 +1,128 @@
+package serv
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMemLimiter(t *testing.T) {
+	l := newMemLimiter(10)
+
+	for i := 0; i < 3; i++ {
+		if d, _ := l.take("a", 1, 3, 1); d != 0 {
+			t.Fatalf("take %d: expecting a token got a wait of %s", i, d)
+		}
+	}
+
+	d, _ := l.take("a", 1, 3, 1)
+	if d <= 0 || d > time.Second {
+		t.Fatalf("expecting a wait of up to a second got %s", d)
+	}
+
+	if retryAfter(d) != "1" {
+		t.Fatalf("expecting Retry-After 1 got %s", retryAfter(d))
+	}
+
+	// other keys have their own bucket
+	if d, _ := l.take("b", 1, 3, 3); d != 0 {
+		t.Fatalf("expecting a full bucket for a new key got a wait of %s", d)
+	}
+}
+
+func TestMemLimiterEvicts(t *testing.T) {
+	l := newMemLimiter(2)
+
+	l.take("a", 1, 1, 1)
+	l.take("b", 1, 1, 1)
+	l.take("a", 1, 1, 0)
+	l.take("c", 1, 1, 1)
+
+	if len(l.buckets) != 2 || l.lru.Len() != 2 {
+		t.Fatalf("expecting 2 buckets got %d", len(l.buckets))
+	}
+
+	if _, ok := l.buckets["b"]; ok {
+		t.Fatal("expecting the least recently used bucket to be dropped")
+	}
+
+	if _, ok := l.buckets["a"]; !ok {
+		t.Fatal("expecting the recently used bucket to be kept")
+	}
+}
+
+func TestRateLimitKey(t *testing.T) {
+	conf = &config{}
+	conf.RateLimit.APIKeyHeader = "X-API-Key"
+	conf.RateLimit.APIKeys = []string{"good"}
+	conf.RateLimit.IPHeader = "X-Forwarded-For"
+
+	_, n, _ := net.ParseCIDR("10.0.0.0/8")
+	trustedProxies = []*net.IPNet{n}
+
+	limiter = newMemLimiter(10)
+	defer func() { limiter, trustedProxies = nil, nil }()
+
+	tests := []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		key     rateKey
+	}{
+		{"valid api key", "1.2.3.4:80",
+			map[string]string{"X-API-Key": "good"}, rateKey{"key:good", roleAPIKey}},
+		{"invalid api key", "1.2.3.4:80",
+			map[string]string{"X-API-Key": "random"}, rateKey{"ip:1.2.3.4", roleAnon}},
+		{"untrusted proxy", "1.2.3.4:80",
+			map[string]string{"X-Forwarded-For": "5.6.7.8"}, rateKey{"ip:1.2.3.4", roleAnon}},
+		{"trusted proxy", "10.0.0.1:80",
+			map[string]string{"X-Forwarded-For": "9.9.9.9, 5.6.7.8, 10.0.0.2"}, rateKey{"ip:5.6.7.8", roleAnon}},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/api/v1/graphql", nil)
+		r.RemoteAddr = tt.remote
+		for k, v := range tt.headers {
+			r.Header.Set(k, v)
+		}
+
+		var key rateKey
+		withRateLimit(func(w http.ResponseWriter, r *http.Request) {
+			key, _ = r.Context().Value(rateKeyKey).(rateKey)
+		})(httptest.NewRecorder(), r)
+
+		if key != tt.key {
+			t.Errorf("%s: expecting %v got %v", tt.name, tt.key, key)
+		}
+	}
+}
+
+func TestCheckRateLimit(t *testing.T) {
+	conf = &config{}
+	conf.RateLimit.Roles = map[string]rateLimit{roleAnon: {Rate: 1, Burst: 2}}
+
+	limiter = newMemLimiter(10)
+	defer func() { limiter = nil }()
+
+	ctx := context.WithValue(context.Background(), rateKeyKey, rateKey{"ip:1.2.3.4", roleAnon})
+
+	for i := 0; i < 2; i++ {
+		if err := checkRateLimit(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := checkRateLimit(ctx)
+	if _, ok := err.(*rateLimitError); !ok {
+		t.Fatalf("expecting a rate limit error got %v", err)
+	}
+
+	// roles without limits are not limited
+	ctx = context.WithValue(context.Background(), rateKeyKey, rateKey{"user:1", roleUser})
+	if err := checkRateLimit(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
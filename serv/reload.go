@@ -0,0 +1,133 @@
+package serv
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/dosco/super-graph/psql"
+	"github.com/dosco/super-graph/qcode"
+)
+
+const (
+	// ddlChannel is the channel the event trigger in the guide sends
+	// notifications to when the database schema changes
+	ddlChannel = "super_graph_ddl"
+
+	// ddlDelay groups the notifications sent by a migration with many
+	// statements into a single reload
+	ddlDelay = 2 * time.Second
+)
+
+type compilers struct {
+	qc *qcode.Compiler
+	pc *psql.Compiler
+}
+
+var (
+	comps    atomic.Value
+	reloadMu sync.Mutex
+)
+
+// getCompilers returns the current compilers, a request should call it
+// once and use the same pair throughout so a reload happening at the
+// same time does not affect it.
+func getCompilers() (*qcode.Compiler, *psql.Compiler) {
+	c := comps.Load().(*compilers)
+	return c.qc, c.pc
+}
+
+func setCompilers(qc *qcode.Compiler, pc *psql.Compiler) {
+	comps.Store(&compilers{qc, pc})
+}
+
+// reloadSchema reads the database schema again and swaps in new
+// compilers, requests already running finish with the old ones. The
+// schema is read from the database even when started from a snapshot
+// as the snapshot does not change after a migration.
+func reloadSchema(reason string) error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	qc, pc, err := initCompilers(conf, true)
+	if err != nil {
+		logger.Errorf("schema reload (%s): %s", reason, err)
+		return err
+	}
+
+	setCompilers(qc, pc)
+	flushCache()
+	if len(conf.DB.SchemaFile) != 0 {
+		logger.Infof("schema reloaded from the database not '%s' (%s)",
+			conf.DB.SchemaFile, reason)
+	} else {
+		logger.Infof("schema reloaded (%s)", reason)
+	}
+
+	return nil
+}
+
+func initReload(c *config) {
+	go reloadOnSignal()
+
+	if c.DB.ReloadOnDDL {
+		go reloadOnDDL()
+	}
+
+	if len(c.AdminToken) != 0 {
+		http.HandleFunc("/api/v1/admin/reload", withSecurity(adminReload))
+	}
+}
+
+func reloadOnSignal() {
+	sc := make(chan os.Signal, 1)
+	signal.Notify(sc, syscall.SIGHUP)
+
+	for range sc {
+		reloadSchema("SIGHUP")
+	}
+}
+
+func reloadOnDDL() {
+	ln := db.Listen(ddlChannel)
+	defer ln.Close()
+
+	var t *time.Timer
+
+	for range ln.Channel() {
+		if t != nil {
+			t.Reset(ddlDelay)
+			continue
+		}
+		t = time.AfterFunc(ddlDelay, func() {
+			reloadSchema("schema changed")
+		})
+	}
+}
+
+func adminReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	if subtle.ConstantTimeCompare([]byte(token), []byte(conf.AdminToken)) != 1 {
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return
+	}
+
+	if err := reloadSchema("admin"); err != nil {
+		errorResp(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,128 @@
+package serv
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// withSecurity sets the security headers, handles CORS and makes sure
+// requests authenticated using a cookie come from an allowed origin as
+// browsers send the cookie along with requests from any site.
+func withSecurity(next http.HandlerFunc) http.HandlerFunc {
+	c := conf.CORS
+
+	headers := c.AllowedHeaders
+	if len(headers) == 0 {
+		headers = []string{"Content-Type", "Authorization"}
+	}
+	if len(conf.Auth.Header) != 0 {
+		headers = append(headers, conf.Auth.Header)
+	}
+
+	allowHeaders := strings.Join(headers, ", ")
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("X-Frame-Options", "DENY")
+		h.Set("Referrer-Policy", "strict-origin-when-cross-origin")
+		h.Set("Content-Security-Policy", "default-src 'none'; frame-ancestors 'none'")
+
+		origin := r.Header.Get("Origin")
+
+		if len(origin) != 0 {
+			h.Add("Vary", "Origin")
+		}
+
+		// Credentials are only sent to origins that are listed, with '*'
+		// any site can read responses but without the user's cookie
+		switch {
+		case len(origin) == 0:
+		case allowedOrigin(origin):
+			h.Set("Access-Control-Allow-Origin", origin)
+
+			if c.AllowCredentials {
+				h.Set("Access-Control-Allow-Credentials", "true")
+			}
+		case anyOrigin():
+			h.Set("Access-Control-Allow-Origin", "*")
+		}
+
+		// Preflight request
+		if r.Method == http.MethodOptions &&
+			len(r.Header.Get("Access-Control-Request-Method")) != 0 {
+			h.Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			h.Set("Access-Control-Allow-Headers", allowHeaders)
+
+			if c.MaxAge != 0 {
+				h.Set("Access-Control-Max-Age", strconv.Itoa(c.MaxAge))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if r.Method != http.MethodGet && r.Method != http.MethodHead &&
+			hasAuthCookie(r) && !sameOrAllowedOrigin(r) {
+			http.Error(w, "Cross-site request blocked", http.StatusForbidden)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func hasAuthCookie(r *http.Request) bool {
+	if len(conf.Auth.Cookie) == 0 {
+		return false
+	}
+	_, err := r.Cookie(conf.Auth.Cookie)
+	return err == nil
+}
+
+// sameOrAllowedOrigin checks the Origin header or when missing the
+// Referer, requests with neither cannot be checked and are blocked. A '*'
+// in the allowed origins does not allow any site here.
+func sameOrAllowedOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+
+	if len(origin) == 0 {
+		origin = r.Header.Get("Referer")
+	}
+
+	if len(origin) == 0 {
+		return false
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || len(u.Host) == 0 {
+		return false
+	}
+
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+
+	return allowedOrigin(u.Scheme + "://" + u.Host)
+}
+
+// allowedOrigin is true when the origin is listed in the allowed origins,
+// a '*' does not match.
+func allowedOrigin(origin string) bool {
+	for _, o := range conf.CORS.AllowedOrigins {
+		if strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func anyOrigin() bool {
+	for _, o := range conf.CORS.AllowedOrigins {
+		if o == "*" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+package serv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+	conf = &config{}
+	conf.CORS.AllowedOrigins = []string{"https://app.example.com", "*"}
+	conf.CORS.AllowCredentials = true
+
+	h := withSecurity(func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		origin      string
+		allowOrigin string
+		credentials string
+	}{
+		{"https://app.example.com", "https://app.example.com", "true"},
+		{"https://evil.example.com", "*", ""},
+		{"", "", ""},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/api/v1/graphql", nil)
+		if len(tt.origin) != 0 {
+			r.Header.Set("Origin", tt.origin)
+		}
+
+		w := httptest.NewRecorder()
+		h(w, r)
+
+		if v := w.Header().Get("Access-Control-Allow-Origin"); v != tt.allowOrigin {
+			t.Errorf("origin %q: allow origin %q, expected %q", tt.origin, v, tt.allowOrigin)
+		}
+
+		if v := w.Header().Get("Access-Control-Allow-Credentials"); v != tt.credentials {
+			t.Errorf("origin %q: allow credentials %q, expected %q", tt.origin, v, tt.credentials)
+		}
+	}
+}
+
+func TestCSRF(t *testing.T) {
+	conf = &config{}
+	conf.Auth.Cookie = "session"
+	conf.CORS.AllowedOrigins = []string{"https://app.example.com", "*"}
+
+	h := withSecurity(func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		name    string
+		cookie  bool
+		headers map[string]string
+		status  int
+	}{
+		{"same host", true, map[string]string{"Origin": "http://example.com"}, 200},
+		{"allowed origin", true, map[string]string{"Origin": "https://app.example.com"}, 200},
+		{"allowed referer", true, map[string]string{"Referer": "https://app.example.com/page"}, 200},
+		{"other origin", true, map[string]string{"Origin": "https://evil.example.com"}, 403},
+		{"no origin or referer", true, nil, 403},
+		{"no cookie", false, map[string]string{"Origin": "https://evil.example.com"}, 200},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "http://example.com/api/v1/graphql", nil)
+		if tt.cookie {
+			r.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+		}
+		for k, v := range tt.headers {
+			r.Header.Set(k, v)
+		}
+
+		w := httptest.NewRecorder()
+		h(w, r)
+
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, expected %d", tt.name, w.Code, tt.status)
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package serv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dosco/super-graph/qcode"
+	"github.com/go-pg/pg"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// seedStep runs a mutation once with the rows in Data, or Count times
+// using Data as a template for each row. Strings in the template starting
+// with '=' are replaced by generated values, see seedValue.
+type seedStep struct {
+	Name     string
+	Mutation string
+	Count    int
+	Data     interface{}
+}
+
+// seedResults holds the rows returned by the earlier steps by name so
+// later steps can refer to them using '=pick <step>.<column>'.
+type seedResults map[string][]map[string]interface{}
+
+func runSeed(file string) error {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	var steps []seedStep
+
+	if err := yaml.Unmarshal(b, &steps); err != nil {
+		return fmt.Errorf("%s: %s", file, err)
+	}
+
+	// Seeds run as a superuser so none of the filters or the
+	// blacklist apply
+	qcompile, err := qcode.NewCompiler(qcode.Config{})
+	if err != nil {
+		return err
+	}
+	_, pcompile := getCompilers()
+
+	rand.Seed(time.Now().UnixNano())
+	res := make(seedResults)
+
+	return db.RunInTransaction(func(tx *pg.Tx) error {
+		for i, s := range steps {
+			name := s.Name
+			if len(name) == 0 {
+				name = strconv.Itoa(i + 1)
+			}
+
+			qc, err := qcompile.CompileQuery(s.Mutation)
+			if err != nil {
+				return fmt.Errorf("seed '%s': %s", name, err)
+			}
+
+			if qc.Type != qcode.QTMutation {
+				return fmt.Errorf("seed '%s': expecting a mutation", name)
+			}
+
+			data, n, err := seedData(&s, res)
+			if err != nil {
+				return fmt.Errorf("seed '%s': %s", name, err)
+			}
+
+			vars := map[string]json.RawMessage{qc.Query.Select.ActionVar: data}
+
+			_, stmt, err := compileStmt(context.Background(), qc, pcompile, vars)
+			if err != nil {
+				return fmt.Errorf("seed '%s': %s", name, err)
+			}
+
+			var root json.RawMessage
+
+			if _, err := tx.Query(pg.Scan(&root), stmt); err != nil {
+				return fmt.Errorf("seed '%s': %s", name, err)
+			}
+
+			if err := res.add(name, qc.Query.Select.FieldName, root); err != nil {
+				return fmt.Errorf("seed '%s': %s", name, err)
+			}
+
+			fmt.Printf("seed '%s': inserted %d rows\n", name, n)
+		}
+		return nil
+	})
+}
+
+// seedData returns the rows to insert as json and the number of rows.
+func seedData(s *seedStep, res seedResults) (json.RawMessage, int, error) {
+	var rows []interface{}
+
+	if s.Count == 0 {
+		switch v := s.Data.(type) {
+		case []interface{}:
+			rows = v
+		case map[interface{}]interface{}:
+			rows = []interface{}{v}
+		default:
+			return nil, 0, fmt.Errorf("data has to be a row or a list of rows")
+		}
+	} else {
+		for i := 0; i < s.Count; i++ {
+			rows = append(rows, s.Data)
+		}
+	}
+
+	for i := range rows {
+		v, err := seedRow(rows[i], i+1, res)
+		if err != nil {
+			return nil, 0, err
+		}
+		rows[i] = v
+	}
+
+	b, err := json.Marshal(rows)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return b, len(rows), nil
+}
+
+// seedRow converts a row read from yaml into one that can be encoded
+// as json and fills in the generated values.
+func seedRow(v interface{}, seq int, res seedResults) (interface{}, error) {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+
+		for k, val := range v {
+			val, err := seedRow(val, seq, res)
+			if err != nil {
+				return nil, err
+			}
+			m[fmt.Sprint(k)] = val
+		}
+		return m, nil
+
+	case []interface{}:
+		l := make([]interface{}, len(v))
+
+		for i := range v {
+			val, err := seedRow(v[i], seq, res)
+			if err != nil {
+				return nil, err
+			}
+			l[i] = val
+		}
+		return l, nil
+
+	case string:
+		if strings.HasPrefix(v, "==") {
+			return v[1:], nil
+		}
+		if strings.HasPrefix(v, "=") {
+			return seedValue(v[1:], seq, res)
+		}
+	}
+
+	return v, nil
+}
+
+func (res seedResults) add(name, field string, root json.RawMessage) error {
+	var data map[string]json.RawMessage
+
+	if err := json.Unmarshal(root, &data); err != nil {
+		return err
+	}
+
+	var rows []map[string]interface{}
+
+	d := data[field]
+
+	if len(d) != 0 && d[0] == '{' {
+		var row map[string]interface{}
+
+		if err := json.Unmarshal(d, &row); err != nil {
+			return err
+		}
+		rows = append(rows, row)
+
+	} else if err := json.Unmarshal(d, &rows); err != nil {
+		return err
+	}
+
+	res[name] = rows
+	return nil
+}
+
+// seedValue generates a value for expressions like 'fake.name',
+// 'fake.int 1 100', 'seq' and 'pick users.id'.
+func seedValue(exp string, seq int, res seedResults) (interface{}, error) {
+	args := strings.Fields(exp)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("empty expression '='")
+	}
+
+	switch args[0] {
+	case "seq":
+		return seq, nil
+
+	case "pick":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("usage: =pick <step>.<column>")
+		}
+		return res.pick(args[1])
+
+	case "fake.first_name":
+		return fakeItem(firstNames), nil
+
+	case "fake.last_name":
+		return fakeItem(lastNames), nil
+
+	case "fake.name":
+		return fakeItem(firstNames) + " " + fakeItem(lastNames), nil
+
+	case "fake.email":
+		return fmt.Sprintf("%s.%s%d@example.com",
+			strings.ToLower(fakeItem(firstNames)),
+			strings.ToLower(fakeItem(lastNames)), seq), nil
+
+	case "fake.phone":
+		return fmt.Sprintf("555-%03d-%04d", rand.Intn(1000), rand.Intn(10000)), nil
+
+	case "fake.word":
+		return fakeItem(words), nil
+
+	case "fake.sentence":
+		return fakeSentence(4 + rand.Intn(8)), nil
+
+	case "fake.paragraph":
+		p := make([]string, 3+rand.Intn(4))
+		for i := range p {
+			p[i] = fakeSentence(4 + rand.Intn(8))
+		}
+		return strings.Join(p, " "), nil
+
+	case "fake.bool":
+		return rand.Intn(2) == 1, nil
+
+	case "fake.int", "fake.float":
+		min, max, err := fakeRange(args)
+		if err != nil {
+			return nil, err
+		}
+		if args[0] == "fake.int" {
+			return int(min) + rand.Intn(int(max-min)+1), nil
+		}
+		return min + rand.Float64()*(max-min), nil
+
+	case "fake.date":
+		d := time.Duration(rand.Int63n(int64(365 * 24 * time.Hour)))
+		return time.Now().Add(-d).UTC().Format(time.RFC3339), nil
+	}
+
+	return nil, fmt.Errorf("unknown expression '=%s'", exp)
+}
+
+func (res seedResults) pick(ref string) (interface{}, error) {
+	v := strings.SplitN(ref, ".", 2)
+	if len(v) != 2 {
+		return nil, fmt.Errorf("usage: =pick <step>.<column>")
+	}
+
+	rows, ok := res[v[0]]
+	if !ok || len(rows) == 0 {
+		return nil, fmt.Errorf("no rows from seed '%s' to pick from", v[0])
+	}
+
+	val, ok := rows[rand.Intn(len(rows))][v[1]]
+	if !ok {
+		return nil, fmt.Errorf("seed '%s' did not return the column '%s'", v[0], v[1])
+	}
+
+	return val, nil
+}
+
+func fakeRange(args []string) (float64, float64, error) {
+	if len(args) != 3 {
+		return 0, 0, fmt.Errorf("usage: =%s <min> <max>", args[0])
+	}
+
+	min, err := strconv.ParseFloat(args[1], 64)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	max, err := strconv.ParseFloat(args[2], 64)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if max < min {
+		return 0, 0, fmt.Errorf("%s: max is less than min", args[0])
+	}
+
+	return min, max, nil
+}
+
+func fakeItem(list []string) string {
+	return list[rand.Intn(len(list))]
+}
+
+func fakeSentence(n int) string {
+	w := make([]string, n)
+	for i := range w {
+		w[i] = fakeItem(words)
+	}
+	s := strings.Join(w, " ")
+
+	return strings.ToUpper(s[:1]) + s[1:] + "."
+}
+
+var firstNames = []string{
+	"James", "Mary", "John", "Patricia", "Robert", "Jennifer", "Michael",
+	"Linda", "William", "Elizabeth", "David", "Barbara", "Richard", "Susan",
+	"Joseph", "Jessica", "Thomas", "Sarah", "Charles", "Karen", "Priya",
+	"Wei", "Fatima", "Carlos", "Aiko", "Olga", "Kwame", "Sofia",
+}
+
+var lastNames = []string{
+	"Smith", "Johnson", "Williams", "Brown", "Jones", "Garcia", "Miller",
+	"Davis", "Rodriguez", "Martinez", "Hernandez", "Lopez", "Wilson",
+	"Anderson", "Thomas", "Taylor", "Moore", "Jackson", "Martin", "Lee",
+	"Patel", "Chen", "Nakamura", "Ivanova", "Mensah", "Rossi",
+}
+
+var words = []string{
+	"lorem", "ipsum", "dolor", "sit", "amet", "consectetur", "adipiscing",
+	"elit", "sed", "do", "eiusmod", "tempor", "incididunt", "ut", "labore",
+	"et", "dolore", "magna", "aliqua", "enim", "ad", "minim", "veniam",
+	"quis", "nostrud", "exercitation", "ullamco", "laboris", "nisi",
+	"aliquip", "ex", "ea", "commodo", "consequat",
+}
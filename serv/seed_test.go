@@ -0,0 +1,222 @@
+package serv
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestSeedValue(t *testing.T) {
+	res := seedResults{
+		"users": {{"id": float64(7), "email": "a@example.com"}},
+	}
+
+	tests := []struct {
+		exp  string
+		want interface{}
+		err  string
+	}{
+		{exp: "seq", want: 3},
+		{exp: "pick users.id", want: float64(7)},
+		{exp: "pick users.email", want: "a@example.com"},
+		{exp: "fake.int 5 5", want: 5},
+		{exp: "fake.float 2.5 2.5", want: 2.5},
+		{exp: "", err: "empty expression"},
+		{exp: "pick users", err: "usage: =pick"},
+		{exp: "pick users.id extra", err: "usage: =pick"},
+		{exp: "pick products.id", err: "no rows from seed 'products'"},
+		{exp: "pick users.name", err: "did not return the column 'name'"},
+		{exp: "fake.int 1", err: "usage: =fake.int <min> <max>"},
+		{exp: "fake.int 10 1", err: "max is less than min"},
+		{exp: "fake.int a 1", err: "invalid syntax"},
+		{exp: "fake.nothing", err: "unknown expression '=fake.nothing'"},
+	}
+
+	for _, tt := range tests {
+		v, err := seedValue(tt.exp, 3, res)
+
+		if len(tt.err) != 0 {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("'%s': expected the error '%s' got %v", tt.exp, tt.err, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("'%s': %s", tt.exp, err)
+			continue
+		}
+
+		if v != tt.want {
+			t.Errorf("'%s': expected %v got %v", tt.exp, tt.want, v)
+		}
+	}
+}
+
+func TestSeedValueFake(t *testing.T) {
+	for _, exp := range []string{"fake.name", "fake.email", "fake.phone",
+		"fake.word", "fake.sentence", "fake.paragraph", "fake.date"} {
+
+		v, err := seedValue(exp, 1, nil)
+		if err != nil {
+			t.Errorf("'%s': %s", exp, err)
+			continue
+		}
+
+		if s, ok := v.(string); !ok || len(s) == 0 {
+			t.Errorf("'%s': expected a string got %v", exp, v)
+		}
+	}
+
+	if v, _ := seedValue("fake.email", 12, nil); !strings.HasSuffix(v.(string), "12@example.com") {
+		t.Errorf("expected the sequence in the email got %v", v)
+	}
+
+	if v, _ := seedValue("fake.int 1 3", 1, nil); v.(int) < 1 || v.(int) > 3 {
+		t.Errorf("expected an int from 1 to 3 got %v", v)
+	}
+}
+
+func TestSeedData(t *testing.T) {
+	res := seedResults{
+		"users": {{"id": float64(7)}},
+	}
+
+	tests := []struct {
+		name string
+		step string
+		want string
+		n    int
+	}{
+		{
+			name: "single row",
+			step: `data: { name: "=seq", user_id: "=pick users.id" }`,
+			want: `[{"name":1,"user_id":7}]`,
+			n:    1,
+		},
+		{
+			name: "list of rows",
+			step: `data: [{ id: "=seq" }, { id: "=seq" }]`,
+			want: `[{"id":1},{"id":2}]`,
+			n:    2,
+		},
+		{
+			name: "count",
+			step: `{ count: 3, data: { id: "=seq", tags: ["=seq", "==seq"] } }`,
+			want: `[{"id":1,"tags":[1,"=seq"]},{"id":2,"tags":[2,"=seq"]},{"id":3,"tags":[3,"=seq"]}]`,
+			n:    3,
+		},
+		{
+			name: "escape",
+			step: `data: { formula: "==A1+B1", note: "plain", price: 10 }`,
+			want: `[{"formula":"=A1+B1","note":"plain","price":10}]`,
+			n:    1,
+		},
+	}
+
+	for _, tt := range tests {
+		var s seedStep
+
+		if err := yaml.Unmarshal([]byte(tt.step), &s); err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+
+		b, n, err := seedData(&s, res)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+
+		if string(b) != tt.want || n != tt.n {
+			t.Errorf("%s: expected %d rows %s got %d rows %s", tt.name, tt.n, tt.want, n, b)
+		}
+	}
+}
+
+func TestSeedDataInvalid(t *testing.T) {
+	for _, step := range []string{
+		`data: 5`,
+		`data: "=seq"`,
+		`data: { id: "=nothing" }`,
+		`{ count: 2, data: { id: "=pick users.id" } }`,
+	} {
+		var s seedStep
+
+		if err := yaml.Unmarshal([]byte(step), &s); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, _, err := seedData(&s, seedResults{}); err == nil {
+			t.Errorf("expected an error for '%s'", step)
+		}
+	}
+}
+
+func TestSeedResults(t *testing.T) {
+	res := make(seedResults)
+
+	if err := res.add("list", "users", json.RawMessage(`{"users":[{"id":1},{"id":2}]}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := res.add("single", "user", json.RawMessage(`{"user":{"id":3}}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := res.add("none", "users", json.RawMessage(`{"users":[]}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res["list"]) != 2 || len(res["single"]) != 1 || len(res["none"]) != 0 {
+		t.Errorf("expected 2, 1 and 0 rows got %v", res)
+	}
+
+	for i := 0; i < 10; i++ {
+		v, err := res.pick("list.id")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != float64(1) && v != float64(2) {
+			t.Fatalf("expected the id of a row in the list got %v", v)
+		}
+	}
+
+	if v, err := res.pick("single.id"); err != nil || v != float64(3) {
+		t.Errorf("expected 3 got %v, %v", v, err)
+	}
+
+	if _, err := res.pick("none.id"); err == nil {
+		t.Error("expected an error picking from no rows")
+	}
+
+	if err := res.add("bad", "users", json.RawMessage(`{"users":"x"}`)); err == nil {
+		t.Error("expected an error for rows that are not objects")
+	}
+}
+
+func TestRunSeedInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := runSeed(filepath.Join(dir, "missing.yml")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+
+	file := filepath.Join(dir, "seed.yml")
+
+	if err := ioutil.WriteFile(file, []byte("name: [x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runSeed(file); err == nil || !strings.HasPrefix(err.Error(), file) {
+		t.Errorf("expected an error for the file got %v", err)
+	}
+}
@@ -2,7 +2,6 @@ package serv
 
 import (
 	"errors"
-	"flag"
 	"fmt"
 	"log"
 	"net/http"
@@ -29,8 +28,6 @@ var (
 	logger        *logrus.Logger
 	conf          *config
 	db            *pg.DB
-	pcompile      *psql.Compiler
-	qcompile      *qcode.Compiler
 	authFailBlock int
 )
 
@@ -42,8 +39,64 @@ type config struct {
 	DebugLevel    int    `mapstructure:"debug_level"`
 	EnableTracing bool   `mapstructure:"enable_tracing"`
 	AuthFailBlock string `mapstructure:"auth_fail_block"`
+	AdminToken    string `mapstructure:"admin_token"`
 	Inflections   map[string]string
 
+	CORS struct {
+		AllowedOrigins   []string `mapstructure:"allowed_origins"`
+		AllowedHeaders   []string `mapstructure:"allowed_headers"`
+		AllowCredentials bool     `mapstructure:"allow_credentials"`
+		MaxAge           int      `mapstructure:"max_age"`
+	} `mapstructure:"cors"`
+
+	CacheControl struct {
+		Default    string
+		Operations map[string]string
+	} `mapstructure:"cache_control"`
+
+	Cache struct {
+		Enable     bool
+		URL        string
+		Password   string
+		MaxIdle    int `mapstructure:"max_idle"`
+		MaxActive  int `mapstructure:"max_active"`
+		MaxEntries int `mapstructure:"max_entries"`
+		TTL        int
+		Tables     map[string]int
+	}
+
+	RateLimit struct {
+		Enable         bool
+		URL            string
+		Password       string
+		MaxIdle        int      `mapstructure:"max_idle"`
+		MaxActive      int      `mapstructure:"max_active"`
+		APIKeyHeader   string   `mapstructure:"api_key_header"`
+		APIKeys        []string `mapstructure:"api_keys"`
+		IPHeader       string   `mapstructure:"ip_header"`
+		TrustedProxies []string `mapstructure:"trusted_proxies"`
+		QueryCost      bool     `mapstructure:"query_cost"`
+		Roles          map[string]rateLimit
+	} `mapstructure:"rate_limit"`
+
+	Tracing struct {
+		Exporter    string
+		Endpoint    string
+		ServiceName string  `mapstructure:"service_name"`
+		SampleRatio float64 `mapstructure:"sample_ratio"`
+		Explain     bool
+	}
+
+	Metrics struct {
+		Enable bool
+		Token  string
+	}
+
+	Batch struct {
+		Concurrency   int
+		MaxOperations int `mapstructure:"max_operations"`
+	}
+
 	Auth struct {
 		Type   string
 		Cookie string
@@ -81,6 +134,11 @@ type config struct {
 		MaxRetries int    `mapstructure:"max_retries"`
 		LogLevel   string `mapstructure:"log_level"`
 
+		ReloadOnDDL bool   `mapstructure:"reload_on_ddl"`
+		SchemaFile  string `mapstructure:"schema_file"`
+
+		MigrationsPath string `mapstructure:"migrations_path"`
+
 		Variables map[string]string
 
 		Defaults struct {
@@ -88,11 +146,52 @@ type config struct {
 			Blacklist []string
 		}
 
+		RLS struct {
+			Enable   bool
+			Role     string
+			AnonRole string `mapstructure:"anon_role"`
+		} `mapstructure:"rls"`
+
 		Fields []struct {
 			Name      string
 			Filter    []string
 			Table     string
 			Blacklist []string
+			RLS       bool `mapstructure:"rls"`
+
+			Search struct {
+				Column        string
+				Language      string
+				Parser        string
+				Normalization string
+			}
+		}
+
+		Relationships []struct {
+			Name                  string
+			Type                  string
+			Table                 string
+			Columns               []string
+			Through               string
+			ThroughColumns        []string `mapstructure:"through_columns"`
+			ThroughForeignColumns []string `mapstructure:"through_foreign_columns"`
+			ForeignTable          string   `mapstructure:"foreign_table"`
+			ForeignColumns        []string `mapstructure:"foreign_columns"`
+			TypeColumn            string   `mapstructure:"type_column"`
+			TypeValue             string   `mapstructure:"type_value"`
+		}
+
+		Functions []struct {
+			Name     string
+			Table    string
+			Function string
+			Args     []string
+			Type     string
+		}
+
+		Mutations []struct {
+			Name      string
+			Anonymous bool
 		}
 	} `mapstructure:"database"`
 }
@@ -108,17 +207,14 @@ func initLog() *logrus.Logger {
 	return log
 }
 
-func initConf() (*config, error) {
+func initConf(path string) (*config, error) {
 	vi := viper.New()
 
-	path := flag.String("path", "./", "Path to config files")
-	flag.Parse()
-
 	vi.SetEnvPrefix("SG")
 	vi.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 	vi.AutomaticEnv()
 
-	vi.AddConfigPath(*path)
+	vi.AddConfigPath(path)
 	vi.AddConfigPath("./config")
 	vi.SetConfigName(getConfigName())
 
@@ -127,11 +223,22 @@ func initConf() (*config, error) {
 	vi.SetDefault("debug_level", 0)
 	vi.SetDefault("enable_tracing", false)
 	vi.SetDefault("auth_fail_block", "always")
+	vi.SetDefault("cache_control.default", "private, no-cache")
+	vi.SetDefault("cache.ttl", 60)
+	vi.SetDefault("cache.max_entries", 10000)
+	vi.SetDefault("cache.max_idle", 10)
+	vi.SetDefault("rate_limit.max_idle", 10)
+	vi.SetDefault("tracing.endpoint", "http://localhost:4318")
+	vi.SetDefault("tracing.service_name", "super-graph")
+	vi.SetDefault("tracing.sample_ratio", 1.0)
+	vi.SetDefault("batch.concurrency", 4)
+	vi.SetDefault("batch.max_operations", 20)
 
 	vi.SetDefault("database.type", "postgres")
 	vi.SetDefault("database.host", "localhost")
 	vi.SetDefault("database.port", 5432)
 	vi.SetDefault("database.user", "postgres")
+	vi.SetDefault("database.migrations_path", "./config/migrations")
 
 	vi.SetDefault("env", "development")
 	vi.BindEnv("env", "GO_ENV")
@@ -195,16 +302,26 @@ func initDB(c *config) (*pg.DB, error) {
 	return db, nil
 }
 
-func initCompilers(c *config) (*qcode.Compiler, *psql.Compiler, error) {
+// initCompilers creates the compilers, fromDB reads the schema from the
+// database even when a snapshot file is set.
+func initCompilers(c *config, fromDB bool) (*qcode.Compiler, *psql.Compiler, error) {
 	cdb := c.DB
 
 	fm := make(map[string][]string, len(cdb.Fields))
 	tmap := make(map[string]string, len(cdb.Fields))
+	sm := make(map[string]qcode.Search, len(cdb.Fields))
 
 	for i := range cdb.Fields {
 		f := cdb.Fields[i]
 		name := flect.Pluralize(strings.ToLower(f.Name))
-		if len(f.Filter) != 0 {
+
+		// Postgres row level security filters the rows instead
+		if f.RLS {
+			if !cdb.RLS.Enable {
+				return nil, nil, fmt.Errorf("field '%s': rls is not enabled", f.Name)
+			}
+			fm[name] = []string{}
+		} else if len(f.Filter) != 0 {
 			if f.Filter[0] == "none" {
 				fm[name] = []string{}
 			} else {
@@ -214,52 +331,169 @@ func initCompilers(c *config) (*qcode.Compiler, *psql.Compiler, error) {
 		if len(f.Table) != 0 {
 			tmap[name] = f.Table
 		}
+		sm[name] = qcode.Search{
+			Column:   f.Search.Column,
+			Lang:     f.Search.Language,
+			Parser:   f.Search.Parser,
+			RankNorm: f.Search.Normalization,
+		}
+	}
+
+	schema, err := initSchema(c, fromDB)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Fields calling a function get the filters of the table it returns,
+	// tables and mapped fields with the same name are used over functions
+	fnm := make(map[string]string, len(schema.TableFuncs))
+
+	for name, fn := range schema.TableFuncs {
+		if _, ok := schema.Tables[name]; ok {
+			continue
+		}
+		if _, ok := tmap[name]; ok {
+			continue
+		}
+		fnm[name] = fn.Table
 	}
 
 	qc, err := qcode.NewCompiler(qcode.Config{
 		Filter:    cdb.Defaults.Filter,
 		FilterMap: fm,
 		Blacklist: cdb.Defaults.Blacklist,
+		SearchMap: sm,
+		FuncMap:   fnm,
 	})
 	if err != nil {
 		return nil, nil, err
 	}
 
-	schema, err := psql.NewDBSchema(db)
-	if err != nil {
+	rels := make([]psql.RelConfig, len(cdb.Relationships))
+
+	for i, r := range cdb.Relationships {
+		rels[i] = psql.RelConfig{
+			Name:                  r.Name,
+			Type:                  r.Type,
+			Table:                 r.Table,
+			Columns:               r.Columns,
+			Through:               r.Through,
+			ThroughColumns:        r.ThroughColumns,
+			ThroughForeignColumns: r.ThroughForeignColumns,
+			ForeignTable:          r.ForeignTable,
+			ForeignColumns:        r.ForeignColumns,
+			TypeColumn:            r.TypeColumn,
+			TypeValue:             r.TypeValue,
+		}
+	}
+
+	if err := schema.AddRelationships(rels); err != nil {
 		return nil, nil, err
 	}
 
+	funcs := make([]psql.FuncConfig, len(cdb.Functions))
+
+	for i, f := range cdb.Functions {
+		funcs[i] = psql.FuncConfig{
+			Name:     f.Name,
+			Table:    f.Table,
+			Function: f.Function,
+			Args:     f.Args,
+			Type:     f.Type,
+		}
+	}
+
+	if err := schema.AddFunctions(funcs); err != nil {
+		return nil, nil, err
+	}
+
+	muts := make([]string, len(cdb.Mutations))
+
+	for i, m := range cdb.Mutations {
+		muts[i] = m.Name
+	}
+
 	pc := psql.NewCompiler(psql.Config{
-		Schema:   schema,
-		Vars:     cdb.Variables,
-		TableMap: tmap,
+		Schema:    schema,
+		Vars:      psql.NewVariables(cdb.Variables),
+		TableMap:  tmap,
+		Mutations: muts,
 	})
 
 	return qc, pc, nil
 }
 
-func InitAndListen() {
+// initSchema reads the schema from the snapshot file when one is set
+// in the config or else from the database.
+func initSchema(c *config, fromDB bool) (*psql.DBSchema, error) {
+	if fromDB || len(c.DB.SchemaFile) == 0 {
+		return psql.NewDBSchema(db)
+	}
+
+	snap, err := psql.LoadSnapshot(c.DB.SchemaFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return snap.Schema(), nil
+}
+
+func saveSchema(file string) error {
+	snap, err := psql.NewSnapshot(db)
+	if err != nil {
+		return err
+	}
+
+	return psql.SaveSnapshot(file, snap)
+}
+
+// initAll loads the config, connects to the database and creates the
+// compilers, everything the commands other than 'version' need.
+func initAll(path string) error {
 	var err error
 
 	logger = initLog()
 
-	conf, err = initConf()
+	conf, err = initConf(path)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	db, err = initDB(conf)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	qcompile, pcompile, err = initCompilers(conf)
+	qc, pc, err := initCompilers(conf, false)
 	if err != nil {
+		return err
+	}
+	setCompilers(qc, pc)
+
+	return nil
+}
+
+func initAndListen(path string) {
+	if err := initAll(path); err != nil {
 		log.Fatal(err)
 	}
 
-	http.HandleFunc("/api/v1/graphql", withAuth(apiv1Http))
+	initReload(conf)
+	initCache(conf)
+	initRateLimit(conf)
+	initTracing(conf)
+
+	api := withTracing(withSecurity(withAuth(withRateLimit(apiv1Http))))
+
+	if conf.Metrics.Enable {
+		api = withMetrics(api)
+	}
+
+	http.HandleFunc("/api/v1/graphql", api)
+
+	if conf.Metrics.Enable {
+		http.HandleFunc("/metrics", metricsHandler)
+	}
 
 	if conf.WebUI {
 		http.Handle("/", http.FileServer(_escFS(false)))
@@ -0,0 +1,400 @@
+package serv
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mrand "math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dosco/super-graph/qcode"
+)
+
+const (
+	traceparentHeader = "traceparent"
+
+	// OTLP span kinds
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+
+	// exportBatch is the most spans sent in one export and exportQueue
+	// the most waiting to be sent, spans after that are dropped
+	exportBatch    = 100
+	exportQueue    = 2048
+	exportInterval = 2 * time.Second
+)
+
+var (
+	exporter   *spanExporter
+	otlpClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+type traceID [16]byte
+type spanID [8]byte
+
+// span is a timed part of handling a request, spans of the same trace
+// share the trace id and point to their parent span.
+type span struct {
+	traceID  traceID
+	id       spanID
+	parentID spanID
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    map[string]string
+	err      string
+}
+
+func initTracing(c *config) {
+	var export func([]*span) error
+
+	switch c.Tracing.Exporter {
+	case "":
+		return
+
+	case "stdout":
+		export = exportStdout
+
+	case "otlp":
+		url := strings.TrimSuffix(c.Tracing.Endpoint, "/") + "/v1/traces"
+		export = func(spans []*span) error {
+			return exportOTLP(url, c.Tracing.ServiceName, spans)
+		}
+
+	default:
+		logger.Fatalf("unknown tracing exporter '%s'", c.Tracing.Exporter)
+	}
+
+	exporter = &spanExporter{make(chan *span, exportQueue), export}
+	go exporter.run()
+}
+
+// withTracing starts the root span of a request, it continues the trace
+// from the traceparent header when there is one.
+func withTracing(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if exporter == nil {
+			next(w, r)
+			return
+		}
+
+		sp := &span{
+			name:  r.Method + " " + r.URL.Path,
+			kind:  spanKindServer,
+			start: time.Now(),
+			attrs: map[string]string{
+				"http.method": r.Method,
+				"http.target": r.URL.Path,
+			},
+		}
+
+		tid, pid, sampled, err := parseTraceparent(r.Header.Get(traceparentHeader))
+		if err == nil {
+			sp.traceID, sp.parentID = tid, pid
+		} else {
+			rand.Read(sp.traceID[:])
+			sampled = mrand.Float64() < conf.Tracing.SampleRatio
+		}
+
+		if !sampled {
+			next(w, r)
+			return
+		}
+
+		rand.Read(sp.id[:])
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next(sw, r.WithContext(context.WithValue(r.Context(), spanKey, sp)))
+
+		sp.attrs["http.status_code"] = strconv.Itoa(sw.status)
+		if sw.status >= 500 {
+			sp.err = http.StatusText(sw.status)
+		}
+		sp.finish()
+	}
+}
+
+// parseTraceparent parses a W3C traceparent header like
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+func parseTraceparent(v string) (traceID, spanID, bool, error) {
+	var tid traceID
+	var pid spanID
+
+	p := strings.Split(strings.TrimSpace(v), "-")
+	if len(p) < 4 || len(p[0]) != 2 || p[0] == "ff" ||
+		len(p[1]) != 32 || len(p[2]) != 16 || len(p[3]) != 2 {
+		return tid, pid, false, errors.New("invalid traceparent")
+	}
+
+	// version 00 has exactly four parts, later ones may add more
+	if p[0] == "00" && len(p) != 4 {
+		return tid, pid, false, errors.New("invalid traceparent")
+	}
+
+	if _, err := hex.Decode(tid[:], []byte(p[1])); err != nil {
+		return tid, pid, false, err
+	}
+
+	if _, err := hex.Decode(pid[:], []byte(p[2])); err != nil {
+		return tid, pid, false, err
+	}
+
+	flags, err := hex.DecodeString(p[3])
+	if err != nil {
+		return tid, pid, false, err
+	}
+
+	if tid == (traceID{}) || pid == (spanID{}) {
+		return tid, pid, false, errors.New("invalid traceparent")
+	}
+
+	return tid, pid, flags[0]&1 == 1, nil
+}
+
+// startSpan starts a child of the span in the context, it returns a nil
+// span when the request is not traced. Methods on a nil span do nothing.
+func startSpan(ctx context.Context, name string) (context.Context, *span) {
+	parent, ok := ctx.Value(spanKey).(*span)
+	if !ok {
+		return ctx, nil
+	}
+
+	sp := &span{
+		traceID:  parent.traceID,
+		parentID: parent.id,
+		name:     name,
+		kind:     spanKindInternal,
+		start:    time.Now(),
+		attrs:    make(map[string]string),
+	}
+	rand.Read(sp.id[:])
+
+	return context.WithValue(ctx, spanKey, sp), sp
+}
+
+// addSpan adds a finished child span that started and ended at the
+// times given.
+func addSpan(ctx context.Context, name string, st, et time.Time) {
+	if _, sp := startSpan(ctx, name); sp != nil {
+		sp.start = st
+		sp.end = et
+		exporter.add(sp)
+	}
+}
+
+// phaseSpans adds a span for each phase of compiling a query.
+func phaseSpans(ctx context.Context) qcode.PhaseFunc {
+	if ctx.Value(spanKey) == nil {
+		return nil
+	}
+
+	return func(phase string, st, et time.Time) {
+		addSpan(ctx, "graphql."+phase, st, et)
+	}
+}
+
+func (sp *span) setAttr(key, val string) {
+	if sp != nil {
+		sp.attrs[key] = val
+	}
+}
+
+func (sp *span) setKind(kind int) {
+	if sp != nil {
+		sp.kind = kind
+	}
+}
+
+func (sp *span) setError(err error) {
+	if sp != nil && err != nil {
+		sp.err = err.Error()
+	}
+}
+
+func (sp *span) finish() {
+	if sp != nil {
+		sp.end = time.Now()
+		exporter.add(sp)
+	}
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// spanExporter sends finished spans in batches so exporting does not slow
+// down requests.
+type spanExporter struct {
+	spans  chan *span
+	export func([]*span) error
+}
+
+func (e *spanExporter) add(sp *span) {
+	select {
+	case e.spans <- sp:
+	default:
+		logger.Warn("tracing: export queue full, span dropped")
+	}
+}
+
+func (e *spanExporter) run() {
+	tick := time.NewTicker(exportInterval)
+	batch := make([]*span, 0, exportBatch)
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.export(batch); err != nil {
+			logger.Errorf("tracing: %s", err)
+		}
+		batch = make([]*span, 0, exportBatch)
+	}
+
+	for {
+		select {
+		case sp := <-e.spans:
+			if batch = append(batch, sp); len(batch) == exportBatch {
+				flush()
+			}
+		case <-tick.C:
+			flush()
+		}
+	}
+}
+
+// exportStdout writes each span as a line of json
+func exportStdout(spans []*span) error {
+	enc := json.NewEncoder(os.Stdout)
+
+	for _, sp := range spans {
+		v := map[string]interface{}{
+			"trace_id":   hex.EncodeToString(sp.traceID[:]),
+			"span_id":    hex.EncodeToString(sp.id[:]),
+			"name":       sp.name,
+			"start":      sp.start,
+			"duration":   sp.end.Sub(sp.start).String(),
+			"attributes": sp.attrs,
+		}
+
+		if sp.parentID != (spanID{}) {
+			v["parent_id"] = hex.EncodeToString(sp.parentID[:])
+		}
+
+		if len(sp.err) != 0 {
+			v["error"] = sp.err
+		}
+
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []otlpAttr `json:"attributes,omitempty"`
+	Status            otlpStatus `json:"status"`
+}
+
+// exportOTLP posts the spans to an OpenTelemetry collector using the OTLP
+// HTTP protocol with json encoding.
+func exportOTLP(url, service string, spans []*span) error {
+	ss := make([]otlpSpan, 0, len(spans))
+
+	for _, sp := range spans {
+		s := otlpSpan{
+			TraceID:           hex.EncodeToString(sp.traceID[:]),
+			SpanID:            hex.EncodeToString(sp.id[:]),
+			Name:              sp.name,
+			Kind:              sp.kind,
+			StartTimeUnixNano: strconv.FormatInt(sp.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(sp.end.UnixNano(), 10),
+		}
+
+		if sp.parentID != (spanID{}) {
+			s.ParentSpanID = hex.EncodeToString(sp.parentID[:])
+		}
+
+		for k, v := range sp.attrs {
+			s.Attributes = append(s.Attributes, otlpAttr{k, otlpValue{v}})
+		}
+
+		if len(sp.err) != 0 {
+			s.Status = otlpStatus{2, sp.err}
+		}
+
+		ss = append(ss, s)
+	}
+
+	body := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []otlpAttr{{"service.name", otlpValue{service}}},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "super-graph"},
+						"spans": ss,
+					},
+				},
+			},
+		},
+	}
+
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	res, err := otlpClient.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("otlp export failed: %s", res.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,59 @@
+package serv
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tid, pid, sampled, err := parseTraceparent(
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v := hex.EncodeToString(tid[:]); v != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("expected trace id got %s", v)
+	}
+
+	if v := hex.EncodeToString(pid[:]); v != "00f067aa0ba902b7" {
+		t.Errorf("expected parent id got %s", v)
+	}
+
+	if !sampled {
+		t.Error("expected sampled")
+	}
+
+	_, _, sampled, err = parseTraceparent(
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	if err != nil || sampled {
+		t.Errorf("expected not sampled got %t, %v", sampled, err)
+	}
+
+	// Later versions may add parts
+	_, _, _, err = parseTraceparent(
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestParseTraceparentInvalid(t *testing.T) {
+	values := []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01",
+		"00-zbf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-zz",
+	}
+
+	for _, v := range values {
+		if _, _, _, err := parseTraceparent(v); err == nil {
+			t.Errorf("expected an error for '%s'", v)
+		}
+	}
+}